@@ -0,0 +1,76 @@
+/*
+Copyright © 2021 Joe Kralicky
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kit
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/kralicky/kit/pkg/machinery"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var DaemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "Pull from the remote continuously in the background",
+	Long: `Pull from the remote periodically. Changes that do not conflict with the
+local kubeconfig are applied automatically. Conflicts (contexts that would be
+modified, replaced, renamed or deleted) are kept until they are resolved with
+'kit resolve'. While the daemon is running, 'kit status' reports its status.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var config *machinery.KitConfig
+		var err error
+		if config, err = readRemoteConfig(cmd); err != nil {
+			log.Fatal(err)
+		}
+		// The cache is read and written in the background
+		if err := config.UnlockCache(); err != nil {
+			log.Fatal(err)
+		}
+		interval := config.DaemonInterval()
+		if cmd.Flags().Changed("interval") {
+			interval, _ = cmd.Flags().GetDuration("interval")
+		}
+		var client *machinery.RemoteClient
+		if client, err = newRemoteClient(config); err != nil {
+			log.Fatal(err)
+		}
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+		if err := client.WatchToken(ctx); err != nil {
+			log.Fatal(err)
+		}
+		daemon := machinery.NewDaemon(config, client)
+		listener, err := daemon.Listen()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Pulling from %s every %s (control socket %s)",
+			config.RemoteName(), interval, listener.Addr())
+		if err := daemon.Run(ctx, listener, interval); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	DaemonCmd.Flags().Duration("interval", machinery.DefaultDaemonInterval, "Time between pulls from the remote")
+}
@@ -28,17 +28,17 @@ var FetchCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		var config *machinery.KitConfig
 		var err error
-		if config, err = machinery.ReadConfig(); err != nil {
+		if config, err = readRemoteConfig(cmd); err != nil {
 			log.Fatal(err)
 		}
 		var client *machinery.RemoteClient
-		if client, err = machinery.NewRemoteClient(config); err != nil {
+		if client, err = newRemoteClient(config); err != nil {
 			log.Fatal(err)
 		}
 		if cache, err := client.LoadRemoteData(); err != nil {
 			log.Fatal(err)
 		} else {
-			if err := cache.WriteToDisk(); err != nil {
+			if err := cache.WriteToDisk(config); err != nil {
 				log.Fatal(err)
 			}
 		}
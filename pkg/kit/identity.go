@@ -0,0 +1,77 @@
+/*
+Copyright © 2021 Joe Kralicky
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kit
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/kralicky/kit/pkg/machinery"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var IdentityCmd = &cobra.Command{
+	Use:   "identity",
+	Short: "Print the public key others can share contexts with, creating it if necessary",
+	Run: func(cmd *cobra.Command, args []string) {
+		var config *machinery.KitConfig
+		var err error
+		if config, err = readConfig(); err != nil {
+			log.Fatal(err)
+		}
+		if signing, _ := cmd.Flags().GetBool("signing"); signing {
+			printSigningKey(config)
+			return
+		}
+		path := config.IdentityPath()
+		identity, err := machinery.LoadIdentity(path)
+		if os.IsNotExist(err) {
+			if identity, err = machinery.GenerateIdentity(); err != nil {
+				log.Fatal(err)
+			}
+			if err := identity.WriteToDisk(path); err != nil {
+				log.Fatal(err)
+			}
+			log.Infof("Created a new identity in %s", path)
+		} else if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(identity.Recipient())
+	},
+}
+
+func printSigningKey(config *machinery.KitConfig) {
+	path := config.SigningKeyPath()
+	key, err := machinery.LoadSigningKey(path)
+	if os.IsNotExist(err) {
+		if key, err = machinery.GenerateSigningKey(); err != nil {
+			log.Fatal(err)
+		}
+		if err := machinery.WriteSigningKey(path, key); err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Created a new signing key in %s", path)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(machinery.SigningPublicKey(key))
+}
+
+func init() {
+	IdentityCmd.Flags().Bool("signing", false, "Print the public key used to sign pushes instead")
+}
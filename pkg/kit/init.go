@@ -28,14 +28,14 @@ var InitCmd = &cobra.Command{
 	Use:   "init",
 	Short: "Initialize kit using the existing kubeconfigs stored in ~/.kube/config",
 	Run: func(cmd *cobra.Command, args []string) {
-		if err := machinery.InitLocal(cmd.Flag("remote").Value.String()); err != nil {
+		if err := machinery.InitLocal(machinery.ResolveConfigPath(cfgFile), cmd.Flag("remote").Value.String()); err != nil {
 			log.Fatal(err)
 		}
 
 		// Read config from disk
 		var config *machinery.KitConfig
 		var err error
-		if config, err = machinery.ReadConfig(); err != nil {
+		if config, err = readConfig(); err != nil {
 			log.Fatal(err)
 		}
 
@@ -51,7 +51,7 @@ var InitCmd = &cobra.Command{
 		log.Info("Checking remote connection")
 		// Check remote connection
 		var client *machinery.RemoteClient
-		if client, err = machinery.NewRemoteClient(config); err != nil {
+		if client, err = newRemoteClient(config); err != nil {
 			log.Fatal(err)
 		}
 		if err := client.CheckConnection(); err != nil {
@@ -60,7 +60,7 @@ var InitCmd = &cobra.Command{
 			log.Info("Remote connection success!")
 		}
 
-		if err := machinery.InitRemote(client); err != nil {
+		if err := machinery.InitRemote(config, client); err != nil {
 			log.Fatal(err)
 		}
 
@@ -74,7 +74,7 @@ var InitCmd = &cobra.Command{
 			}
 		} else {
 			log.Infof("Fetching %d contexts from remote", len(data.Latest.Contexts))
-			if err := data.WriteToDisk(); err != nil {
+			if err := data.WriteToDisk(config); err != nil {
 				log.Fatal(err)
 			}
 		}
@@ -0,0 +1,51 @@
+/*
+Copyright © 2021 Joe Kralicky
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kit
+
+import (
+	"github.com/kralicky/kit/pkg/machinery"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var LoginCmd = &cobra.Command{
+	Use:   "login",
+	Short: "Log in to vault using the auth method configured in the kit config",
+	Run: func(cmd *cobra.Command, args []string) {
+		var config *machinery.KitConfig
+		var err error
+		if config, err = readRemoteConfig(cmd); err != nil {
+			log.Fatal(err)
+		}
+		auth := config.Auth
+		if auth == nil {
+			log.Fatal("No auth method is configured")
+		}
+		var client *machinery.RemoteClient
+		if client, err = machinery.NewRemoteClient(config); err != nil {
+			log.Fatal(err)
+		}
+		token, err := client.Login(auth)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := machinery.StoreToken(config, token); err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Logged in using %s", auth.Method)
+	},
+}
@@ -0,0 +1,110 @@
+/*
+Copyright © 2021 Joe Kralicky
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kit
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kralicky/kit/pkg/machinery"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var PolicyCmd = &cobra.Command{
+	Use:   "policy",
+	Short: "Manage Vault access policies for kit data",
+}
+
+var PolicyGenerateCmd = &cobra.Command{
+	Use:   "generate",
+	Short: "Generate Vault ACL policies for groups of contexts",
+	Example: `  kit policy generate --read support=prod-*,staging-* --push platform=*
+  kit policy generate --push platform=* --write`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var groups []machinery.PolicyGroup
+		for _, access := range []machinery.PolicyAccess{
+			machinery.PolicyAccessRead,
+			machinery.PolicyAccessPush,
+		} {
+			values, err := cmd.Flags().GetStringArray(string(access))
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, value := range values {
+				group, err := parsePolicyGroup(value, access)
+				if err != nil {
+					log.Fatal(err)
+				}
+				groups = append(groups, group)
+			}
+		}
+		if len(groups) == 0 {
+			log.Fatal("At least one --read or --push group is required")
+		}
+
+		config, err := readConfig()
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Fatal(err)
+			}
+			// Policies can be generated without a local config using the
+			// default mount layout
+			config = &machinery.KitConfig{}
+		}
+		var client *machinery.RemoteClient
+		if write, _ := cmd.Flags().GetBool("write"); write {
+			if client, err = newRemoteClient(config); err != nil {
+				log.Fatal(err)
+			}
+		}
+		for _, group := range groups {
+			policy, err := machinery.GeneratePolicy(group, config.KVPaths())
+			if err != nil {
+				log.Fatal(err)
+			}
+			if client == nil {
+				fmt.Println(policy)
+				continue
+			}
+			if err := client.WritePolicy(group); err != nil {
+				log.Fatal(err)
+			}
+			log.Infof("Wrote policy %s", group.Name)
+		}
+	},
+}
+
+func parsePolicyGroup(value string, access machinery.PolicyAccess) (machinery.PolicyGroup, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return machinery.PolicyGroup{}, fmt.Errorf("invalid group %q (expected name=glob[,glob...])", value)
+	}
+	return machinery.PolicyGroup{
+		Name:     parts[0],
+		Contexts: strings.Split(parts[1], ","),
+		Access:   access,
+	}, nil
+}
+
+func init() {
+	PolicyGenerateCmd.Flags().StringArray("read", nil, "Read-only policy group in the form name=glob[,glob...]")
+	PolicyGenerateCmd.Flags().StringArray("push", nil, "Push policy group in the form name=glob[,glob...]")
+	PolicyGenerateCmd.Flags().Bool("write", false, "Write the policies to Vault instead of printing them")
+	PolicyCmd.AddCommand(PolicyGenerateCmd)
+}
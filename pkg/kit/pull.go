@@ -16,12 +16,74 @@ limitations under the License.
 
 package kit
 
-import "github.com/spf13/cobra"
+import (
+	"github.com/kralicky/kit/pkg/machinery"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
 
 var PullCmd = &cobra.Command{
 	Use:   "pull",
 	Short: "Pull kubeconfigs from vault and merge with the local store",
 	Run: func(cmd *cobra.Command, args []string) {
-
+		var config *machinery.KitConfig
+		var err error
+		if config, err = readRemoteConfig(cmd); err != nil {
+			log.Fatal(err)
+		}
+		var client *machinery.RemoteClient
+		if client, err = newRemoteClient(config); err != nil {
+			log.Fatal(err)
+		}
+		cache, err := client.LoadRemoteData()
+		if err != nil {
+			if machinery.IsNotFound(err) {
+				log.Info("No remote data available")
+				return
+			}
+			log.Fatal(err)
+		}
+		if err := cache.WriteToDisk(config); err != nil {
+			log.Fatal(err)
+		}
+		var localData *machinery.LocalData
+		if localData, err = machinery.ReadLocalData(config); err != nil {
+			log.Fatal(err)
+		}
+		owners, err := machinery.ReadOwnership(config.Home())
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Contexts owned by other remotes are never modified or deleted
+		diff, err := machinery.ComputeRemoteDiff(localData.Config, cache,
+			config.Sync, owners, config.RemoteName())
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(diff.Items) > 0 {
+			for _, item := range diff.Items {
+				log.Info(machinery.FormatDiffItem(item, localData.Config, &cache.Latest))
+			}
+			if err := diff.Apply(localData.Config, &cache.Latest, machinery.AutoResolver); err != nil {
+				log.Fatal(err)
+			}
+			if backup, err := machinery.CreateBackup(config); err != nil {
+				log.Fatal(err)
+			} else if backup != nil {
+				log.Debugf("Saved backup %s", backup.Name)
+			}
+			if err := machinery.WriteLocalData(config, localData); err != nil {
+				log.Fatal(err)
+			}
+		}
+		owners.Claim(localData.Config, machinery.FilterConfig(&cache.Latest, config.Sync), config.RemoteName())
+		if err := owners.WriteToDisk(config.Home()); err != nil {
+			log.Fatal(err)
+		}
+		if len(diff.Items) == 0 {
+			log.Info("Already up to date.")
+			return
+		}
+		log.Infof("Applied %d changes to %s", len(diff.Items), config.KubeconfigPath)
 	},
 }
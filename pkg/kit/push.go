@@ -16,12 +16,57 @@ limitations under the License.
 
 package kit
 
-import "github.com/spf13/cobra"
+import (
+	"github.com/kralicky/kit/pkg/machinery"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
 
 var PushCmd = &cobra.Command{
 	Use:   "push",
 	Short: "Push local kubeconfigs to vault",
 	Run: func(cmd *cobra.Command, args []string) {
-
+		var config *machinery.KitConfig
+		var err error
+		if config, err = readRemoteConfig(cmd); err != nil {
+			log.Fatal(err)
+		}
+		var localData *machinery.LocalData
+		if localData, err = machinery.ReadLocalData(config); err != nil {
+			log.Fatal(err)
+		}
+		var client *machinery.RemoteClient
+		if client, err = newRemoteClient(config); err != nil {
+			log.Fatal(err)
+		}
+		if err := pushLocalData(config, client, localData); err != nil {
+			log.Fatal(err)
+		}
+		log.Info("Done.")
 	},
 }
+
+// pushLocalData pushes the local contexts that are synced with the remote,
+// and records them as owned by it.
+func pushLocalData(config *machinery.KitConfig, client *machinery.RemoteClient, localData *machinery.LocalData) error {
+	if err := config.Sync.Validate(); err != nil {
+		return err
+	}
+	owners, err := machinery.ReadOwnership(config.Home())
+	if err != nil {
+		return err
+	}
+	// Local-only contexts and contexts owned by other remotes are never
+	// uploaded
+	synced := machinery.FilterConfig(
+		owners.Filter(localData.Config, config.RemoteName()), config.Sync)
+	log.Infof("Pushing %d contexts to %s", len(synced.Contexts), config.RemoteName())
+	if err := client.PushRemoteData(synced); err != nil {
+		return err
+	}
+	owners.Claim(localData.Config, synced, config.RemoteName())
+	if err := owners.WriteToDisk(config.Home()); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+/*
+Copyright © 2021 Joe Kralicky
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kit
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/kralicky/kit/pkg/machinery"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var RemoteCmd = &cobra.Command{
+	Use:   "remote",
+	Short: "Manage named remotes",
+}
+
+var RemoteAddCmd = &cobra.Command{
+	Use:     "add <name> <url>",
+	Short:   "Add a named remote",
+	Args:    cobra.ExactArgs(2),
+	Example: `  kit remote add support https://vault.support.example.com --auth-method userpass --exclude kind-*`,
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := readConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		remote := machinery.RemoteConfig{
+			Name: args[0],
+			URL:  args[1],
+		}
+		flags := cmd.Flags()
+		remote.MountPath, _ = flags.GetString("mount-path")
+		remote.SecretPath, _ = flags.GetString("secret-path")
+		remote.KVVersion, _ = flags.GetInt("kv-version")
+		remote.Namespace, _ = flags.GetString("namespace")
+		if method, _ := flags.GetString("auth-method"); method != "" {
+			remote.Auth = &machinery.AuthConfig{
+				Method: method,
+			}
+			remote.Auth.Mount, _ = flags.GetString("auth-mount")
+			remote.Auth.Role, _ = flags.GetString("auth-role")
+		}
+		include, _ := flags.GetStringSlice("include")
+		exclude, _ := flags.GetStringSlice("exclude")
+		if len(include) > 0 || len(exclude) > 0 {
+			remote.Sync = &machinery.SyncFilter{
+				Include: include,
+				Exclude: exclude,
+			}
+		}
+		if err := config.AddRemote(remote); err != nil {
+			log.Fatal(err)
+		}
+		if setDefault, _ := flags.GetBool("default"); setDefault {
+			config.DefaultRemote = remote.Name
+		}
+		if err := config.WriteToDisk(); err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Added remote %s", remote.Name)
+	},
+}
+
+var RemoteListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List configured remotes",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := readConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defaultRemote := config.DefaultRemote
+		if defaultRemote == "" {
+			defaultRemote = machinery.DefaultRemoteName
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tURL\tAUTH")
+		for _, remote := range config.ListRemotes() {
+			name := remote.Name
+			if name == defaultRemote {
+				name += " (default)"
+			}
+			auth := "token"
+			if remote.Auth != nil {
+				auth = remote.Auth.Method
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", name, remote.URL, auth)
+		}
+		w.Flush()
+	},
+}
+
+var RemoteRemoveCmd = &cobra.Command{
+	Use:   "remove <name>",
+	Short: "Remove a named remote",
+	Long: `Remove a named remote. Contexts pulled from the remote are kept in the
+local kubeconfig, but are no longer tracked as belonging to it.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := readConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := config.RemoveRemote(args[0]); err != nil {
+			log.Fatal(err)
+		}
+		if err := config.WriteToDisk(); err != nil {
+			log.Fatal(err)
+		}
+		owners, err := machinery.ReadOwnership(config.Home())
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, name := range owners.OwnedBy(args[0]) {
+			delete(owners.Contexts, name)
+		}
+		if err := owners.WriteToDisk(config.Home()); err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Removed remote %s", args[0])
+	},
+}
+
+// readRemoteConfig reads the kit config and selects the remote given by the
+// --remote flag.
+func readRemoteConfig(cmd *cobra.Command) (*machinery.KitConfig, error) {
+	config, err := readConfig()
+	if err != nil {
+		return nil, err
+	}
+	name, _ := cmd.Flags().GetString("remote")
+	return config.ForRemote(name)
+}
+
+// newRemoteClient connects to the remote, logging in with the configured auth
+// method if there is no token.
+func newRemoteClient(config *machinery.KitConfig) (*machinery.RemoteClient, error) {
+	client, err := machinery.NewRemoteClient(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.LoginIfNeeded(config); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+func init() {
+	flags := RemoteAddCmd.Flags()
+	flags.String("mount-path", "", "Path of the KV secret engine mount")
+	flags.String("secret-path", "", "Path prefix within the mount under which contexts are stored")
+	flags.Int("kv-version", 0, "KV secret engine version (1 or 2)")
+	flags.String("namespace", "", "Vault Enterprise namespace")
+	flags.String("auth-method", "", "Method used to log in to the remote")
+	flags.String("auth-mount", "", "Mount path of the auth method")
+	flags.String("auth-role", "", "Role to log in with")
+	flags.StringSlice("include", nil, "Only sync contexts matching these patterns")
+	flags.StringSlice("exclude", nil, "Never sync contexts matching these patterns")
+	flags.Bool("default", false, "Use this remote when --remote is not given")
+	RemoteCmd.AddCommand(RemoteAddCmd)
+	RemoteCmd.AddCommand(RemoteListCmd)
+	RemoteCmd.AddCommand(RemoteRemoveCmd)
+
+	for _, cmd := range []*cobra.Command{
+		FetchCmd, LoginCmd, PullCmd, PushCmd, ShareCmd, RewrapCmd, StatusCmd, WatchCmd,
+		DaemonCmd,
+	} {
+		cmd.Flags().String("remote", "", "Name of the remote to use (default is the default remote)")
+	}
+}
@@ -0,0 +1,107 @@
+/*
+Copyright © 2021 Joe Kralicky
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kit
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/kralicky/kit/pkg/machinery"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	acceptConflict bool
+	rejectConflict bool
+	candidateName  string
+)
+
+var ResolveCmd = &cobra.Command{
+	Use:   "resolve [<conflict> --accept [--candidate <context>]|--reject]",
+	Short: "List or resolve conflicts found by kit daemon",
+	Long: `List the conflicts found by 'kit daemon', or resolve one of them. An
+accepted conflict is applied to the local kubeconfig; a rejected one is not
+reported again unless the incoming context changes. If several local contexts
+match the incoming one, --candidate chooses which of them the change applies
+to.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if !acceptConflict && !rejectConflict {
+			return cobra.NoArgs(cmd, args)
+		}
+		if acceptConflict && rejectConflict {
+			return fmt.Errorf("--accept and --reject cannot be used together")
+		}
+		if candidateName != "" && !acceptConflict {
+			return fmt.Errorf("--candidate can only be used with --accept")
+		}
+		return cobra.ExactArgs(1)(cmd, args)
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := readConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		client, err := machinery.NewDaemonClient(config.Home())
+		if err != nil {
+			if machinery.IsDaemonNotRunning(err) {
+				log.Fatal("kit daemon is not running (use 'kit pull' to pull and resolve conflicts directly)")
+			}
+			log.Fatal(err)
+		}
+		if len(args) == 0 {
+			status, err := client.Status()
+			if err != nil {
+				log.Fatal(err)
+			}
+			printConflicts(status.Conflicts)
+			return
+		}
+		status, err := client.Resolve(args[0], acceptConflict, candidateName)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if acceptConflict {
+			log.Infof("Applied %s", args[0])
+		} else {
+			log.Infof("Rejected %s", args[0])
+		}
+		if len(status.Conflicts) > 0 {
+			log.Infof("%d conflicts remaining", len(status.Conflicts))
+		}
+	},
+}
+
+func printConflicts(conflicts []machinery.Conflict) {
+	if len(conflicts) == 0 {
+		fmt.Println("No conflicts.")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCHANGE")
+	for _, conflict := range conflicts {
+		fmt.Fprintf(w, "%s\t%s\n", conflict.ID, conflict.Description)
+	}
+	w.Flush()
+}
+
+func init() {
+	ResolveCmd.Flags().BoolVar(&acceptConflict, "accept", false, "Apply the incoming change")
+	ResolveCmd.Flags().BoolVar(&rejectConflict, "reject", false, "Keep the local kubeconfig as it is")
+	ResolveCmd.Flags().StringVar(&candidateName, "candidate", "", "Local context an ambiguous change applies to")
+}
@@ -0,0 +1,129 @@
+/*
+Copyright © 2021 Joe Kralicky
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kit
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/kralicky/kit/pkg/machinery"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+const backupTimeFormat = "2006-01-02 15:04:05 MST"
+
+var (
+	listBackups bool
+	skipConfirm bool
+)
+
+var RestoreCmd = &cobra.Command{
+	Use:   "restore [--list] <backup>",
+	Short: "Restore the local kubeconfig from a backup",
+	Long: `Restore the local kubeconfig from a backup. A backup is taken automatically
+before kit modifies the local kubeconfig, and before a restore, so a restore
+can itself be undone.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if listBackups {
+			return cobra.NoArgs(cmd, args)
+		}
+		return cobra.ExactArgs(1)(cmd, args)
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := readConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if listBackups {
+			backups, err := machinery.ListBackups(config)
+			if err != nil {
+				log.Fatal(err)
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tCREATED\tFILES")
+			for _, backup := range backups {
+				fmt.Fprintf(w, "%s\t%s\t%d\n", backup.Name,
+					backup.Created.Local().Format(backupTimeFormat), len(backup.Files))
+			}
+			w.Flush()
+			return
+		}
+		backup, err := machinery.ReadBackup(config, args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		backupConfig, err := backup.Config()
+		if err != nil {
+			log.Fatal(err)
+		}
+		var localData *machinery.LocalData
+		if localData, err = machinery.ReadLocalData(config); err != nil {
+			if !errors.Is(err, machinery.ErrKubeconfigDoesNotExist) {
+				log.Fatal(err)
+			}
+			// Restoring a deleted kubeconfig
+			localData = &machinery.LocalData{Config: api.NewConfig()}
+		}
+		diff, err := machinery.ComputeDiff(localData.Config, backupConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(diff.Items) == 0 {
+			fmt.Println("No changes to contexts.")
+		}
+		for _, item := range diff.Items {
+			fmt.Println(machinery.FormatDiffItem(item, localData.Config, backupConfig))
+		}
+		if !skipConfirm && !confirm(fmt.Sprintf("Restore backup %s?", backup.Name)) {
+			return
+		}
+		current, err := machinery.CreateBackup(config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := machinery.RestoreBackup(config, backup); err != nil {
+			log.Fatal(err)
+		}
+		if current != nil {
+			log.Infof("Restored backup %s (previous state saved as %s)", backup.Name, current.Name)
+		} else {
+			log.Infof("Restored backup %s", backup.Name)
+		}
+	},
+}
+
+// confirm asks a yes/no question on stderr, defaulting to no.
+func confirm(question string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func init() {
+	RestoreCmd.Flags().BoolVarP(&listBackups, "list", "l", false, "List available backups")
+	RestoreCmd.Flags().BoolVarP(&skipConfirm, "yes", "y", false, "Restore without asking for confirmation")
+}
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/kralicky/kit/pkg/machinery"
 	"github.com/spf13/cobra"
 )
 
@@ -40,9 +41,28 @@ func Execute() {
 	}
 }
 
+// readConfig reads the kit config from the location given by --config,
+// KIT_CONFIG or KIT_HOME.
+func readConfig() (*machinery.KitConfig, error) {
+	return machinery.ReadConfig(machinery.ResolveConfigPath(cfgFile))
+}
+
 func init() {
-	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.kit/config.yaml)")
+	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $KIT_CONFIG, or config.yaml in $KIT_HOME or $HOME/.kit)")
 
 	rootCmd.AddCommand(InitCmd)
+	rootCmd.AddCommand(LoginCmd)
 	rootCmd.AddCommand(FetchCmd)
+	rootCmd.AddCommand(PullCmd)
+	rootCmd.AddCommand(PushCmd)
+	rootCmd.AddCommand(StatusCmd)
+	rootCmd.AddCommand(ShareCmd)
+	rootCmd.AddCommand(IdentityCmd)
+	rootCmd.AddCommand(RewrapCmd)
+	rootCmd.AddCommand(PolicyCmd)
+	rootCmd.AddCommand(RemoteCmd)
+	rootCmd.AddCommand(RestoreCmd)
+	rootCmd.AddCommand(WatchCmd)
+	rootCmd.AddCommand(DaemonCmd)
+	rootCmd.AddCommand(ResolveCmd)
 }
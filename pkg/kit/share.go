@@ -0,0 +1,67 @@
+/*
+Copyright © 2021 Joe Kralicky
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kit
+
+import (
+	"github.com/kralicky/kit/pkg/machinery"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var ShareCmd = &cobra.Command{
+	Use:   "share <context>",
+	Short: "Share a context with specific recipients, encrypted to their public keys",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var config *machinery.KitConfig
+		var err error
+		if config, err = readRemoteConfig(cmd); err != nil {
+			log.Fatal(err)
+		}
+		to, err := cmd.Flags().GetStringArray("to")
+		if err != nil {
+			log.Fatal(err)
+		}
+		var recipients []string
+		for _, r := range to {
+			key, err := config.ResolveRecipient(r)
+			if err != nil {
+				log.Fatal(err)
+			}
+			recipients = append(recipients, key)
+		}
+		var localData *machinery.LocalData
+		if localData, err = machinery.ReadLocalData(config); err != nil {
+			log.Fatal(err)
+		}
+		var client *machinery.RemoteClient
+		if client, err = newRemoteClient(config); err != nil {
+			log.Fatal(err)
+		}
+		if err := client.ShareContext(localData.Config, args[0], recipients); err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Shared context %s with %d recipient(s)", args[0], len(recipients))
+	},
+}
+
+func init() {
+	ShareCmd.Flags().StringArray("to", nil, "Recipient name (from the kit config) or public key")
+	if err := ShareCmd.MarkFlagRequired("to"); err != nil {
+		panic(err)
+	}
+}
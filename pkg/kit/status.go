@@ -17,22 +17,81 @@ limitations under the License.
 package kit
 
 import (
+	"fmt"
+
+	"github.com/kralicky/kit/pkg/machinery"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
+var showContexts bool
+
 var StatusCmd = &cobra.Command{
 	Use:   "status",
 	Short: "Show the difference between the local kubeconfigs and the remote cache",
 	Run: func(cmd *cobra.Command, args []string) {
-		// var config *machinery.KitConfig
-		// var err error
-		// if config, err = machinery.ReadConfig(); err != nil {
-		// 	log.Fatal(err)
-		// }
-		// var client *machinery.RemoteClient
-		// if client, err = machinery.NewRemoteClient(config); err != nil {
-		// 	log.Fatal(err)
-		// }
-		// diff, err := machinery.ComputeIncomingDiff(client)
+		var config *machinery.KitConfig
+		var err error
+		if config, err = readRemoteConfig(cmd); err != nil {
+			log.Fatal(err)
+		}
+		// While the daemon is running, it is the source of truth for what has
+		// not been applied yet
+		if daemon, err := machinery.NewDaemonClient(config.Home()); err == nil {
+			status, err := daemon.Status()
+			if err != nil {
+				log.Fatal(err)
+			}
+			if status.Remote == config.RemoteName() {
+				printDaemonStatus(status)
+				return
+			}
+		}
+		var localData *machinery.LocalData
+		if localData, err = machinery.ReadLocalData(config); err != nil {
+			log.Fatal(err)
+		}
+		cache, err := machinery.ReadRemoteCache(config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		owners, err := machinery.ReadOwnership(config.Home())
+		if err != nil {
+			log.Fatal(err)
+		}
+		diff, err := machinery.ComputeRemoteDiff(localData.Config, cache,
+			config.Sync, owners, config.RemoteName())
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(diff.Items) == 0 {
+			fmt.Println("Up to date with the remote cache.")
+			return
+		}
+		for _, item := range diff.Items {
+			fmt.Println(machinery.FormatDiffItem(item, localData.Config, &cache.Latest))
+			if showContexts && item.AffectedIncoming.Name != "" {
+				// Secrets are replaced with fingerprints
+				fmt.Print(machinery.FormatConfig(
+					machinery.ContextConfig(&cache.Latest, item.AffectedIncoming.Name)))
+			}
+		}
 	},
 }
+
+func printDaemonStatus(status *machinery.DaemonStatus) {
+	fmt.Printf("kit daemon is running (remote %s, started %s)\n",
+		status.Remote, status.Started.Local().Format(backupTimeFormat))
+	if !status.LastSync.IsZero() {
+		fmt.Printf("Last pull: %s, %d changes applied\n",
+			status.LastSync.Local().Format(backupTimeFormat), status.Applied)
+	}
+	if status.LastError != "" {
+		fmt.Printf("Last pull failed: %s\n", status.LastError)
+	}
+	printConflicts(status.Conflicts)
+}
+
+func init() {
+	StatusCmd.Flags().BoolVarP(&showContexts, "verbose", "v", false, "Show the contents of incoming contexts with secrets redacted")
+}
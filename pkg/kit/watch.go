@@ -0,0 +1,136 @@
+/*
+Copyright © 2021 Joe Kralicky
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kit
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/kralicky/kit/pkg/machinery"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+var WatchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "Watch the local kubeconfig and report or push unpushed contexts",
+	Long: `Watch the local kubeconfig for changes made by other tools, such as
+'kind create cluster' or 'gcloud container clusters get-credentials'. After
+each change, contexts that differ from the remote cache are reported, or
+pushed if the watch policy is "push".`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var config *machinery.KitConfig
+		var err error
+		if config, err = readRemoteConfig(cmd); err != nil {
+			log.Fatal(err)
+		}
+		// The cache is read and written in the background
+		if err := config.UnlockCache(); err != nil {
+			log.Fatal(err)
+		}
+		policy, err := config.WatchPolicy()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if push, _ := cmd.Flags().GetBool("push"); push {
+			policy = machinery.WatchPolicyPush
+		}
+		debounce := config.WatchDebounce()
+		if cmd.Flags().Changed("debounce") {
+			debounce, _ = cmd.Flags().GetDuration("debounce")
+		}
+
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+		var client *machinery.RemoteClient
+		if policy == machinery.WatchPolicyPush {
+			if client, err = newRemoteClient(config); err != nil {
+				log.Fatal(err)
+			}
+			// Keep the token alive for as long as kit is watching
+			if err := client.WatchToken(ctx); err != nil {
+				log.Fatal(err)
+			}
+		}
+		check := func() {
+			if err := checkOutgoing(config, client); err != nil {
+				log.Error(err)
+			}
+		}
+		check()
+		log.Infof("Watching %s", config.KubeconfigPath)
+		if err := machinery.WatchKubeconfig(ctx, config, debounce, check); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+// checkOutgoing reports the contexts that have not been pushed to the
+// remote. If a client is given, they are pushed instead.
+func checkOutgoing(config *machinery.KitConfig, client *machinery.RemoteClient) error {
+	localData, err := machinery.ReadLocalData(config)
+	if err != nil {
+		return err
+	}
+	remote := api.NewConfig()
+	if machinery.RemoteCacheExists(config) {
+		cache, err := machinery.ReadRemoteCache(config)
+		if err != nil {
+			return err
+		}
+		remote = &cache.Latest
+	}
+	owners, err := machinery.ReadOwnership(config.Home())
+	if err != nil {
+		return err
+	}
+	diff, err := machinery.ComputeOutgoingDiff(localData.Config, remote,
+		config.Sync, owners, config.RemoteName())
+	if err != nil {
+		return err
+	}
+	if len(diff.Items) == 0 {
+		log.Debug("No unpushed contexts")
+		return nil
+	}
+	for _, item := range diff.Items {
+		log.Info(machinery.FormatDiffItem(item, remote, localData.Config))
+	}
+	if client == nil {
+		log.Warnf("%d contexts have not been pushed to %s (run 'kit push')",
+			len(diff.Items), config.RemoteName())
+		return nil
+	}
+	if err := pushLocalData(config, client, localData); err != nil {
+		return err
+	}
+	// Refresh the remote cache, so the pushed contexts are not reported again
+	cache, err := client.LoadRemoteData()
+	if err != nil {
+		return err
+	}
+	return cache.WriteToDisk(config)
+}
+
+func init() {
+	WatchCmd.Flags().Bool("push", false, "Push changes automatically, regardless of the watch policy")
+	WatchCmd.Flags().Duration("debounce", machinery.DefaultWatchDebounce, "Time to wait after a change before reacting to it")
+}
@@ -1,9 +1,19 @@
 package machinery
 
-import "k8s.io/client-go/tools/clientcmd/api"
+import (
+	"fmt"
+
+	"k8s.io/client-go/tools/clientcmd/api"
+)
 
 func (d *Diff) Apply(existing, incoming *api.Config, handler ConflictResolver) error {
 	for _, item := range d.Items {
+		if (item.ChangeType & ChangeTypeAmbiguous) != 0 {
+			var err error
+			if item, err = chooseCandidate(item, existing, incoming, handler); err != nil {
+				return err
+			}
+		}
 		// isComplex := (item.ChangeType & ChangeTypeComplex) != 0
 		switch {
 		case (item.ChangeType & ChangeTypeNew) != 0:
@@ -69,9 +79,15 @@ func (d *Diff) Apply(existing, incoming *api.Config, handler ConflictResolver) e
 			clusterName := item.AffectedExisting.Cluster
 			authInfoName := item.AffectedExisting.AuthInfo
 			contextName := item.AffectedExisting.Name
-			delete(existing.Clusters, clusterName)
-			delete(existing.AuthInfos, authInfoName)
 			delete(existing.Contexts, contextName)
+			// Clusters and auth infos can be shared with other contexts,
+			// including local-only ones that are not part of the diff
+			if !clusterReferenced(existing, clusterName) {
+				delete(existing.Clusters, clusterName)
+			}
+			if !authInfoReferenced(existing, authInfoName) {
+				delete(existing.AuthInfos, authInfoName)
+			}
 		case (item.ChangeType & ChangeTypeReplace) != 0:
 			existingContextName := item.AffectedExisting.Name
 			existingClusterName := item.AffectedExisting.Cluster
@@ -106,6 +122,9 @@ func (d *Diff) Apply(existing, incoming *api.Config, handler ConflictResolver) e
 				case (cmplx & ComplexDiffPreferencesChanged) != 0:
 					// No-op
 					cmplx &^= ComplexDiffPreferencesChanged
+				case (cmplx & ComplexDiffAmbiguousMatch) != 0:
+					// Resolved before applying
+					cmplx &^= ComplexDiffAmbiguousMatch
 				case (cmplx & ComplexDiffRenameRequired) != 0:
 					// This isn't used in ChangeTypeModify
 					panic("bug: ComplexDiffRenameRequired used in ChangeTypeModify")
@@ -115,3 +134,45 @@ func (d *Diff) Apply(existing, incoming *api.Config, handler ConflictResolver) e
 	}
 	return nil
 }
+
+func clusterReferenced(config *api.Config, name string) bool {
+	for _, context := range config.Contexts {
+		if context.Cluster == name {
+			return true
+		}
+	}
+	return false
+}
+
+func authInfoReferenced(config *api.Config, name string) bool {
+	for _, context := range config.Contexts {
+		if context.AuthInfo == name {
+			return true
+		}
+	}
+	return false
+}
+
+// chooseCandidate asks the handler which candidate an ambiguous item applies
+// to, and updates the item to apply to it.
+func chooseCandidate(item DiffItem, existing, incoming *api.Config, handler ConflictResolver) (DiffItem, error) {
+	chosen := handler.Choose(item)
+	found := false
+	for _, candidate := range item.Candidates {
+		if candidate.Name == chosen.Name {
+			chosen, found = candidate, true
+			break
+		}
+	}
+	if !found {
+		return item, fmt.Errorf("%w: %s", ErrInvalidCandidate, chosen.Name)
+	}
+	if (item.ChangeType&ChangeTypeModify) != 0 && chosen.Name != item.AffectedExisting.Name {
+		// Server and CA changes are relative to the chosen context's cluster
+		item.Complex &^= ComplexDiffServerChanged | ComplexDiffClusterCAChanged
+		item.Complex |= clusterChanges(existing.Clusters[chosen.Cluster],
+			incoming.Clusters[item.AffectedIncoming.Cluster])
+	}
+	item.AffectedExisting = chosen
+	return item, nil
+}
@@ -0,0 +1,245 @@
+package machinery
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/vault/command/token"
+	"github.com/hashicorp/vault/sdk/helper/password"
+	"golang.org/x/term"
+)
+
+const DefaultKubernetesJWTPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+type AuthConfig struct {
+	// Login method: approle, userpass, ldap, kubernetes, or jwt
+	Method string `json:"method"`
+	// Mount path of the auth method (defaults to the method name)
+	Mount string `json:"mount,omitempty"`
+	// Role to log in with (kubernetes and jwt)
+	Role string `json:"role,omitempty"`
+	// File containing the AppRole role ID
+	RoleIDFile string `json:"roleIdFile,omitempty"`
+	// File containing the AppRole secret ID
+	SecretIDFile string `json:"secretIdFile,omitempty"`
+	// Username to log in with (userpass and ldap). The password is
+	// prompted for interactively.
+	Username string `json:"username,omitempty"`
+	// File containing the JWT (kubernetes and jwt). For the kubernetes method
+	// this defaults to the pod's service account token.
+	JWTFile string `json:"jwtFile,omitempty"`
+}
+
+// An AuthMethod builds the login request for a Vault auth method. It returns
+// the login path relative to the auth method's mount and the request body.
+type AuthMethod func(conf *AuthConfig) (string, map[string]interface{}, error)
+
+var authMethods = map[string]AuthMethod{
+	"approle":    appRoleLogin,
+	"userpass":   passwordLogin,
+	"ldap":       passwordLogin,
+	"kubernetes": kubernetesLogin,
+	"jwt":        jwtLogin,
+}
+
+// RegisterAuthMethod adds support for an additional auth method, or replaces
+// the implementation of an existing one.
+func RegisterAuthMethod(name string, method AuthMethod) {
+	authMethods[name] = method
+}
+
+// Login authenticates to Vault using the configured auth method and updates
+// the client's token. The token is not persisted; see StoreToken.
+func (r *RemoteClient) Login(conf *AuthConfig) (string, error) {
+	method, ok := authMethods[conf.Method]
+	if !ok {
+		return "", fmt.Errorf("%w: %q", ErrUnsupportedAuthMethod, conf.Method)
+	}
+	loginPath, data, err := method(conf)
+	if err != nil {
+		return "", err
+	}
+	mount := conf.Mount
+	if mount == "" {
+		mount = conf.Method
+	}
+	// Login requests must not carry an existing (possibly expired) token
+	client, err := r.VaultClient.Clone()
+	if err != nil {
+		return "", err
+	}
+	client.SetHeaders(r.VaultClient.Headers())
+	client.ClearToken()
+	sec, err := client.Logical().Write(path.Join("auth", strings.Trim(mount, "/"), loginPath), data)
+	if err != nil {
+		return "", err
+	}
+	if sec == nil || sec.Auth == nil || sec.Auth.ClientToken == "" {
+		return "", ErrLoginNoToken
+	}
+	r.VaultClient.SetToken(sec.Auth.ClientToken)
+	return sec.Auth.ClientToken, nil
+}
+
+// LoginIfNeeded logs in using the auth method configured in the kit config if
+// the client has no token, or its token has expired or was revoked, and
+// stores the new token with StoreToken. Clients returned by NewRemoteClient
+// never log in on their own.
+func (r *RemoteClient) LoginIfNeeded(config *KitConfig) error {
+	if config.Auth == nil {
+		return nil
+	}
+	if r.VaultClient.Token() != "" {
+		// Other lookup errors are left for the remote operations to report
+		if _, err := r.LookupToken(); !IsAuthExpired(err) {
+			return nil
+		}
+	}
+	token, err := r.Login(config.Auth)
+	if err != nil {
+		return err
+	}
+	return StoreToken(config, token)
+}
+
+// StoreToken saves the token so it is reused by later kit invocations. The
+// default remote uses the vault CLI's token helper, so the token is shared
+// with the vault CLI. Named remotes each keep their own token file.
+func StoreToken(conf *KitConfig, t string) error {
+	if conf.RemoteName() != DefaultRemoteName {
+		data, err := EncryptCacheData([]byte(t), conf.cacheEncryption())
+		if err != nil {
+			return err
+		}
+		path := conf.TokenPath()
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return err
+		}
+		return os.WriteFile(path, data, 0600)
+	}
+	helper, err := token.NewInternalTokenHelper()
+	if err != nil {
+		return err
+	}
+	return helper.Store(t)
+}
+
+// loadToken returns the token stored with StoreToken, or "" if there is none.
+func loadToken(conf *KitConfig) (string, error) {
+	if conf.RemoteName() != DefaultRemoteName {
+		data, err := os.ReadFile(conf.TokenPath())
+		if err != nil {
+			if os.IsNotExist(err) {
+				return "", nil
+			}
+			return "", err
+		}
+		if !IsEncryptedCache(data) {
+			// Stored in plaintext by an older version of kit
+			t := strings.TrimSpace(string(data))
+			return t, StoreToken(conf, t)
+		}
+		if data, err = DecryptCacheData(data, conf.cacheEncryption()); err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+	helper, err := token.NewInternalTokenHelper()
+	if err != nil {
+		return "", err
+	}
+	return helper.Get()
+}
+
+func appRoleLogin(conf *AuthConfig) (string, map[string]interface{}, error) {
+	if conf.RoleIDFile == "" {
+		return "", nil, fmt.Errorf("%w: approle requires roleIdFile", ErrInvalidAuthConfig)
+	}
+	roleID, err := readSecretFile(conf.RoleIDFile)
+	if err != nil {
+		return "", nil, err
+	}
+	data := map[string]interface{}{
+		"role_id": roleID,
+	}
+	// The secret ID is optional if the role does not require one
+	if conf.SecretIDFile != "" {
+		secretID, err := readSecretFile(conf.SecretIDFile)
+		if err != nil {
+			return "", nil, err
+		}
+		data["secret_id"] = secretID
+	}
+	return "login", data, nil
+}
+
+func passwordLogin(conf *AuthConfig) (string, map[string]interface{}, error) {
+	if conf.Username == "" {
+		return "", nil, fmt.Errorf("%w: %s requires username", ErrInvalidAuthConfig, conf.Method)
+	}
+	fmt.Fprintf(os.Stderr, "Password for %s (will be hidden): ", conf.Username)
+	pw, err := readPassword(os.Stdin)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", nil, err
+	}
+	return path.Join("login", conf.Username), map[string]interface{}{
+		"password": pw,
+	}, nil
+}
+
+// readPassword reads a password from the terminal without echoing it. If the
+// file is not a terminal, its first line is used, so that the password can be
+// piped in.
+func readPassword(f *os.File) (string, error) {
+	if term.IsTerminal(int(f.Fd())) {
+		return password.Read(f)
+	}
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func kubernetesLogin(conf *AuthConfig) (string, map[string]interface{}, error) {
+	jwtFile := conf.JWTFile
+	if jwtFile == "" {
+		jwtFile = DefaultKubernetesJWTPath
+	}
+	return roleJWTLogin(conf, jwtFile)
+}
+
+func jwtLogin(conf *AuthConfig) (string, map[string]interface{}, error) {
+	if conf.JWTFile == "" {
+		return "", nil, fmt.Errorf("%w: jwt requires jwtFile", ErrInvalidAuthConfig)
+	}
+	return roleJWTLogin(conf, conf.JWTFile)
+}
+
+func roleJWTLogin(conf *AuthConfig, jwtFile string) (string, map[string]interface{}, error) {
+	if conf.Role == "" {
+		return "", nil, fmt.Errorf("%w: %s requires role", ErrInvalidAuthConfig, conf.Method)
+	}
+	jwt, err := readSecretFile(jwtFile)
+	if err != nil {
+		return "", nil, err
+	}
+	return "login", map[string]interface{}{
+		"role": conf.Role,
+		"jwt":  jwt,
+	}, nil
+}
+
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
@@ -0,0 +1,224 @@
+package machinery_test
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/kralicky/kit/pkg/machinery"
+)
+
+var _ = Describe("Auth", func() {
+	var vault *stubVault
+	var client *machinery.RemoteClient
+	var dir string
+	var restoreAuthMethods func()
+	preserveEnv(machinery.HomeEnv, "VAULT_TOKEN", "VAULT_NAMESPACE")
+	BeforeEach(func() {
+		restoreAuthMethods = machinery.SaveAuthMethods()
+		loginResponse := map[string]interface{}{
+			"auth": map[string]interface{}{
+				"client_token": "new-token",
+			},
+		}
+		vault = newStubVault(map[string]interface{}{
+			"PUT /v1/auth/approle/login":            loginResponse,
+			"PUT /v1/auth/ci-approle/login":         loginResponse,
+			"PUT /v1/auth/kubernetes/login":         loginResponse,
+			"PUT /v1/auth/jwt/login":                loginResponse,
+			"PUT /v1/auth/userpass/login/test-user": loginResponse,
+		})
+		os.Setenv("VAULT_TOKEN", "old-token")
+		os.Unsetenv("VAULT_NAMESPACE")
+		var err error
+		client, err = machinery.NewRemoteClient(&machinery.KitConfig{
+			RemoteURL: vault.URL,
+			Namespace: "team-a",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		dir, err = os.MkdirTemp("", "kit-auth")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.WriteFile(filepath.Join(dir, "role-id"), []byte("test-role-id\n"), 0600)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "secret-id"), []byte("test-secret-id\n"), 0600)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "jwt"), []byte("test-jwt"), 0600)).To(Succeed())
+	})
+	AfterEach(func() {
+		restoreAuthMethods()
+		vault.Close()
+		os.RemoveAll(dir)
+	})
+
+	It("should log in using AppRole", func() {
+		token, err := client.Login(&machinery.AuthConfig{
+			Method:       "approle",
+			RoleIDFile:   filepath.Join(dir, "role-id"),
+			SecretIDFile: filepath.Join(dir, "secret-id"),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(token).To(Equal("new-token"))
+		Expect(client.VaultClient.Token()).To(Equal("new-token"))
+		Expect(vault.Requests()).To(Equal([]stubRequest{
+			{
+				Method:    "PUT",
+				Path:      "/v1/auth/approle/login",
+				Namespace: "team-a",
+				Body: map[string]interface{}{
+					"role_id":   "test-role-id",
+					"secret_id": "test-secret-id",
+				},
+			},
+		}))
+	})
+	It("should use a custom auth mount", func() {
+		_, err := client.Login(&machinery.AuthConfig{
+			Method:     "approle",
+			Mount:      "ci-approle",
+			RoleIDFile: filepath.Join(dir, "role-id"),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(vault.Requests()[0].Path).To(Equal("/v1/auth/ci-approle/login"))
+	})
+	It("should log in using a Kubernetes service account token", func() {
+		_, err := client.Login(&machinery.AuthConfig{
+			Method:  "kubernetes",
+			Role:    "kit",
+			JWTFile: filepath.Join(dir, "jwt"),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(vault.Requests()[0].Body).To(Equal(map[string]interface{}{
+			"role": "kit",
+			"jwt":  "test-jwt",
+		}))
+	})
+	It("should log in using a JWT", func() {
+		_, err := client.Login(&machinery.AuthConfig{
+			Method:  "jwt",
+			Role:    "kit",
+			JWTFile: filepath.Join(dir, "jwt"),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(vault.Requests()[0].Path).To(Equal("/v1/auth/jwt/login"))
+	})
+	It("should read the password from stdin", func() {
+		stdin := os.Stdin
+		defer func() { os.Stdin = stdin }()
+		r, w, err := os.Pipe()
+		Expect(err).NotTo(HaveOccurred())
+		defer r.Close()
+		os.Stdin = r
+		_, err = w.WriteString("test-password\n")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(w.Close()).To(Succeed())
+
+		_, err = client.Login(&machinery.AuthConfig{
+			Method:   "userpass",
+			Username: "test-user",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(vault.Requests()).To(Equal([]stubRequest{
+			{
+				Method:    "PUT",
+				Path:      "/v1/auth/userpass/login/test-user",
+				Namespace: "team-a",
+				Body: map[string]interface{}{
+					"password": "test-password",
+				},
+			},
+		}))
+	})
+	It("should only log in when asked to", func() {
+		os.Setenv(machinery.HomeEnv, dir)
+		os.Unsetenv("VAULT_TOKEN")
+		config := &machinery.KitConfig{
+			RemoteURL: vault.URL,
+			Auth: &machinery.AuthConfig{
+				Method:     "approle",
+				RoleIDFile: filepath.Join(dir, "role-id"),
+			},
+			Remotes: []machinery.RemoteConfig{
+				{Name: "ci", URL: vault.URL},
+			},
+		}
+		config.Remotes[0].Auth = config.Auth
+		ci, err := config.ForRemote("ci")
+		Expect(err).NotTo(HaveOccurred())
+		client, err := machinery.NewRemoteClient(ci)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(client.VaultClient.Token()).To(BeEmpty())
+		Expect(vault.Requests()).To(BeEmpty())
+		Expect(ci.TokenPath()).NotTo(BeAnExistingFile())
+
+		Expect(client.LoginIfNeeded(ci)).To(Succeed())
+		Expect(client.VaultClient.Token()).To(Equal("new-token"))
+		Expect(vault.Requests()).To(HaveLen(1))
+		Expect(ci.TokenPath()).To(BeAnExistingFile())
+
+		// A valid token is kept
+		vault.responses["GET /v1/auth/token/lookup-self"] = map[string]interface{}{
+			"data": map[string]interface{}{
+				"ttl": 3600,
+			},
+		}
+		Expect(client.LoginIfNeeded(ci)).To(Succeed())
+		Expect(vault.Requests()).To(HaveLen(2))
+		Expect(vault.Requests()[1].Path).To(Equal("/v1/auth/token/lookup-self"))
+	})
+	It("should log in again if the token has expired", func() {
+		vault.responses["GET /v1/auth/token/lookup-self"] = http.StatusForbidden
+		config := &machinery.KitConfig{
+			RemoteURL: vault.URL,
+			Auth: &machinery.AuthConfig{
+				Method:     "approle",
+				RoleIDFile: filepath.Join(dir, "role-id"),
+			},
+			Remotes: []machinery.RemoteConfig{
+				{Name: "ci", URL: vault.URL},
+			},
+		}
+		os.Setenv(machinery.HomeEnv, dir)
+		config.Remotes[0].Auth = config.Auth
+		ci, err := config.ForRemote("ci")
+		Expect(err).NotTo(HaveOccurred())
+		client, err := machinery.NewRemoteClient(ci)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(client.VaultClient.Token()).To(Equal("old-token"))
+
+		Expect(client.LoginIfNeeded(ci)).To(Succeed())
+		Expect(client.VaultClient.Token()).To(Equal("new-token"))
+		Expect(vault.Requests()[1].Path).To(Equal("/v1/auth/approle/login"))
+		Expect(ci.TokenPath()).To(BeAnExistingFile())
+	})
+	It("should support registering additional auth methods", func() {
+		machinery.RegisterAuthMethod("test", func(conf *machinery.AuthConfig) (string, map[string]interface{}, error) {
+			return "login/" + conf.Username, map[string]interface{}{
+				"password": "test-password",
+			}, nil
+		})
+		_, err := client.Login(&machinery.AuthConfig{
+			Method:   "test",
+			Mount:    "userpass",
+			Username: "test-user",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(vault.Requests()[0].Path).To(Equal("/v1/auth/userpass/login/test-user"))
+	})
+	It("should reject invalid auth configs", func() {
+		_, err := client.Login(&machinery.AuthConfig{
+			Method: "kerberos",
+		})
+		Expect(err).To(MatchError(machinery.ErrUnsupportedAuthMethod))
+		_, err = client.Login(&machinery.AuthConfig{
+			Method: "jwt",
+			Role:   "kit",
+		})
+		Expect(err).To(MatchError(machinery.ErrInvalidAuthConfig))
+		_, err = client.Login(&machinery.AuthConfig{
+			Method: "approle",
+		})
+		Expect(err).To(MatchError(machinery.ErrInvalidAuthConfig))
+		Expect(vault.Requests()).To(BeEmpty())
+	})
+})
@@ -0,0 +1,267 @@
+package machinery
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/clientcmd/api"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	KindBackup = "Backup"
+
+	// Number of backups kept if not configured
+	DefaultMaxBackups = 20
+
+	backupTimeFormat = "20060102-150405.000"
+)
+
+// BackupConfig controls the backups of the local kubeconfig that are taken
+// before it is modified.
+type BackupConfig struct {
+	// Do not take backups
+	Disabled bool `json:"disabled,omitempty"`
+	// Number of backups to keep (default 20)
+	MaxCount int `json:"maxCount,omitempty"`
+	// Delete backups older than this (default never), e.g. "720h"
+	MaxAge *metav1.Duration `json:"maxAge,omitempty"`
+}
+
+// Backup is a snapshot of every local kubeconfig file.
+type Backup struct {
+	TypeMeta `json:",inline"`
+
+	Created time.Time    `json:"created"`
+	Files   []BackupFile `json:"files"`
+
+	// Name of the backup, derived from its file name
+	Name string `json:"-"`
+}
+
+type BackupFile struct {
+	Path     string `json:"path"`
+	Contents string `json:"contents"`
+}
+
+func BackupsPath(home string) string {
+	return filepath.Join(home, "backups")
+}
+
+func backupPath(home, name string) string {
+	return filepath.Join(BackupsPath(home), name+".yaml")
+}
+
+// CreateBackup saves the current contents of the local kubeconfig files and
+// prunes old backups. It returns nil if backups are disabled.
+func CreateBackup(conf *KitConfig) (*Backup, error) {
+	if conf.Backups != nil && conf.Backups.Disabled {
+		return nil, nil
+	}
+	paths, err := conf.KubeconfigPaths()
+	if err != nil {
+		return nil, err
+	}
+	backup := &Backup{
+		TypeMeta: TypeMeta{
+			APIVersion: APIVersion,
+			Kind:       KindBackup,
+		},
+		Created: time.Now().UTC(),
+		Files:   []BackupFile{},
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		backup.Files = append(backup.Files, BackupFile{
+			Path:     path,
+			Contents: string(data),
+		})
+	}
+	data, err := yaml.Marshal(backup)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(BackupsPath(conf.Home()), 0700); err != nil {
+		return nil, err
+	}
+	// Backups taken within the same millisecond get a numbered suffix
+	name := backup.Created.Format(backupTimeFormat)
+	for i := 2; ; i++ {
+		f, err := os.OpenFile(backupPath(conf.Home(), name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			name = fmt.Sprintf("%s-%d", backup.Created.Format(backupTimeFormat), i)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write(data); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if err := f.Close(); err != nil {
+			return nil, err
+		}
+		break
+	}
+	backup.Name = name
+	if err := PruneBackups(conf); err != nil {
+		return nil, err
+	}
+	return backup, nil
+}
+
+// ListBackups returns all backups, newest first. Backups that cannot be read
+// are skipped with a warning, so that they do not prevent new backups from
+// being taken.
+func ListBackups(conf *KitConfig) ([]*Backup, error) {
+	entries, err := os.ReadDir(BackupsPath(conf.Home()))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var backups []*Backup
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".yaml")
+		if !entry.Type().IsRegular() || name == entry.Name() {
+			continue
+		}
+		backup, err := ReadBackup(conf, name)
+		if err != nil {
+			log.Warnf("Skipping backup %s: %v", name, err)
+			continue
+		}
+		backups = append(backups, backup)
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		if !backups[i].Created.Equal(backups[j].Created) {
+			return backups[i].Created.After(backups[j].Created)
+		}
+		return backups[i].Name > backups[j].Name
+	})
+	return backups, nil
+}
+
+// ReadBackup reads the named backup. The name may include the .yaml
+// extension.
+func ReadBackup(conf *KitConfig, name string) (*Backup, error) {
+	name = strings.TrimSuffix(name, ".yaml")
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		return nil, fmt.Errorf("%w: %q", ErrBackupNotFound, name)
+	}
+	path := backupPath(conf.Home(), name)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: %s", ErrBackupNotFound, name)
+		}
+		return nil, err
+	}
+	migrated, _, err := migrate(data, KindBackup, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	backup := &Backup{}
+	if err := unmarshalStrict(migrated, backup, path); err != nil {
+		return nil, err
+	}
+	backup.Name = name
+	return backup, nil
+}
+
+// Config merges the kubeconfig files in the backup, as they would be merged
+// if they were restored.
+func (b *Backup) Config() (*api.Config, error) {
+	files := make([]*kubeconfigFile, 0, len(b.Files))
+	for _, file := range b.Files {
+		loaded, err := loadKubeconfig(file.Path, []byte(file.Contents))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, loaded)
+	}
+	return mergeKubeconfigFiles(files), nil
+}
+
+// RestoreBackup writes the files in the backup back to disk. Local
+// kubeconfig files that did not exist when the backup was taken are
+// deleted.
+func RestoreBackup(conf *KitConfig, backup *Backup) (err error) {
+	paths, err := conf.KubeconfigPaths()
+	if err != nil {
+		return err
+	}
+	locks := &fileLocks{}
+	defer func() {
+		if unlockErr := locks.unlock(); unlockErr != nil && err == nil {
+			err = unlockErr
+		}
+	}()
+	restored := map[string]bool{}
+	for _, file := range backup.Files {
+		if err := locks.lock(file.Path); err != nil {
+			return err
+		}
+		restored[file.Path] = true
+	}
+	for _, path := range paths {
+		if err := locks.lock(path); err != nil {
+			return err
+		}
+	}
+	for _, file := range backup.Files {
+		if err := writeFileAtomic(file.Path, []byte(file.Contents), 0600); err != nil {
+			return err
+		}
+	}
+	for _, path := range paths {
+		if restored[path] {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// PruneBackups deletes the oldest backups beyond the configured count, and
+// backups older than the configured age.
+func PruneBackups(conf *KitConfig) error {
+	maxCount := DefaultMaxBackups
+	var maxAge time.Duration
+	if conf.Backups != nil {
+		if conf.Backups.MaxCount > 0 {
+			maxCount = conf.Backups.MaxCount
+		}
+		if conf.Backups.MaxAge != nil {
+			maxAge = conf.Backups.MaxAge.Duration
+		}
+	}
+	backups, err := ListBackups(conf)
+	if err != nil {
+		return err
+	}
+	for i, backup := range backups {
+		if i < maxCount && (maxAge == 0 || time.Since(backup.Created) <= maxAge) {
+			continue
+		}
+		if err := os.Remove(backupPath(conf.Home(), backup.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
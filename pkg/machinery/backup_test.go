@@ -0,0 +1,136 @@
+package machinery_test
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kralicky/kit/pkg/machinery"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+var _ = Describe("Backups", func() {
+	var dir, file string
+	var config *machinery.KitConfig
+	preserveEnv(machinery.HomeEnv)
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "kit-backup")
+		Expect(err).NotTo(HaveOccurred())
+		os.Setenv(machinery.HomeEnv, filepath.Join(dir, "home"))
+		file = filepath.Join(dir, "config")
+		Expect(clientcmd.WriteToFile(*sampleClusters(1, 2), file)).To(Succeed())
+		config = &machinery.KitConfig{
+			KubeconfigPath: file,
+		}
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should restore the local kubeconfig", func() {
+		original, err := os.ReadFile(file)
+		Expect(err).NotTo(HaveOccurred())
+		backup, err := machinery.CreateBackup(config)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(clientcmd.WriteToFile(*sampleClusters(3), file)).To(Succeed())
+		backup, err = machinery.ReadBackup(config, backup.Name)
+		Expect(err).NotTo(HaveOccurred())
+		backupConfig, err := backup.Config()
+		Expect(err).NotTo(HaveOccurred())
+		local, err := machinery.ReadLocalData(config)
+		Expect(err).NotTo(HaveOccurred())
+		diff, err := machinery.ComputeDiff(local.Config, backupConfig)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(diff.Items).NotTo(BeEmpty())
+
+		Expect(machinery.RestoreBackup(config, backup)).To(Succeed())
+		restored, err := os.ReadFile(file)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(restored).To(Equal(original))
+		Expect(file + ".lock").NotTo(BeAnExistingFile())
+	})
+	It("should delete files that did not exist when the backup was taken", func() {
+		kubeDir := filepath.Join(dir, "kube")
+		Expect(os.Mkdir(kubeDir, 0700)).To(Succeed())
+		Expect(clientcmd.WriteToFile(*sampleClusters(1), filepath.Join(kubeDir, "one.yaml"))).To(Succeed())
+		config.KubeconfigPath = kubeDir
+		backup, err := machinery.CreateBackup(config)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(backup.Files).To(HaveLen(1))
+
+		Expect(clientcmd.WriteToFile(*sampleClusters(2), filepath.Join(kubeDir, "two.yaml"))).To(Succeed())
+		Expect(machinery.RestoreBackup(config, backup)).To(Succeed())
+		Expect(filepath.Join(kubeDir, "one.yaml")).To(BeAnExistingFile())
+		Expect(filepath.Join(kubeDir, "two.yaml")).NotTo(BeAnExistingFile())
+	})
+	It("should list backups newest first", func() {
+		first, err := machinery.CreateBackup(config)
+		Expect(err).NotTo(HaveOccurred())
+		second, err := machinery.CreateBackup(config)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(second.Name).NotTo(Equal(first.Name))
+		backups, err := machinery.ListBackups(config)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(backups).To(HaveLen(2))
+		Expect(backups[0].Name).To(Equal(second.Name))
+		Expect(backups[1].Name).To(Equal(first.Name))
+	})
+	It("should prune backups by count", func() {
+		config.Backups = &machinery.BackupConfig{
+			MaxCount: 2,
+		}
+		for i := 0; i < 3; i++ {
+			_, err := machinery.CreateBackup(config)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		backups, err := machinery.ListBackups(config)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(backups).To(HaveLen(2))
+	})
+	It("should prune backups by age", func() {
+		old, err := machinery.CreateBackup(config)
+		Expect(err).NotTo(HaveOccurred())
+		time.Sleep(50 * time.Millisecond)
+		config.Backups = &machinery.BackupConfig{
+			MaxAge: &metav1.Duration{Duration: 25 * time.Millisecond},
+		}
+		latest, err := machinery.CreateBackup(config)
+		Expect(err).NotTo(HaveOccurred())
+		backups, err := machinery.ListBackups(config)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(backups).To(HaveLen(1))
+		Expect(backups[0].Name).To(Equal(latest.Name))
+		_, err = machinery.ReadBackup(config, old.Name)
+		Expect(err).To(MatchError(machinery.ErrBackupNotFound))
+	})
+	It("should skip backups that cannot be read", func() {
+		Expect(os.MkdirAll(machinery.BackupsPath(config.Home()), 0700)).To(Succeed())
+		corrupt := filepath.Join(machinery.BackupsPath(config.Home()), "corrupt.yaml")
+		Expect(os.WriteFile(corrupt, []byte("files: [\n"), 0600)).To(Succeed())
+		config.Backups = &machinery.BackupConfig{
+			MaxCount: 1,
+		}
+		for i := 0; i < 2; i++ {
+			_, err := machinery.CreateBackup(config)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		backups, err := machinery.ListBackups(config)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(backups).To(HaveLen(1))
+		Expect(corrupt).To(BeAnExistingFile())
+	})
+	It("should not take backups if disabled", func() {
+		config.Backups = &machinery.BackupConfig{
+			Disabled: true,
+		}
+		backup, err := machinery.CreateBackup(config)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(backup).To(BeNil())
+		Expect(machinery.BackupsPath(config.Home())).NotTo(BeADirectory())
+	})
+})
@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package machinery
+
+import (
+	"os"
+	"syscall"
+)
+
+// chownLike sets the owner and group of a file to those of another file.
+func chownLike(path string, like os.FileInfo) error {
+	stat, ok := like.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	if info, err := os.Lstat(path); err == nil {
+		if current, ok := info.Sys().(*syscall.Stat_t); ok &&
+			current.Uid == stat.Uid && current.Gid == stat.Gid {
+			// Nothing to do, which also avoids needing permission to chown
+			return nil
+		}
+	}
+	return os.Lchown(path, int(stat.Uid), int(stat.Gid))
+}
@@ -0,0 +1,9 @@
+package machinery
+
+import "os"
+
+// chownLike is a no-op on Windows, where renaming a file keeps the ACLs of
+// the new file.
+func chownLike(path string, like os.FileInfo) error {
+	return nil
+}
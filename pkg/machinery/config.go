@@ -1,6 +1,7 @@
 package machinery
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 
@@ -9,37 +10,156 @@ import (
 )
 
 type KitConfig struct {
-	RemoteURL      string `json:"remoteUrl"`
+	TypeMeta `json:",inline"`
+
+	RemoteURL string `json:"remoteUrl"`
+	// Location of the local kubeconfig. Like KUBECONFIG, this may be a list
+	// of files, which are merged using the same rules as kubectl. It may
+	// also be a directory containing one .yaml or .yml file per context.
 	KubeconfigPath string `json:"kubeconfigPath"`
+	// File that new contexts are written to (default the first file in
+	// the kubeconfig path). Not used with a kubeconfig directory.
+	KubeconfigTarget string `json:"kubeconfigTarget,omitempty"`
+
+	// Path of the KV secret engine mount (default "kit")
+	MountPath string `json:"mountPath,omitempty"`
+	// Path prefix within the mount under which contexts are stored
+	SecretPath string `json:"secretPath,omitempty"`
+	// KV secret engine version, either 1 or 2 (default 2)
+	KVVersion int `json:"kvVersion,omitempty"`
+	// Vault Enterprise namespace. If unset, VAULT_NAMESPACE is used.
+	Namespace string `json:"namespace,omitempty"`
+	// Which contexts are synced with the remote (default all)
+	Sync *SyncFilter `json:"sync,omitempty"`
+	// Method used to log in to Vault when no token is available
+	Auth *AuthConfig `json:"auth,omitempty"`
+	// Encrypt remote data using Vault's Transit secret engine
+	Transit *TransitConfig `json:"transit,omitempty"`
+	// Public keys of users that contexts can be shared with
+	Recipients []Recipient `json:"recipients,omitempty"`
+	// Location of the local identity used to open shared contexts
+	// (default ~/.kit/identity)
+	IdentityFile string `json:"identityFile,omitempty"`
+	// Location of the ed25519 key used to sign pushes
+	// (default ~/.kit/signing.key)
+	SigningKeyFile string `json:"signingKeyFile,omitempty"`
+	// Public keys whose signed pushes are trusted
+	TrustedKeys []TrustedKey `json:"trustedKeys,omitempty"`
+	// How to handle unsigned or untrusted contexts when pulling, either
+	// "warn" (default) or "require"
+	SignaturePolicy SignaturePolicy `json:"signaturePolicy,omitempty"`
+	// How the remote cache is encrypted at rest
+	CacheEncryption *CacheEncryptionConfig `json:"cacheEncryption,omitempty"`
+	// Backups of the local kubeconfig taken before it is modified
+	Backups *BackupConfig `json:"backups,omitempty"`
+	// How 'kit watch' reacts to changes to the local kubeconfig
+	Watch *WatchConfig `json:"watch,omitempty"`
+	// Settings for 'kit daemon'
+	Daemon *DaemonConfig `json:"daemon,omitempty"`
+	// Additional named remotes
+	Remotes []RemoteConfig `json:"remotes,omitempty"`
+	// Remote used when none is specified (default "default", the remote
+	// configured by the top-level fields)
+	DefaultRemote string `json:"defaultRemote,omitempty"`
+
+	// Name of the remote selected with ForRemote
+	remoteName string
+	// Locations of the kit home directory and the config file
+	home string
+	path string
 }
 
+// Environment variables that relocate the kit home directory and the kit
+// config file
+const (
+	HomeEnv   = "KIT_HOME"
+	ConfigEnv = "KIT_CONFIG"
+)
+
 func (c *KitConfig) WriteToDisk() error {
-	// Write the config to "$HOME/.kit/config.yaml"
+	c.APIVersion = APIVersion
+	c.Kind = KindKitConfig
 	data, err := yaml.Marshal(c)
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(KitConfigPath(), data, 0600)
+	return os.WriteFile(c.ConfigPath(), data, 0600)
 }
 
-func ReadConfig() (*KitConfig, error) {
-	data, err := os.ReadFile(KitConfigPath())
+// ReadConfig reads the kit config from the given file. The directory holding
+// the remote cache, keys and other state is KIT_HOME if set, otherwise the
+// directory containing the config file.
+func ReadConfig(path string) (*KitConfig, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	var c KitConfig
-	err = yaml.Unmarshal(data, &c)
+	migrated, upgraded, err := migrate(data, KindKitConfig, configMigrations)
 	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	var c KitConfig
+	if err := unmarshalStrict(migrated, &c, path); err != nil {
 		return nil, err
 	}
+	c.path = path
+	c.home = HomeForConfig(path)
+	if upgraded {
+		if err := replaceMigrated(path, data, c.WriteToDisk); err != nil {
+			return nil, err
+		}
+	}
 	return &c, nil
 }
 
-func KitConfigPath() string {
-	return filepath.Join(DotKitPath(), "config.yaml")
+// ResolveConfigPath returns the location of the kit config file. In order of
+// precedence, this is the given path (from the --config flag), KIT_CONFIG,
+// or config.yaml in the kit home directory.
+func ResolveConfigPath(path string) string {
+	if path != "" {
+		return path
+	}
+	if env, ok := os.LookupEnv(ConfigEnv); ok && env != "" {
+		return env
+	}
+	return KitConfigPath(DotKitPath())
 }
 
+// HomeForConfig returns the kit home directory to use with the given config
+// file.
+func HomeForConfig(path string) string {
+	if env, ok := os.LookupEnv(HomeEnv); ok && env != "" {
+		return env
+	}
+	return filepath.Dir(path)
+}
+
+// Home returns the directory holding the remote cache, keys and other state.
+func (c *KitConfig) Home() string {
+	if c.home != "" {
+		return c.home
+	}
+	return DotKitPath()
+}
+
+// ConfigPath returns the file the config was read from.
+func (c *KitConfig) ConfigPath() string {
+	if c.path != "" {
+		return c.path
+	}
+	return KitConfigPath(c.Home())
+}
+
+func KitConfigPath(home string) string {
+	return filepath.Join(home, "config.yaml")
+}
+
+// DotKitPath returns the default kit home directory, which is KIT_HOME if
+// set, otherwise ~/.kit.
 func DotKitPath() string {
+	if env, ok := os.LookupEnv(HomeEnv); ok && env != "" {
+		return env
+	}
 	path, err := homedir.Expand("~/.kit")
 	if err != nil {
 		panic(err)
@@ -0,0 +1,75 @@
+package machinery_test
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/kralicky/kit/pkg/machinery"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Config", func() {
+	var dir string
+	preserveEnv(machinery.HomeEnv, machinery.ConfigEnv)
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "kit-config")
+		Expect(err).NotTo(HaveOccurred())
+		os.Unsetenv(machinery.HomeEnv)
+		os.Unsetenv(machinery.ConfigEnv)
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should resolve the config path", func() {
+		Expect(machinery.ResolveConfigPath("/tmp/flag.yaml")).To(Equal("/tmp/flag.yaml"))
+
+		os.Setenv(machinery.ConfigEnv, "/tmp/env.yaml")
+		Expect(machinery.ResolveConfigPath("")).To(Equal("/tmp/env.yaml"))
+		Expect(machinery.ResolveConfigPath("/tmp/flag.yaml")).To(Equal("/tmp/flag.yaml"))
+
+		os.Unsetenv(machinery.ConfigEnv)
+		os.Setenv(machinery.HomeEnv, dir)
+		Expect(machinery.ResolveConfigPath("")).To(Equal(filepath.Join(dir, "config.yaml")))
+	})
+	It("should keep state next to the config file", func() {
+		path := filepath.Join(dir, "team", "config.yaml")
+		Expect(machinery.InitLocal(path, "https://vault.example.com")).To(Succeed())
+		config, err := machinery.ReadConfig(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config.RemoteURL).To(Equal("https://vault.example.com"))
+		Expect(config.Home()).To(Equal(filepath.Join(dir, "team")))
+		Expect(config.ConfigPath()).To(Equal(path))
+		Expect(config.RemoteCachePath()).To(Equal(filepath.Join(dir, "team", "remote.yaml")))
+		Expect(config.IdentityPath()).To(Equal(filepath.Join(dir, "team", "identity")))
+	})
+	It("should use KIT_HOME for state", func() {
+		path := filepath.Join(dir, "config.yaml")
+		Expect(machinery.InitLocal(path, "https://vault.example.com")).To(Succeed())
+		os.Setenv(machinery.HomeEnv, filepath.Join(dir, "home"))
+		config, err := machinery.ReadConfig(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config.RemoteCachePath()).To(Equal(filepath.Join(dir, "home", "remote.yaml")))
+	})
+	It("should isolate the remote cache of separate homes", func() {
+		for _, name := range []string{"a", "b"} {
+			path := filepath.Join(dir, name, "config.yaml")
+			Expect(machinery.InitLocal(path, "https://"+name+".example.com")).To(Succeed())
+			config, err := machinery.ReadConfig(path)
+			Expect(err).NotTo(HaveOccurred())
+			cache := &machinery.RemoteCache{}
+			cache.Latest.Contexts = sampleClusters(1).Contexts
+			Expect(cache.WriteToDisk(config)).To(Succeed())
+		}
+		for _, name := range []string{"a", "b"} {
+			config, err := machinery.ReadConfig(filepath.Join(dir, name, "config.yaml"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(dir, name, "remote.key")).To(BeAnExistingFile())
+			cache, err := machinery.ReadRemoteCache(config)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cache.Latest.Contexts).To(HaveKey("context1"))
+		}
+	})
+})
@@ -0,0 +1,98 @@
+package machinery
+
+import (
+	"encoding/json"
+
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/clientcmd/api"
+	"k8s.io/client-go/tools/clientcmd/api/latest"
+	clientcmdv1 "k8s.io/client-go/tools/clientcmd/api/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// The internal api.Config type stores clusters, users and contexts in maps,
+// while kubeconfig files store them in lists of named entries. Everything kit
+// writes uses the kubeconfig (v1) format, so that remote data and the remote
+// cache can be read by kubectl and other tools.
+
+// toV1 converts a config to the kubeconfig file format.
+func toV1(config *api.Config) (*clientcmdv1.Config, error) {
+	out := &clientcmdv1.Config{}
+	if err := latest.Scheme.Convert(config, out, nil); err != nil {
+		return nil, err
+	}
+	out.APIVersion = latest.Version
+	out.Kind = "Config"
+	return out, nil
+}
+
+// fromV1 converts a config in the kubeconfig file format to the internal
+// type.
+func fromV1(config *clientcmdv1.Config) (*api.Config, error) {
+	out := api.NewConfig()
+	if err := latest.Scheme.Convert(config, out, nil); err != nil {
+		return nil, err
+	}
+	if out.Clusters == nil {
+		out.Clusters = map[string]*api.Cluster{}
+	}
+	if out.AuthInfos == nil {
+		out.AuthInfos = map[string]*api.AuthInfo{}
+	}
+	if out.Contexts == nil {
+		out.Contexts = map[string]*api.Context{}
+	}
+	return out, nil
+}
+
+// decodeKubeconfig decodes a kubeconfig. Older versions of kit stored remote
+// data by marshaling the internal type directly, which is detected by its
+// clusters, users or contexts being maps instead of lists.
+func decodeKubeconfig(data []byte) (*api.Config, error) {
+	if isLegacyKubeconfig(data) {
+		config := api.NewConfig()
+		if err := yaml.Unmarshal(data, config); err != nil {
+			return nil, err
+		}
+		return config, nil
+	}
+	return clientcmd.Load(data)
+}
+
+func isLegacyKubeconfig(data []byte) bool {
+	doc := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return false
+	}
+	for _, key := range []string{"clusters", "users", "contexts"} {
+		if _, ok := doc[key].(map[string]interface{}); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// convertLegacyConfig converts a config in the internal format, decoded into
+// a generic document, to the kubeconfig format.
+func convertLegacyConfig(doc interface{}) (interface{}, error) {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	config := api.NewConfig()
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	v1, err := toV1(config)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = json.Marshal(v1); err != nil {
+		return nil, err
+	}
+	var out interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,156 @@
+package machinery_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kralicky/kit/pkg/machinery"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/clientcmd/api"
+	"sigs.k8s.io/yaml"
+)
+
+var _ = Describe("Kubeconfig conversion", func() {
+	var dir string
+	var local *api.Config
+	preserveEnv(machinery.HomeEnv, "VAULT_TOKEN", "VAULT_NAMESPACE")
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "kit-convert")
+		Expect(err).NotTo(HaveOccurred())
+		os.Setenv(machinery.HomeEnv, dir)
+		os.Setenv("VAULT_TOKEN", "test-token")
+		os.Unsetenv("VAULT_NAMESPACE")
+		data, err := machinery.ReadLocalData(&machinery.KitConfig{
+			KubeconfigPath: filepath.Join("testdata", "kubeconfigs", "auth-plugins.yaml"),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		local = data.Config
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	expectEquivalent := func(config *api.Config) {
+		diff, err := machinery.ComputeDiff(local, config)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(diff.Items).To(BeEmpty())
+		for name, authInfo := range local.AuthInfos {
+			Expect(config.AuthInfos).To(HaveKey(name))
+			Expect(machinery.AuthInfosEqual(authInfo, config.AuthInfos[name])).To(BeTrue(), name)
+		}
+		for name, cluster := range local.Clusters {
+			Expect(config.Clusters).To(HaveKey(name))
+			Expect(machinery.ClustersEqual(cluster, config.Clusters[name])).To(BeTrue(), name)
+		}
+		exec := config.AuthInfos["arn:aws:eks:us-east-1:123456789012:cluster/prod"].Exec
+		Expect(exec.Args).To(ContainElement("get-token"))
+		Expect(exec.Env).To(ConsistOf(api.ExecEnvVar{Name: "AWS_PROFILE", Value: "production"}))
+		gcp := config.AuthInfos["gke_project_us-central1_staging"].AuthProvider
+		Expect(gcp.Name).To(Equal("gcp"))
+		Expect(gcp.Config).To(HaveKeyWithValue("expiry-key", "{.credential.token_expiry}"))
+	}
+
+	It("should round trip through the remote cache", func() {
+		config := &machinery.KitConfig{}
+		cache := &machinery.RemoteCache{
+			Latest:  *local,
+			History: []api.Config{*local},
+		}
+		Expect(cache.WriteToDisk(config)).To(Succeed())
+		read, err := machinery.ReadRemoteCache(config)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(read.APIVersion).To(Equal(machinery.RemoteCacheAPIVersion))
+		expectEquivalent(&read.Latest)
+		Expect(read.History).To(HaveLen(1))
+		expectEquivalent(&read.History[0])
+	})
+	It("should upgrade remote caches that store the internal format", func() {
+		config := &machinery.KitConfig{}
+		legacy, err := yaml.Marshal(map[string]interface{}{
+			"apiVersion": "kit/v1",
+			"kind":       machinery.KindRemoteCache,
+			"latest":     local,
+			"history":    []interface{}{},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.WriteFile(config.RemoteCachePath(), legacy, 0600)).To(Succeed())
+		read, err := machinery.ReadRemoteCache(config)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(read.APIVersion).To(Equal(machinery.RemoteCacheAPIVersion))
+		expectEquivalent(&read.Latest)
+		Expect(machinery.MigrationBackupPath(config.RemoteCachePath())).To(BeAnExistingFile())
+	})
+	It("should round trip through remote data", func() {
+		responses := map[string]interface{}{}
+		for name := range local.Contexts {
+			responses["PUT /v1/kit/data/"+name] = map[string]interface{}{}
+		}
+		vault := newStubVault(responses)
+		defer vault.Close()
+		client, err := machinery.NewRemoteClient(&machinery.KitConfig{RemoteURL: vault.URL})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(client.PushRemoteData(local)).To(Succeed())
+
+		var names []string
+		pushed := map[string]interface{}{}
+		for _, req := range vault.Requests() {
+			if req.Method != "PUT" {
+				continue
+			}
+			name := strings.TrimPrefix(req.Path, "/v1/kit/data/")
+			data := req.Body["data"].(map[string]interface{})
+			// Remote data is stored as a regular kubeconfig
+			kubeconfig, err := clientcmd.Load([]byte(data["kubeconfig"].(string)))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(kubeconfig.Contexts).To(HaveKey(name))
+			names = append(names, name)
+			pushed["GET /v1/kit/data/"+name] = map[string]interface{}{
+				"data": map[string]interface{}{
+					"data": data,
+				},
+			}
+		}
+		Expect(names).To(HaveLen(len(local.Contexts)))
+		pushed["LIST /v1/kit/metadata"] = map[string]interface{}{
+			"data": map[string]interface{}{
+				"keys": names,
+			},
+		}
+		remote := newStubVault(pushed)
+		defer remote.Close()
+		client, err = machinery.NewRemoteClient(&machinery.KitConfig{RemoteURL: remote.URL})
+		Expect(err).NotTo(HaveOccurred())
+		cache, err := client.LoadRemoteData()
+		Expect(err).NotTo(HaveOccurred())
+		expectEquivalent(&cache.Latest)
+	})
+	It("should read remote data written by older versions", func() {
+		legacy, err := yaml.Marshal(machinery.ContextConfig(local, "gke"))
+		Expect(err).NotTo(HaveOccurred())
+		vault := newStubVault(map[string]interface{}{
+			"LIST /v1/kit/metadata": map[string]interface{}{
+				"data": map[string]interface{}{
+					"keys": []string{"gke"},
+				},
+			},
+			"GET /v1/kit/data/gke": map[string]interface{}{
+				"data": map[string]interface{}{
+					"data": map[string]interface{}{
+						"kubeconfig": string(legacy),
+					},
+				},
+			},
+		})
+		defer vault.Close()
+		client, err := machinery.NewRemoteClient(&machinery.KitConfig{RemoteURL: vault.URL})
+		Expect(err).NotTo(HaveOccurred())
+		cache, err := client.LoadRemoteData()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cache.Latest.Contexts).To(HaveKey("gke"))
+		Expect(cache.Latest.AuthInfos["gke_project_us-central1_staging"].AuthProvider.Name).To(Equal("gcp"))
+	})
+})
@@ -0,0 +1,536 @@
+package machinery
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+// Time between pulls if not configured
+const DefaultDaemonInterval = 5 * time.Minute
+
+// DaemonConfig controls 'kit daemon'.
+type DaemonConfig struct {
+	// Time between pulls from the remote (default 5m)
+	Interval *metav1.Duration `json:"interval,omitempty"`
+}
+
+func (c *KitConfig) DaemonInterval() time.Duration {
+	if c.Daemon == nil || c.Daemon.Interval == nil || c.Daemon.Interval.Duration <= 0 {
+		return DefaultDaemonInterval
+	}
+	return c.Daemon.Interval.Duration
+}
+
+func DaemonSocketPath(home string) string {
+	return filepath.Join(home, "daemon.sock")
+}
+
+// IsConflict returns true if applying the item would overwrite, rename or
+// delete something in the local kubeconfig, and so needs to be confirmed.
+func IsConflict(item DiffItem) bool {
+	return item.ChangeType&(ChangeTypeReplace|ChangeTypeModify|ChangeTypeRename|
+		ChangeTypeDelete|ChangeTypeComplex|ChangeTypeAmbiguous) != 0 ||
+		item.Complex&ComplexDiffRenameRequired != 0
+}
+
+// Conflict is an incoming change the daemon did not apply automatically.
+type Conflict struct {
+	// Identifies the change; a different incoming change to the same context
+	// has a different ID
+	ID          string `json:"id"`
+	Description string `json:"description"`
+	Incoming    string `json:"incoming,omitempty"`
+	Existing    string `json:"existing,omitempty"`
+	// Existing contexts the change may apply to, if it is ambiguous
+	Candidates []string  `json:"candidates,omitempty"`
+	Detected   time.Time `json:"detected"`
+}
+
+func conflictID(item DiffItem, existing, incoming *api.Config) string {
+	sum := sha256.Sum256([]byte(FormatDiffItem(item, existing, incoming)))
+	return hex.EncodeToString(sum[:6])
+}
+
+// DaemonStatus is reported by the daemon's status endpoint.
+type DaemonStatus struct {
+	Remote    string     `json:"remote"`
+	Started   time.Time  `json:"started"`
+	LastSync  time.Time  `json:"lastSync,omitempty"`
+	LastError string     `json:"lastError,omitempty"`
+	Applied   int        `json:"applied"`
+	Conflicts []Conflict `json:"conflicts"`
+}
+
+// Daemon pulls from a remote periodically. Changes that do not conflict with
+// the local kubeconfig are applied automatically, and conflicts are kept
+// until they are resolved through the control API.
+type Daemon struct {
+	conf   *KitConfig
+	client *RemoteClient
+
+	// Serializes pulls and resolutions, which both write the kubeconfig
+	syncMu sync.Mutex
+
+	mu        sync.Mutex
+	status    DaemonStatus
+	conflicts map[string]Conflict
+	// Conflicts rejected since the daemon was started
+	rejected map[string]bool
+}
+
+func NewDaemon(conf *KitConfig, client *RemoteClient) *Daemon {
+	return &Daemon{
+		conf:   conf,
+		client: client,
+		status: DaemonStatus{
+			Remote:  conf.RemoteName(),
+			Started: time.Now().UTC(),
+		},
+		conflicts: map[string]Conflict{},
+		rejected:  map[string]bool{},
+	}
+}
+
+// Status returns the current status, with conflicts oldest first.
+func (d *Daemon) Status() DaemonStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	status := d.status
+	status.Conflicts = make([]Conflict, 0, len(d.conflicts))
+	for _, c := range d.conflicts {
+		status.Conflicts = append(status.Conflicts, c)
+	}
+	sort.Slice(status.Conflicts, func(i, j int) bool {
+		a, b := status.Conflicts[i], status.Conflicts[j]
+		if !a.Detected.Equal(b.Detected) {
+			return a.Detected.Before(b.Detected)
+		}
+		return a.ID < b.ID
+	})
+	return status
+}
+
+// daemonState is the local and remote data a pull or resolution works on.
+type daemonState struct {
+	local  *LocalData
+	remote *api.Config
+	owners *Ownership
+	diff   *Diff
+}
+
+func (d *Daemon) readState() (*daemonState, error) {
+	local, err := ReadLocalData(d.conf)
+	if err != nil {
+		return nil, err
+	}
+	cache, err := ReadRemoteCache(d.conf)
+	if err != nil {
+		return nil, err
+	}
+	owners, err := ReadOwnership(d.conf.Home())
+	if err != nil {
+		return nil, err
+	}
+	diff, err := ComputeRemoteDiff(local.Config, cache,
+		d.conf.Sync, owners, d.conf.RemoteName())
+	if err != nil {
+		return nil, err
+	}
+	return &daemonState{
+		local:  local,
+		remote: &cache.Latest,
+		owners: owners,
+		diff:   diff,
+	}, nil
+}
+
+// candidateResolver chooses the named candidate for ambiguous items, or the
+// one chosen by ComputeDiff if no name is given.
+type candidateResolver struct {
+	name string
+}
+
+func (r candidateResolver) Rename(kind, oldName string, validator func(string) error) string {
+	return AutoResolver.Rename(kind, oldName, validator)
+}
+
+func (r candidateResolver) Choose(item DiffItem) NamedContext {
+	if r.name == "" {
+		return item.AffectedExisting
+	}
+	return NamedContext{Name: r.name}
+}
+
+// apply applies the items to the local kubeconfig and writes it.
+func (d *Daemon) apply(state *daemonState, items []DiffItem, resolver ConflictResolver) error {
+	if len(items) > 0 {
+		diff := &Diff{Items: items}
+		if err := diff.Apply(state.local.Config, state.remote, resolver); err != nil {
+			return err
+		}
+		if _, err := CreateBackup(d.conf); err != nil {
+			return err
+		}
+		if err := WriteLocalData(d.conf, state.local); err != nil {
+			return err
+		}
+	}
+	state.owners.Claim(state.local.Config, FilterConfig(state.remote, d.conf.Sync), d.conf.RemoteName())
+	return state.owners.WriteToDisk(d.conf.Home())
+}
+
+// Sync pulls from the remote once, applies changes that do not conflict, and
+// replaces the pending conflicts with the ones that remain.
+func (d *Daemon) Sync() error {
+	d.syncMu.Lock()
+	defer d.syncMu.Unlock()
+	err := d.sync()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.status.LastSync = time.Now().UTC()
+	d.status.LastError = ""
+	if err != nil {
+		d.status.LastError = err.Error()
+	}
+	return err
+}
+
+func (d *Daemon) sync() error {
+	cache, err := d.client.LoadRemoteData()
+	if err != nil {
+		if IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if err := cache.WriteToDisk(d.conf); err != nil {
+		return err
+	}
+	state, err := d.readState()
+	if err != nil {
+		return err
+	}
+	safe := d.queueConflicts(state)
+	for _, item := range safe {
+		log.Info(FormatDiffItem(item, state.local.Config, state.remote))
+	}
+	if err := d.apply(state, safe, AutoResolver); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.status.Applied += len(safe)
+	d.mu.Unlock()
+	return nil
+}
+
+// queueConflicts replaces the pending conflicts with the conflicts in the
+// diff, and returns the items that do not conflict.
+func (d *Daemon) queueConflicts(state *daemonState) []DiffItem {
+	var safe []DiffItem
+	conflicts := map[string]Conflict{}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, item := range state.diff.Items {
+		if !IsConflict(item) {
+			safe = append(safe, item)
+			continue
+		}
+		id := conflictID(item, state.local.Config, state.remote)
+		if d.rejected[id] {
+			continue
+		}
+		conflict, ok := d.conflicts[id]
+		if !ok {
+			conflict = Conflict{
+				ID:          id,
+				Description: FormatDiffItem(item, state.local.Config, state.remote),
+				Incoming:    item.AffectedIncoming.Name,
+				Existing:    item.AffectedExisting.Name,
+				Detected:    time.Now().UTC(),
+			}
+			for _, candidate := range item.Candidates {
+				conflict.Candidates = append(conflict.Candidates, candidate.Name)
+			}
+			log.Infof("Conflict %s: %s", id, conflict.Description)
+		}
+		conflicts[id] = conflict
+	}
+	d.conflicts = conflicts
+	return safe
+}
+
+// Resolve accepts or rejects a pending conflict. Accepted changes are applied
+// to the local kubeconfig; rejected ones are not reported again unless the
+// incoming context changes. If the conflict is ambiguous, candidate names the
+// existing context the change applies to (default the first candidate).
+//
+// Accepting a change can affect other pending conflicts, for example when a
+// different candidate is chosen, so they are computed again afterwards.
+func (d *Daemon) Resolve(id string, accept bool, candidate string) error {
+	d.syncMu.Lock()
+	defer d.syncMu.Unlock()
+	d.mu.Lock()
+	_, ok := d.conflicts[id]
+	d.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrConflictNotFound, id)
+	}
+	if accept {
+		// The local kubeconfig may have changed since the conflict was found
+		state, err := d.readState()
+		if err != nil {
+			return err
+		}
+		var item *DiffItem
+		for i := range state.diff.Items {
+			if conflictID(state.diff.Items[i], state.local.Config, state.remote) == id {
+				item = &state.diff.Items[i]
+				break
+			}
+		}
+		if item == nil {
+			d.forget(id)
+			return fmt.Errorf("%w: %s", ErrConflictNotFound, id)
+		}
+		if candidate != "" && item.ChangeType&ChangeTypeAmbiguous == 0 {
+			return fmt.Errorf("%w: %s (the change is not ambiguous)", ErrInvalidCandidate, candidate)
+		}
+		log.Info(FormatDiffItem(*item, state.local.Config, state.remote))
+		if err := d.apply(state, []DiffItem{*item}, candidateResolver{name: candidate}); err != nil {
+			return err
+		}
+		d.mu.Lock()
+		d.status.Applied++
+		d.mu.Unlock()
+		if state, err = d.readState(); err != nil {
+			return err
+		}
+		// Changes that do not conflict are applied by the next pull
+		d.queueConflicts(state)
+	} else {
+		d.mu.Lock()
+		d.rejected[id] = true
+		d.mu.Unlock()
+	}
+	d.forget(id)
+	return nil
+}
+
+func (d *Daemon) forget(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.conflicts, id)
+}
+
+// Handler returns the daemon's control API.
+func (d *Daemon) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeDaemonError(w, http.StatusMethodNotAllowed, errors.New(r.Method+" not allowed"))
+			return
+		}
+		writeDaemonResponse(w, d.Status())
+	})
+	mux.HandleFunc("/v1/sync", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeDaemonError(w, http.StatusMethodNotAllowed, errors.New(r.Method+" not allowed"))
+			return
+		}
+		if err := d.Sync(); err != nil {
+			writeDaemonError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeDaemonResponse(w, d.Status())
+	})
+	// POST /v1/conflicts/<id>/accept[?candidate=<name>] or
+	// /v1/conflicts/<id>/reject
+	mux.HandleFunc("/v1/conflicts/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeDaemonError(w, http.StatusMethodNotAllowed, errors.New(r.Method+" not allowed"))
+			return
+		}
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/conflicts/"), "/")
+		if len(parts) != 2 || (parts[1] != "accept" && parts[1] != "reject") {
+			http.NotFound(w, r)
+			return
+		}
+		if err := d.Resolve(parts[0], parts[1] == "accept", r.URL.Query().Get("candidate")); err != nil {
+			code := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, ErrConflictNotFound):
+				code = http.StatusNotFound
+			case errors.Is(err, ErrInvalidCandidate):
+				code = http.StatusBadRequest
+			}
+			writeDaemonError(w, code, err)
+			return
+		}
+		writeDaemonResponse(w, d.Status())
+	})
+	return mux
+}
+
+type daemonError struct {
+	Error string `json:"error"`
+}
+
+func writeDaemonResponse(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Debugf("Failed to write daemon response: %v", err)
+	}
+}
+
+func writeDaemonError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(daemonError{Error: err.Error()}); err != nil {
+		log.Debugf("Failed to write daemon response: %v", err)
+	}
+}
+
+// Listen creates the daemon's control socket. A socket left behind by a
+// daemon that is no longer running is replaced.
+func (d *Daemon) Listen() (net.Listener, error) {
+	path := DaemonSocketPath(d.conf.Home())
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("%w (%s)", ErrDaemonAlreadyRunning, path)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Run serves the control API on the listener and pulls from the remote every
+// interval, until the context is canceled. Failed pulls are logged and
+// retried at the next interval.
+func (d *Daemon) Run(ctx context.Context, listener net.Listener, interval time.Duration) error {
+	server := &http.Server{Handler: d.Handler()}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+	defer server.Close()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := d.Sync(); err != nil {
+			log.Errorf("Pull failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-serveErr:
+			return err
+		case <-ticker.C:
+		}
+	}
+}
+
+// DaemonClient talks to a running daemon over its control socket.
+type DaemonClient struct {
+	client *http.Client
+}
+
+// NewDaemonClient connects to the daemon for the kit home directory. It
+// returns ErrDaemonNotRunning if there is no daemon listening.
+func NewDaemonClient(home string) (*DaemonClient, error) {
+	path := DaemonSocketPath(home)
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, ErrDaemonNotRunning
+	}
+	conn.Close()
+	return &DaemonClient{
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", path)
+				},
+			},
+		},
+	}, nil
+}
+
+func (c *DaemonClient) do(method, path string) (*DaemonStatus, error) {
+	req, err := http.NewRequest(method, "http://kit"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		apiErr := daemonError{}
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil || apiErr.Error == "" {
+			apiErr.Error = resp.Status
+		}
+		switch resp.StatusCode {
+		case http.StatusNotFound:
+			return nil, ErrConflictNotFound
+		case http.StatusBadRequest:
+			return nil, fmt.Errorf("%w: %s", ErrInvalidCandidate, apiErr.Error)
+		}
+		return nil, errors.New(apiErr.Error)
+	}
+	status := &DaemonStatus{}
+	if err := json.NewDecoder(resp.Body).Decode(status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func (c *DaemonClient) Status() (*DaemonStatus, error) {
+	return c.do(http.MethodGet, "/v1/status")
+}
+
+// Sync asks the daemon to pull immediately.
+func (c *DaemonClient) Sync() (*DaemonStatus, error) {
+	return c.do(http.MethodPost, "/v1/sync")
+}
+
+func (c *DaemonClient) Resolve(id string, accept bool, candidate string) (*DaemonStatus, error) {
+	path := "/v1/conflicts/" + url.PathEscape(id) + "/reject"
+	if accept {
+		path = "/v1/conflicts/" + url.PathEscape(id) + "/accept"
+		if candidate != "" {
+			path += "?" + url.Values{"candidate": {candidate}}.Encode()
+		}
+	}
+	return c.do(http.MethodPost, path)
+}
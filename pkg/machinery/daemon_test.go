@@ -0,0 +1,236 @@
+package machinery_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kralicky/kit/pkg/machinery"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+var _ = Describe("Daemon", func() {
+	var dir, file string
+	var config *machinery.KitConfig
+	var vault *stubVault
+	var daemon *machinery.Daemon
+	preserveEnv(machinery.HomeEnv, "VAULT_TOKEN", "VAULT_NAMESPACE", "VAULT_MAX_RETRIES")
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "kit-daemon")
+		Expect(err).NotTo(HaveOccurred())
+		os.Setenv(machinery.HomeEnv, filepath.Join(dir, "home"))
+		os.Setenv("VAULT_TOKEN", "test-token")
+		os.Unsetenv("VAULT_NAMESPACE")
+		os.Setenv("VAULT_MAX_RETRIES", "0")
+		file = filepath.Join(dir, "config")
+		Expect(clientcmd.WriteToFile(*sampleClusters(1), file)).To(Succeed())
+
+		// context1 moved to a new server, and context2 is new
+		remote := sampleClusters(1, 2)
+		remote.Clusters["cluster1"].Server = "https://moved:6443"
+		responses := map[string]interface{}{
+			"LIST /v1/kit/metadata": map[string]interface{}{
+				"data": map[string]interface{}{
+					"keys": []string{"context1", "context2"},
+				},
+			},
+		}
+		for name := range remote.Contexts {
+			kubeconfig, err := clientcmd.Write(*machinery.ContextConfig(remote, name))
+			Expect(err).NotTo(HaveOccurred())
+			responses["GET /v1/kit/data/"+name] = map[string]interface{}{
+				"data": map[string]interface{}{
+					"data": map[string]interface{}{
+						"kubeconfig": string(kubeconfig),
+					},
+				},
+			}
+		}
+		vault = newStubVault(responses)
+		config = &machinery.KitConfig{
+			KubeconfigPath: file,
+			RemoteURL:      vault.URL,
+		}
+		client, err := machinery.NewRemoteClient(config)
+		Expect(err).NotTo(HaveOccurred())
+		daemon = machinery.NewDaemon(config, client)
+	})
+	AfterEach(func() {
+		vault.Close()
+		os.RemoveAll(dir)
+	})
+	readLocal := func() *api.Config {
+		local, err := machinery.ReadLocalData(config)
+		Expect(err).NotTo(HaveOccurred())
+		return local.Config
+	}
+
+	It("should apply changes that do not conflict and queue the rest", func() {
+		Expect(daemon.Sync()).To(Succeed())
+		local := readLocal()
+		Expect(local.Contexts).To(HaveKey("context2"))
+		Expect(local.Clusters["cluster1"].Server).To(Equal("https://host1:6443"))
+		status := daemon.Status()
+		Expect(status.Applied).To(Equal(1))
+		Expect(status.LastError).To(BeEmpty())
+		Expect(status.Conflicts).To(HaveLen(1))
+		Expect(status.Conflicts[0].Incoming).To(Equal("context1"))
+
+		// Conflicts keep their ID across pulls
+		Expect(daemon.Sync()).To(Succeed())
+		Expect(daemon.Status().Conflicts).To(Equal(status.Conflicts))
+	})
+	It("should apply accepted conflicts", func() {
+		Expect(daemon.Sync()).To(Succeed())
+		id := daemon.Status().Conflicts[0].ID
+		Expect(daemon.Resolve(id, true, "context2")).To(MatchError(machinery.ErrInvalidCandidate))
+		Expect(daemon.Resolve(id, true, "")).To(Succeed())
+		Expect(readLocal().Clusters["cluster1"].Server).To(Equal("https://moved:6443"))
+		Expect(daemon.Status().Conflicts).To(BeEmpty())
+		Expect(daemon.Resolve(id, true, "")).To(MatchError(machinery.ErrConflictNotFound))
+	})
+	It("should not report rejected conflicts again", func() {
+		Expect(daemon.Sync()).To(Succeed())
+		id := daemon.Status().Conflicts[0].ID
+		Expect(daemon.Resolve(id, false, "")).To(Succeed())
+		Expect(daemon.Sync()).To(Succeed())
+		Expect(daemon.Status().Conflicts).To(BeEmpty())
+		Expect(readLocal().Clusters["cluster1"].Server).To(Equal("https://host1:6443"))
+	})
+	It("should queue remote deletions instead of applying them", func() {
+		Expect(daemon.Sync()).To(Succeed())
+		Expect(readLocal().Contexts).To(HaveKey("context2"))
+
+		// context2 was deleted from the remote
+		vault.responses["LIST /v1/kit/metadata"] = map[string]interface{}{
+			"data": map[string]interface{}{
+				"keys": []string{"context1"},
+			},
+		}
+		Expect(daemon.Sync()).To(Succeed())
+		Expect(readLocal().Contexts).To(HaveKey("context2"))
+		id := ""
+		for _, conflict := range daemon.Status().Conflicts {
+			if conflict.Existing == "context2" {
+				id = conflict.ID
+			}
+		}
+		Expect(id).NotTo(BeEmpty())
+		Expect(daemon.Resolve(id, true, "")).To(Succeed())
+		Expect(readLocal().Contexts).NotTo(HaveKey("context2"))
+	})
+	It("should not delete the chosen candidate of an ambiguous conflict", func() {
+		// context1 and context2 share a cluster, and the remote has a single
+		// context on it with a new user
+		local := sampleClusters(1, 2)
+		local.Contexts["context2"].Cluster = "cluster1"
+		delete(local.Clusters, "cluster2")
+		Expect(clientcmd.WriteToFile(*local, file)).To(Succeed())
+		Expect(os.MkdirAll(config.Home(), 0700)).To(Succeed())
+		owners := &machinery.Ownership{
+			Contexts: map[string]string{
+				"context1": machinery.DefaultRemoteName,
+				"context2": machinery.DefaultRemoteName,
+			},
+		}
+		Expect(owners.WriteToDisk(config.Home())).To(Succeed())
+		remote := sampleClusters(1)
+		remote.AuthInfos["authInfo1"].Token = "new-token"
+		kubeconfig, err := clientcmd.Write(*remote)
+		Expect(err).NotTo(HaveOccurred())
+		vault.responses["LIST /v1/kit/metadata"] = map[string]interface{}{
+			"data": map[string]interface{}{
+				"keys": []string{"other"},
+			},
+		}
+		vault.responses["GET /v1/kit/data/other"] = map[string]interface{}{
+			"data": map[string]interface{}{
+				"data": map[string]interface{}{
+					"kubeconfig": strings.Replace(string(kubeconfig), "name: context1", "name: other", 1),
+				},
+			},
+		}
+
+		Expect(daemon.Sync()).To(Succeed())
+		conflicts := daemon.Status().Conflicts
+		Expect(conflicts).To(HaveLen(1))
+		Expect(conflicts[0].Candidates).To(Equal([]string{"context1", "context2"}))
+		Expect(daemon.Resolve(conflicts[0].ID, true, "context2")).To(Succeed())
+		Expect(readLocal().Contexts).To(HaveKey("context2"))
+		Expect(readLocal().AuthInfos["authInfo2"].Token).To(Equal("new-token"))
+
+		// The candidate that was not chosen is deleted, not the chosen one
+		var deleted []string
+		for _, conflict := range daemon.Status().Conflicts {
+			if conflict.Incoming == "" {
+				deleted = append(deleted, conflict.Existing)
+				Expect(daemon.Resolve(conflict.ID, true, "")).To(Succeed())
+			}
+		}
+		Expect(deleted).To(Equal([]string{"context1"}))
+		local = readLocal()
+		Expect(local.Contexts).NotTo(HaveKey("context1"))
+		Expect(local.Contexts).To(HaveKey("context2"))
+	})
+	It("should record failed pulls", func() {
+		vault.Close()
+		Expect(daemon.Sync()).NotTo(Succeed())
+		Expect(daemon.Status().LastError).NotTo(BeEmpty())
+	})
+
+	Context("control API", func() {
+		var cancel context.CancelFunc
+		var done chan error
+		BeforeEach(func() {
+			listener, err := daemon.Listen()
+			Expect(err).NotTo(HaveOccurred())
+			var ctx context.Context
+			ctx, cancel = context.WithCancel(context.Background())
+			done = make(chan error, 1)
+			go func() {
+				done <- daemon.Run(ctx, listener, time.Hour)
+			}()
+		})
+		AfterEach(func() {
+			cancel()
+			Eventually(done).Should(Receive(BeNil()))
+		})
+
+		It("should report status and resolve conflicts", func() {
+			client, err := machinery.NewDaemonClient(config.Home())
+			Expect(err).NotTo(HaveOccurred())
+			var status *machinery.DaemonStatus
+			Eventually(func() []machinery.Conflict {
+				status, err = client.Status()
+				Expect(err).NotTo(HaveOccurred())
+				return status.Conflicts
+			}).Should(HaveLen(1))
+			Expect(status.Remote).To(Equal(config.RemoteName()))
+
+			status, err = client.Resolve(status.Conflicts[0].ID, true, "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status.Conflicts).To(BeEmpty())
+			_, err = client.Resolve("unknown", false, "")
+			Expect(err).To(MatchError(machinery.ErrConflictNotFound))
+
+			status, err = client.Sync()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status.Applied).To(Equal(2))
+		})
+		It("should refuse to start twice", func() {
+			_, err := daemon.Listen()
+			Expect(err).To(MatchError(machinery.ErrDaemonAlreadyRunning))
+		})
+	})
+
+	It("should report when the daemon is not running", func() {
+		_, err := machinery.NewDaemonClient(config.Home())
+		Expect(err).To(MatchError(machinery.ErrDaemonNotRunning))
+	})
+})
@@ -2,10 +2,9 @@ package machinery
 
 import (
 	"bytes"
-	"reflect"
-
-	log "github.com/sirupsen/logrus"
+	"sort"
 
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/client-go/tools/clientcmd/api"
 )
 
@@ -16,7 +15,14 @@ func ClustersEqual(a, b *api.Cluster) bool {
 }
 
 func AuthInfosEqual(a, b *api.AuthInfo) bool {
-	return reflect.DeepEqual(a, b)
+	// The file an auth info was read from does not affect its contents
+	if a.LocationOfOrigin != b.LocationOfOrigin {
+		a, b = a.DeepCopy(), b.DeepCopy()
+		a.LocationOfOrigin, b.LocationOfOrigin = "", ""
+	}
+	// Empty and nil maps are equal, since files written by other tools may
+	// contain either
+	return equality.Semantic.DeepEqual(a, b)
 }
 
 func ComputeIncomingDiff(config *KitConfig, client *RemoteClient) (*Diff, error) {
@@ -24,13 +30,37 @@ func ComputeIncomingDiff(config *KitConfig, client *RemoteClient) (*Diff, error)
 	if err != nil {
 		return nil, err
 	}
-	remote, err := ReadRemoteCache()
+	remote, err := ReadRemoteCache(config)
+	if err != nil {
+		return nil, err
+	}
+	owners, err := ReadOwnership(config.Home())
 	if err != nil {
 		return nil, err
 	}
-	localConfig := local.Config
-	remoteConfig := remote.Latest
-	return ComputeDiff(localConfig, &remoteConfig)
+	return ComputeRemoteDiff(local.Config, remote, config.Sync, owners, config.RemoteName())
+}
+
+// ComputeOutgoingDiff computes the changes a push would make to the remote,
+// given the latest remote data. Pushes never delete remote contexts, so the
+// diff contains no deletions.
+func ComputeOutgoingDiff(local, remote *api.Config, filter *SyncFilter, owners *Ownership, remoteName string) (*Diff, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	outgoing := FilterConfig(owners.Filter(local, remoteName), filter)
+	diff, err := ComputeDiff(FilterConfig(remote, filter), outgoing)
+	if err != nil {
+		return nil, err
+	}
+	items := diff.Items[:0]
+	for _, item := range diff.Items {
+		if item.ChangeType&ChangeTypeDelete == 0 {
+			items = append(items, item)
+		}
+	}
+	diff.Items = items
+	return diff, nil
 }
 
 func ComputeDiff(existing *api.Config, incoming *api.Config) (*Diff, error) {
@@ -51,160 +81,112 @@ func ComputeDiff(existing *api.Config, incoming *api.Config) (*Diff, error) {
 	//     RenameRequired
 
 	diff := &Diff{}
+	incomingIndex, err := indexConfig(incoming, "remote", nil)
+	if err != nil {
+		return nil, err
+	}
 
-CONTEXT:
-	for contextName, context := range incoming.Contexts {
-		namedContext := NewNamedContext(contextName, context)
-		incomingCluster, ok := incoming.Clusters[context.Cluster]
-		if !ok {
-			// TODO: provide options to fix this automatically
-			log.Fatalf("Remote config is ill-formed: context %s references nonexistent cluster %s", contextName, context.Cluster)
-		}
-
-		incomingAuth, ok := incoming.AuthInfos[context.AuthInfo]
-		if !ok {
-			// TODO: provide options to fix this automatically
-			log.Fatalf("Remote config is ill-formed: context %s references nonexistent auth info %s", contextName, context.AuthInfo)
+	// Contexts that are identical on both sides are left out of the diff, and
+	// are never candidates for matching other incoming contexts
+	unchanged := map[string]bool{}
+	for _, entry := range incomingIndex.entries {
+		if isExactMatch(existing, entry) {
+			unchanged[entry.Name] = true
 		}
+	}
+	existingIndex, err := indexConfig(existing, "local", unchanged)
+	if err != nil {
+		return nil, err
+	}
 
-		// Check if there is an exact match
-		exactMatch := false
-		if existingContext, ok := existing.Contexts[contextName]; ok {
-			existingCluster, ok := existing.Clusters[existingContext.Cluster]
-			if ok && existingContext.Cluster == context.Cluster {
-				existingAuth, ok := existing.AuthInfos[existingContext.AuthInfo]
-				if ok && existingContext.AuthInfo == context.AuthInfo {
-					if ClustersEqual(existingCluster, incomingCluster) &&
-						AuthInfosEqual(existingAuth, incomingAuth) {
-						exactMatch = true
-					}
-				}
-			}
-		}
+	for _, entry := range incomingIndex.entries {
+		contextName, context := entry.Name, entry.Context
+		namedContext := entry.named()
+		incomingCluster, incomingAuth := entry.Cluster, entry.AuthInfo
 
 		// If there is an exact match, we can skip it
-		if exactMatch {
+		if unchanged[contextName] {
 			continue
 		}
 
 		// Check if there is a local match with different names
-		var matchingCluster *struct {
-			Cluster *api.Cluster
-			Context NamedContext
-		}
-		var matchingAuth *struct {
-			AuthInfo *api.AuthInfo
-			Context  NamedContext
-		}
-		for existingContextName, existingContext := range existing.Contexts {
-			existingCluster, ok := existing.Clusters[existingContext.Cluster]
-			if !ok {
-				log.Fatalf("Local config is ill-formed: context %s references nonexistent cluster %s", existingContextName, existingContext.Cluster)
-			}
-			existingAuth, ok := existing.AuthInfos[existingContext.AuthInfo]
-			if !ok {
-				log.Fatalf("Local config is ill-formed: context %s references nonexistent auth info %s", existingContextName, existingContext.AuthInfo)
-			}
-			if ClustersEqual(existingCluster, incomingCluster) {
-				matchingCluster = &struct {
-					Cluster *api.Cluster
-					Context NamedContext
-				}{
-					Cluster: existingCluster,
-					Context: NewNamedContext(existingContextName, existingContext),
-				}
-			}
-			if AuthInfosEqual(existingAuth, incomingAuth) {
-				matchingAuth = &struct {
-					AuthInfo *api.AuthInfo
-					Context  NamedContext
-				}{
-					AuthInfo: existingAuth,
-					Context:  NewNamedContext(existingContextName, existingContext),
-				}
+		matchingClusters := existingIndex.matchCluster(incomingCluster)
+		matchingAuths := existingIndex.matchAuthInfo(incomingAuth)
+		switch {
+		case len(matchingClusters) > 0 && len(matchingAuths) > 0:
+			// Renamed, if a context matches both the cluster and the auth info
+			if matches := existingIndex.matchContext(incomingCluster, incomingAuth); len(matches) > 0 {
+				renamed, candidates := pickMatch(matches, contextName)
+				diff.Items = append(diff.Items, withCandidates(DiffItem{
+					AffectedExisting: renamed.named(),
+					AffectedIncoming: namedContext,
+					ChangeType:       ChangeTypeRename,
+					Complex:          ComplexDiffTypeNone,
+				}, candidates))
+				continue
 			}
-			if matchingCluster != nil && matchingAuth != nil {
-				if matchingCluster.Context != matchingAuth.Context {
-					continue
-				}
-				break
+			// Otherwise some contexts match the cluster and others the auth
+			// info, and whichever one is picked is modified
+			modified, candidates := pickMatch(mergeEntries(matchingClusters, matchingAuths), contextName)
+			changes := clusterChanges(modified.Cluster, incomingCluster)
+			if changes == ComplexDiffTypeNone {
+				changes = ComplexDiffUserAuthChanged
 			}
-		}
-		switch {
-		case matchingCluster != nil && matchingAuth != nil:
-			// Renamed
-			diff.Items = append(diff.Items, DiffItem{
-				AffectedExisting: matchingCluster.Context,
+			diff.Items = append(diff.Items, withCandidates(DiffItem{
+				AffectedExisting: modified.named(),
 				AffectedIncoming: namedContext,
-				ChangeType:       ChangeTypeRename,
-				Complex:          ComplexDiffTypeNone,
-			})
+				ChangeType:       ChangeTypeModify | ChangeTypeComplex,
+				Complex:          changes,
+			}, candidates))
 			continue
-		case matchingCluster != nil:
+		case len(matchingClusters) > 0:
 			// User auth changed
-			diff.Items = append(diff.Items, DiffItem{
-				AffectedExisting: matchingCluster.Context,
+			modified, candidates := pickMatch(matchingClusters, contextName)
+			diff.Items = append(diff.Items, withCandidates(DiffItem{
+				AffectedExisting: modified.named(),
 				AffectedIncoming: namedContext,
 				ChangeType:       ChangeTypeModify | ChangeTypeComplex,
 				Complex:          ComplexDiffUserAuthChanged,
-			})
+			}, candidates))
 			continue
-		case matchingAuth != nil:
+		case len(matchingAuths) > 0:
 			// Cluster and/or server URL changed
-			complexType := ComplexDiffTypeNone
-			if incomingCluster.Server != existing.Clusters[matchingAuth.Context.Cluster].Server {
-				complexType |= ComplexDiffServerChanged
-			}
-			if !bytes.Equal(incomingCluster.CertificateAuthorityData,
-				existing.Clusters[matchingAuth.Context.Cluster].CertificateAuthorityData) {
-				complexType |= ComplexDiffClusterCAChanged
-			}
-			diff.Items = append(diff.Items, DiffItem{
-				AffectedExisting: matchingAuth.Context,
+			modified, candidates := pickMatch(matchingAuths, contextName)
+			diff.Items = append(diff.Items, withCandidates(DiffItem{
+				AffectedExisting: modified.named(),
 				AffectedIncoming: namedContext,
 				ChangeType:       ChangeTypeModify | ChangeTypeComplex,
-				Complex:          complexType,
-			})
+				Complex:          clusterChanges(modified.Cluster, incomingCluster),
+			}, candidates))
+			continue
+		}
+
+		// Nothing matched, before assuming it is new, check if the incoming
+		// context has a matching server CA. If so, both the user auth and
+		// cluster URL are new, but the cluster is not a replacement.
+		if matches := existingIndex.matchCA(incomingCluster); len(matches) > 0 {
+			// Cluster CA is the same, this is a modification
+			modified, candidates := pickMatch(matches, contextName)
+			diff.Items = append(diff.Items, withCandidates(DiffItem{
+				AffectedExisting: modified.named(),
+				AffectedIncoming: namedContext,
+				ChangeType:       ChangeTypeModify | ChangeTypeComplex,
+				Complex:          ComplexDiffUserAuthChanged | ComplexDiffServerChanged,
+			}, candidates))
 			continue
-		default:
-			// Nothing matched, before assuming it is new, check if the incoming
-			// context has a matching server CA. If so, both the user auth and
-			// cluster URL are new, but the cluster is not a replacement.
-			for existingContextName, existingContext := range existing.Contexts {
-				existingCluster, ok := existing.Clusters[existingContext.Cluster]
-				if !ok {
-					log.Fatalf("Local config is ill-formed: context %s references nonexistent cluster %s", existingContextName, existingContext.Cluster)
-				}
-				if bytes.Equal(incomingCluster.CertificateAuthorityData,
-					existingCluster.CertificateAuthorityData) {
-					// Cluster CA is the same, this is a modification
-					diff.Items = append(diff.Items, DiffItem{
-						AffectedExisting: NewNamedContext(existingContextName, existingContext),
-						AffectedIncoming: namedContext,
-						ChangeType:       ChangeTypeModify | ChangeTypeComplex,
-						Complex:          ComplexDiffUserAuthChanged | ComplexDiffServerChanged,
-					})
-					continue CONTEXT
-				}
-			}
 		}
 
 		// Check if there is a local server URL match
-		for existingContextName, existingContext := range existing.Contexts {
-			existingCluster, ok := existing.Clusters[existingContext.Cluster]
-			if !ok {
-				log.Fatalf("Local config is ill-formed: context %s references nonexistent cluster %s", existingContextName, existingContext.Cluster)
-			}
-			if existingCluster.Server == incomingCluster.Server {
-				// Replacement
-				diff.Items = append(diff.Items, DiffItem{
-					AffectedExisting: NewNamedContext(existingContextName, existingContext),
-					AffectedIncoming: namedContext,
-					ChangeType:       ChangeTypeReplace,
-					Complex:          ComplexDiffTypeNone,
-				})
-				continue CONTEXT
-			}
+		if matches := existingIndex.matchServer(incomingCluster); len(matches) > 0 {
+			// Replacement
+			replaced, candidates := pickMatch(matches, contextName)
+			diff.Items = append(diff.Items, withCandidates(DiffItem{
+				AffectedExisting: replaced.named(),
+				AffectedIncoming: namedContext,
+				ChangeType:       ChangeTypeReplace,
+				Complex:          ComplexDiffTypeNone,
+			}, candidates))
+			continue
 		}
 
 		var renameRequired ComplexDiffType = ComplexDiffTypeNone
@@ -242,50 +224,127 @@ CONTEXT:
 	//    match in the incoming contexts (if so, it would have been skipped
 	//		in the first pass). If so, skip it.
 	// 3. If there is no exact match, mark it as deleted.
-	for existingContextName, existingContext := range existing.Contexts {
-		var found bool
-		for _, diffItem := range diff.Items {
-			if diffItem.AffectedExisting.Name == existingContextName {
-				found = true
-				break
-			}
+	// Candidates of ambiguous items are never deleted, since the resolver may
+	// choose any of them. Those that are not chosen are deleted by a later
+	// diff, once the match is no longer ambiguous.
+	affected := make(map[string]bool, len(diff.Items))
+	for _, diffItem := range diff.Items {
+		affected[diffItem.AffectedExisting.Name] = true
+		for _, candidate := range diffItem.Candidates {
+			affected[candidate.Name] = true
 		}
-		if found {
+	}
+	for _, entry := range existingIndex.entries {
+		if affected[entry.Name] {
 			continue
 		}
-		for incomingContextName, incomingContext := range incoming.Contexts {
-			existingCluster, ok := existing.Clusters[existingContext.Cluster]
-			if !ok {
-				log.Fatalf("Local config is ill-formed: context %s references nonexistent cluster %s", existingContextName, existingContext.Cluster)
-			}
-			existingAuth, ok := existing.AuthInfos[existingContext.AuthInfo]
-			if !ok {
-				log.Fatalf("Local config is ill-formed: context %s references nonexistent auth info %s", existingContextName, existingContext.AuthInfo)
-			}
-			incomingCluster, ok := incoming.Clusters[incomingContext.Cluster]
-			if !ok {
-				log.Fatalf("Incoming config is ill-formed: context %s references nonexistent cluster %s", incomingContextName, incomingContext.Cluster)
-			}
-			incomingAuth, ok := incoming.AuthInfos[incomingContext.AuthInfo]
-			if !ok {
-				log.Fatalf("Incoming config is ill-formed: context %s references nonexistent auth info %s", incomingContextName, incomingContext.AuthInfo)
-			}
-			if ClustersEqual(existingCluster, incomingCluster) &&
-				AuthInfosEqual(existingAuth, incomingAuth) {
-				found = true
-				break
-			}
-		}
-		if found {
+		if len(incomingIndex.matchContext(entry.Cluster, entry.AuthInfo)) > 0 {
 			continue
 		}
-
 		diff.Items = append(diff.Items, DiffItem{
-			AffectedExisting: NewNamedContext(existingContextName, existingContext),
+			AffectedExisting: entry.named(),
 			AffectedIncoming: NamedContext{},
 			ChangeType:       ChangeTypeDelete,
 			Complex:          ComplexDiffTypeNone,
 		})
 	}
+	diff.Sort()
 	return diff, nil
 }
+
+// isExactMatch returns true if the existing config has a context with the
+// same name, cluster and auth info as the incoming one.
+func isExactMatch(existing *api.Config, incoming *contextEntry) bool {
+	existingContext, ok := existing.Contexts[incoming.Name]
+	if !ok || existingContext.Cluster != incoming.Context.Cluster ||
+		existingContext.AuthInfo != incoming.Context.AuthInfo {
+		return false
+	}
+	existingCluster, ok := existing.Clusters[existingContext.Cluster]
+	if !ok || !ClustersEqual(existingCluster, incoming.Cluster) {
+		return false
+	}
+	existingAuth, ok := existing.AuthInfos[existingContext.AuthInfo]
+	return ok && AuthInfosEqual(existingAuth, incoming.AuthInfo)
+}
+
+// pickMatch returns the existing context an incoming context most likely
+// corresponds to. If several match and none of them has the incoming
+// context's name, the first by name is returned along with all of them as
+// candidates.
+func pickMatch(matches []*contextEntry, name string) (*contextEntry, []NamedContext) {
+	if len(matches) == 1 {
+		return matches[0], nil
+	}
+	for _, match := range matches {
+		if match.Name == name {
+			return match, nil
+		}
+	}
+	candidates := make([]NamedContext, len(matches))
+	for i, match := range matches {
+		candidates[i] = match.named()
+	}
+	return matches[0], candidates
+}
+
+// withCandidates marks the item as ambiguous if there are candidates.
+func withCandidates(item DiffItem, candidates []NamedContext) DiffItem {
+	if len(candidates) > 0 {
+		item.ChangeType |= ChangeTypeAmbiguous
+		item.Complex |= ComplexDiffAmbiguousMatch
+		item.Candidates = candidates
+	}
+	return item
+}
+
+// clusterChanges returns the changes needed to turn one cluster into the
+// other.
+func clusterChanges(existing, incoming *api.Cluster) ComplexDiffType {
+	changes := ComplexDiffTypeNone
+	if incoming.Server != existing.Server {
+		changes |= ComplexDiffServerChanged
+	}
+	if !bytes.Equal(incoming.CertificateAuthorityData, existing.CertificateAuthorityData) {
+		changes |= ComplexDiffClusterCAChanged
+	}
+	return changes
+}
+
+// Order in which Sort places each kind of change. Deletions come last, as
+// they did before items were sorted, so that new contexts are applied before
+// the ones they conflict with are deleted.
+var changeTypeOrder = []ChangeType{
+	ChangeTypeNew,
+	ChangeTypeRename,
+	ChangeTypeReplace,
+	ChangeTypeModify,
+	ChangeTypeDelete,
+}
+
+func changeTypeRank(changeType ChangeType) int {
+	for i, t := range changeTypeOrder {
+		if changeType&t != 0 {
+			return i
+		}
+	}
+	return len(changeTypeOrder)
+}
+
+// Sort orders the items by change type, then by the name of the affected
+// context (the incoming name, or the existing name for deletions).
+func (d *Diff) Sort() {
+	sort.SliceStable(d.Items, func(i, j int) bool {
+		a, b := d.Items[i], d.Items[j]
+		if ra, rb := changeTypeRank(a.ChangeType), changeTypeRank(b.ChangeType); ra != rb {
+			return ra < rb
+		}
+		if a.ChangeType != b.ChangeType {
+			return a.ChangeType < b.ChangeType
+		}
+		if a.AffectedIncoming.Name != b.AffectedIncoming.Name {
+			return a.AffectedIncoming.Name < b.AffectedIncoming.Name
+		}
+		return a.AffectedExisting.Name < b.AffectedExisting.Name
+	})
+}
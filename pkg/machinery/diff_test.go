@@ -1,9 +1,14 @@
 package machinery_test
 
 import (
+	"fmt"
+	"testing"
+
 	"github.com/kralicky/kit/pkg/machinery"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/clientcmd/api"
 )
 
 var _ = Describe("Diff", func() {
@@ -196,6 +201,34 @@ var _ = Describe("Diff", func() {
 			},
 		}))
 	})
+	It("should reject contexts that reference a missing cluster or user", func() {
+		incoming := sampleClusters(1, 2)
+		delete(incoming.Clusters, "cluster2")
+		_, err := machinery.ComputeDiff(sampleClusters(1), incoming)
+		Expect(err).To(MatchError(machinery.ErrIllFormedConfig))
+		Expect(err.Error()).To(ContainSubstring("remote config is ill-formed: context context2 references nonexistent cluster cluster2"))
+
+		existing := sampleClusters(1, 2)
+		delete(existing.AuthInfos, "authInfo2")
+		_, err = machinery.ComputeDiff(existing, sampleClusters(1))
+		Expect(err).To(MatchError(machinery.ErrIllFormedConfig))
+		Expect(err.Error()).To(ContainSubstring("local config is ill-formed: context context2 references nonexistent auth info authInfo2"))
+	})
+	// Contexts that are unchanged are never matched against other incoming
+	// contexts. Otherwise a second incoming context on the same cluster
+	// would be reported as a modification of the unchanged one.
+	It("should not modify unchanged contexts for other incoming contexts", func() {
+		existing := sampleClusters(1)
+		incoming := sampleClusters(1)
+		incoming.AuthInfos["other"] = &api.AuthInfo{Token: "other-token"}
+		incoming.Contexts["other"] = &api.Context{Cluster: "cluster1", AuthInfo: "other"}
+		diff, err := machinery.ComputeDiff(existing, incoming)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(diff.Items).To(HaveLen(1))
+		Expect(diff.Items[0].ChangeType).To(Equal(machinery.ChangeTypeNew | machinery.ChangeType(machinery.ComplexDiffRenameRequired)))
+		Expect(diff.Items[0].AffectedIncoming.Name).To(Equal("other"))
+		Expect(diff.Items[0].AffectedExisting.Name).To(BeEmpty())
+	})
 	It("should handle a deleted context", func() {
 		existing, incoming := sampleClusters(1, 2), sampleClusters(1)
 		diff, err := machinery.ComputeDiff(existing, incoming)
@@ -212,3 +245,245 @@ var _ = Describe("Diff", func() {
 		}))
 	})
 })
+
+var _ = Describe("Diff ordering", func() {
+	It("should sort items by change type, then by name", func() {
+		existing, incoming := sampleClusters(1, 2, 3, 4, 5), sampleClusters(1, 6, 7, 8)
+		incoming.Contexts["renamed"] = incoming.Contexts["context1"]
+		delete(incoming.Contexts, "context1")
+		for i := 0; i < 20; i++ {
+			diff, err := machinery.ComputeDiff(existing, incoming)
+			Expect(err).NotTo(HaveOccurred())
+			var names []string
+			for _, item := range diff.Items {
+				names = append(names, item.AffectedIncoming.Name+"/"+item.AffectedExisting.Name)
+			}
+			Expect(names).To(Equal([]string{
+				"context6/", "context7/", "context8/",
+				"renamed/context1",
+				"/context2", "/context3", "/context4", "/context5",
+			}))
+		}
+	})
+	It("should resolve ambiguous matches by name", func() {
+		existing := sampleClusters(1)
+		for _, name := range []string{"b", "c", "a"} {
+			existing.Contexts[name] = existing.Contexts["context1"].DeepCopy()
+		}
+		delete(existing.Contexts, "context1")
+		incoming := sampleClusters(1)
+		incoming.Contexts["renamed"] = incoming.Contexts["context1"]
+		delete(incoming.Contexts, "context1")
+		for i := 0; i < 20; i++ {
+			diff, err := machinery.ComputeDiff(existing, incoming)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(diff.Items).To(HaveLen(1))
+			Expect(diff.Items[0].ChangeType).To(Equal(machinery.ChangeTypeRename | machinery.ChangeTypeAmbiguous))
+			Expect(diff.Items[0].AffectedExisting.Name).To(Equal("a"))
+		}
+	})
+})
+
+// chooseResolver chooses the named candidate for ambiguous items.
+type chooseResolver struct {
+	name string
+}
+
+func (r chooseResolver) Rename(kind, oldName string, validator func(string) error) string {
+	return machinery.AutoResolver.Rename(kind, oldName, validator)
+}
+
+func (r chooseResolver) Choose(item machinery.DiffItem) machinery.NamedContext {
+	return machinery.NamedContext{Name: r.name}
+}
+
+var _ = Describe("Ambiguous matches", func() {
+	// Two contexts on the same cluster with different users, and an incoming
+	// context on that cluster with a new user
+	var existing, incoming *api.Config
+	BeforeEach(func() {
+		existing = sampleClusters(1, 2)
+		existing.Contexts["context2"].Cluster = "cluster1"
+		delete(existing.Clusters, "cluster2")
+		incoming = sampleClusters(1)
+		incoming.Contexts["other"] = incoming.Contexts["context1"]
+		delete(incoming.Contexts, "context1")
+		incoming.AuthInfos["authInfo1"].Token = "new-token"
+	})
+	candidateNames := func(item machinery.DiffItem) []string {
+		var names []string
+		for _, candidate := range item.Candidates {
+			names = append(names, candidate.Name)
+		}
+		return names
+	}
+
+	It("should report every candidate", func() {
+		diff, err := machinery.ComputeDiff(existing, incoming)
+		Expect(err).NotTo(HaveOccurred())
+		// Candidates are not deleted, since any of them may be chosen
+		Expect(diff.Items).To(HaveLen(1))
+		item := diff.Items[0]
+		Expect(item.ChangeType).To(Equal(machinery.ChangeTypeModify | machinery.ChangeTypeComplex | machinery.ChangeTypeAmbiguous))
+		Expect(item.Complex).To(Equal(machinery.ComplexDiffUserAuthChanged | machinery.ComplexDiffAmbiguousMatch))
+		Expect(item.AffectedExisting.Name).To(Equal("context1"))
+		Expect(candidateNames(item)).To(Equal([]string{"context1", "context2"}))
+		Expect(machinery.FormatDiffItem(item, existing, incoming)).To(
+			HaveSuffix("(ambiguous, could be any of context1, context2)"))
+	})
+	It("should prefer a candidate with the same name", func() {
+		incoming.Contexts["context2"] = incoming.Contexts["other"]
+		delete(incoming.Contexts, "other")
+		diff, err := machinery.ComputeDiff(existing, incoming)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(diff.Items).To(HaveLen(2))
+		Expect(diff.Items[0].ChangeType & machinery.ChangeTypeAmbiguous).To(BeZero())
+		Expect(diff.Items[0].AffectedExisting.Name).To(Equal("context2"))
+		Expect(diff.Items[0].Candidates).To(BeEmpty())
+	})
+	It("should not consider unchanged contexts as candidates", func() {
+		incoming.Clusters["cluster2"] = existing.Clusters["cluster1"].DeepCopy()
+		incoming.AuthInfos["authInfo2"] = existing.AuthInfos["authInfo2"].DeepCopy()
+		incoming.Contexts["context2"] = existing.Contexts["context2"].DeepCopy()
+		incoming.Contexts["context2"].Cluster = "cluster1"
+		diff, err := machinery.ComputeDiff(existing, incoming)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(diff.Items).To(HaveLen(1))
+		Expect(diff.Items[0].ChangeType & machinery.ChangeTypeAmbiguous).To(BeZero())
+		Expect(diff.Items[0].AffectedExisting.Name).To(Equal("context1"))
+	})
+	It("should report a modification when no context matches both the cluster and the user", func() {
+		existing := sampleClusters(1, 2)
+		incoming := sampleClusters(1, 2)
+		incoming.Contexts = map[string]*api.Context{
+			"merged": {Cluster: "cluster1", AuthInfo: "authInfo2"},
+		}
+		diff, err := machinery.ComputeDiff(existing, incoming)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(diff.Items).To(HaveLen(1))
+		item := diff.Items[0]
+		Expect(item.ChangeType).To(Equal(machinery.ChangeTypeModify | machinery.ChangeTypeComplex | machinery.ChangeTypeAmbiguous))
+		Expect(item.Complex).To(Equal(machinery.ComplexDiffUserAuthChanged | machinery.ComplexDiffAmbiguousMatch))
+		Expect(item.AffectedExisting.Name).To(Equal("context1"))
+		Expect(candidateNames(item)).To(Equal([]string{"context1", "context2"}))
+
+		// Choosing the context with the matching user moves it to the cluster
+		Expect(diff.Apply(existing, incoming, chooseResolver{name: "context2"})).To(Succeed())
+		Expect(existing.Contexts).To(HaveKey("context2"))
+		Expect(existing.Clusters["cluster2"].Server).To(Equal(incoming.Clusters["cluster1"].Server))
+	})
+	It("should apply the change to the chosen candidate", func() {
+		diff, err := machinery.ComputeDiff(existing, incoming)
+		Expect(err).NotTo(HaveOccurred())
+		original := existing.DeepCopy()
+		Expect(diff.Apply(existing, incoming, chooseResolver{name: "context2"})).To(Succeed())
+		Expect(existing.Contexts).To(HaveKey("context1"))
+		Expect(existing.Contexts).To(HaveKey("context2"))
+		Expect(existing.AuthInfos["authInfo1"]).To(Equal(original.AuthInfos["authInfo1"]))
+		Expect(existing.AuthInfos["authInfo2"].Token).To(Equal("new-token"))
+
+		// The candidate that was not chosen is deleted once the match is no
+		// longer ambiguous
+		diff, err = machinery.ComputeDiff(existing, incoming)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(diff.Apply(existing, incoming, machinery.AutoResolver)).To(Succeed())
+		Expect(existing.Contexts).To(HaveLen(1))
+		Expect(existing.Contexts).To(HaveKey("other"))
+		Expect(existing.AuthInfos[existing.Contexts["other"].AuthInfo].Token).To(Equal("new-token"))
+	})
+	It("should reject choices that are not candidates", func() {
+		diff, err := machinery.ComputeDiff(existing, incoming)
+		Expect(err).NotTo(HaveOccurred())
+		err = diff.Apply(existing, incoming, chooseResolver{name: "context3"})
+		Expect(err).To(MatchError(machinery.ErrInvalidCandidate))
+	})
+})
+
+var _ = Describe("Large diffs", func() {
+	It("should find every kind of change among many contexts", func() {
+		existing, incoming := largeConfigs(2000)
+		diff, err := machinery.ComputeDiff(existing, incoming)
+		Expect(err).NotTo(HaveOccurred())
+		counts := map[machinery.ChangeType]int{}
+		for _, item := range diff.Items {
+			counts[item.ChangeType]++
+		}
+		Expect(counts).To(Equal(map[machinery.ChangeType]int{
+			machinery.ChangeTypeRename:                               10,
+			machinery.ChangeTypeModify | machinery.ChangeTypeComplex: 10,
+			machinery.ChangeTypeNew:                                  10,
+			machinery.ChangeTypeDelete:                               10,
+		}))
+	})
+})
+
+// largeConfigs returns n existing contexts, and incoming contexts in which
+// 10 are renamed, 10 have a new token, 10 are deleted and 10 are new.
+func largeConfigs(n int) (existing, incoming *api.Config) {
+	ids := make([]int, n)
+	for i := range ids {
+		ids[i] = i + 1
+	}
+	existing, incoming = sampleClusters(ids...), sampleClusters(ids[10:]...)
+	for i := 1; i <= 10; i++ {
+		name := fmt.Sprintf("context%d", n-i)
+		incoming.Contexts["renamed-"+name] = incoming.Contexts[name]
+		delete(incoming.Contexts, name)
+		incoming.AuthInfos[fmt.Sprintf("authInfo%d", n-i-10)].Token = "changed"
+	}
+	added := sampleClusters(n+1, n+2, n+3, n+4, n+5, n+6, n+7, n+8, n+9, n+10)
+	for name, context := range added.Contexts {
+		incoming.Contexts[name] = context
+		incoming.Clusters[context.Cluster] = added.Clusters[context.Cluster]
+		incoming.AuthInfos[context.AuthInfo] = added.AuthInfos[context.AuthInfo]
+	}
+	return existing, incoming
+}
+
+func benchmarkComputeDiff(b *testing.B, existing, incoming *api.Config) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := machinery.ComputeDiff(existing, incoming); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkComputeDiff(b *testing.B) {
+	for _, n := range []int{100, 1000, 2500} {
+		b.Run(fmt.Sprintf("unchanged/%d", n), func(b *testing.B) {
+			existing, _ := largeConfigs(n)
+			benchmarkComputeDiff(b, existing, existing.DeepCopy())
+		})
+		b.Run(fmt.Sprintf("changed/%d", n), func(b *testing.B) {
+			existing, incoming := largeConfigs(n)
+			benchmarkComputeDiff(b, existing, incoming)
+		})
+		b.Run(fmt.Sprintf("disjoint/%d", n), func(b *testing.B) {
+			existing, _ := largeConfigs(n)
+			incoming, _ := largeConfigs(n)
+			for _, cluster := range incoming.Clusters {
+				cluster.Server += "-other"
+				cluster.CertificateAuthorityData = append(cluster.CertificateAuthorityData, '!')
+			}
+			for _, authInfo := range incoming.AuthInfos {
+				authInfo.Token = "other"
+			}
+			benchmarkComputeDiff(b, existing, incoming)
+		})
+	}
+}
+
+var _ = Describe("AuthInfosEqual", func() {
+	It("should ignore the file an auth info was read from", func() {
+		a := sampleClusters(1).AuthInfos["authInfo1"]
+		b := a.DeepCopy()
+		b.LocationOfOrigin = "/home/user/.kube/config"
+		Expect(machinery.AuthInfosEqual(a, b)).To(BeTrue())
+		Expect(b.LocationOfOrigin).To(Equal("/home/user/.kube/config"))
+		b.Extensions = map[string]runtime.Object{}
+		Expect(machinery.AuthInfosEqual(a, b)).To(BeTrue())
+		b.Token = "changed"
+		Expect(machinery.AuthInfosEqual(a, b)).To(BeFalse())
+	})
+})
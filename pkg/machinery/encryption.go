@@ -0,0 +1,251 @@
+package machinery
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/hashicorp/vault/sdk/helper/password"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+const PassphraseEnv = "KIT_PASSPHRASE"
+
+// Encrypted cache layout:
+//
+//	magic | mode (1 byte) | salt (16 bytes) | nonce (24 bytes) | secretbox
+//
+// The salt is only used when the key is derived from a passphrase.
+var cacheMagic = []byte("KITENC1\n")
+
+const (
+	cacheModeKeyFile    byte = 'k'
+	cacheModePassphrase byte = 'p'
+
+	cacheSaltSize  = 16
+	cacheNonceSize = 24
+	cacheKeySize   = 32
+)
+
+type CacheEncryptionConfig struct {
+	// Derive the key from a passphrase instead of using a key file. The
+	// passphrase is read from KIT_PASSPHRASE, or prompted for if unset.
+	Passphrase bool `json:"passphrase,omitempty"`
+	// Location of the key file (default remote.key in the kit home
+	// directory). The key is generated the first time the cache is written.
+	KeyFile string `json:"keyFile,omitempty"`
+}
+
+func IsEncryptedCache(data []byte) bool {
+	return bytes.HasPrefix(data, cacheMagic)
+}
+
+func EncryptCacheData(plaintext []byte, conf *CacheEncryptionConfig) ([]byte, error) {
+	if conf == nil {
+		conf = &CacheEncryptionConfig{}
+	}
+	var salt [cacheSaltSize]byte
+	var key *[cacheKeySize]byte
+	var mode byte
+	var err error
+	if conf.Passphrase {
+		mode = cacheModePassphrase
+		if _, err := io.ReadFull(rand.Reader, salt[:]); err != nil {
+			return nil, err
+		}
+		key, err = passphraseKey(salt[:])
+	} else {
+		mode = cacheModeKeyFile
+		key, err = readOrCreateKeyFile(conf.keyFile())
+	}
+	if err != nil {
+		return nil, err
+	}
+	var nonce [cacheNonceSize]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+	out := append([]byte{}, cacheMagic...)
+	out = append(out, mode)
+	out = append(out, salt[:]...)
+	out = append(out, nonce[:]...)
+	return secretbox.Seal(out, plaintext, &nonce, key), nil
+}
+
+func DecryptCacheData(data []byte, conf *CacheEncryptionConfig) ([]byte, error) {
+	if conf == nil {
+		conf = &CacheEncryptionConfig{}
+	}
+	if !IsEncryptedCache(data) {
+		return nil, ErrCacheNotEncrypted
+	}
+	data = data[len(cacheMagic):]
+	if len(data) < 1+cacheSaltSize+cacheNonceSize+secretbox.Overhead {
+		return nil, ErrCacheDecryptionFailed
+	}
+	mode := data[0]
+	salt := data[1 : 1+cacheSaltSize]
+	var nonce [cacheNonceSize]byte
+	copy(nonce[:], data[1+cacheSaltSize:])
+	box := data[1+cacheSaltSize+cacheNonceSize:]
+
+	var key *[cacheKeySize]byte
+	var err error
+	switch mode {
+	case cacheModePassphrase:
+		key, err = passphraseKey(salt)
+	case cacheModeKeyFile:
+		key, err = readKeyFile(conf.keyFile())
+	default:
+		return nil, fmt.Errorf("%w: unknown key mode %q", ErrCacheDecryptionFailed, mode)
+	}
+	if err != nil {
+		return nil, err
+	}
+	plaintext, ok := secretbox.Open(nil, box, &nonce, key)
+	if !ok {
+		return nil, ErrCacheDecryptionFailed
+	}
+	return plaintext, nil
+}
+
+func (c *CacheEncryptionConfig) keyFile() string {
+	if c.KeyFile != "" {
+		return c.KeyFile
+	}
+	return DefaultCacheKeyPath(DotKitPath())
+}
+
+func DefaultCacheKeyPath(home string) string {
+	return filepath.Join(home, "remote.key")
+}
+
+// cacheEncryption returns the cache encryption settings, with the key file
+// located in the kit home directory by default.
+func (c *KitConfig) cacheEncryption() *CacheEncryptionConfig {
+	conf := CacheEncryptionConfig{}
+	if c.CacheEncryption != nil {
+		conf = *c.CacheEncryption
+	}
+	if conf.KeyFile == "" {
+		conf.KeyFile = DefaultCacheKeyPath(c.Home())
+	}
+	return &conf
+}
+
+// UnlockCache prompts for the cache passphrase, if the cache is encrypted
+// with one and KIT_PASSPHRASE is unset. Long-running commands call it before
+// they start, so that reading or writing the cache later never prompts.
+func (c *KitConfig) UnlockCache() error {
+	if !c.cacheEncryption().Passphrase {
+		return nil
+	}
+	_, err := readPassphrase()
+	return err
+}
+
+// The passphrase entered at the prompt, kept so it is only asked for once
+var (
+	passphraseMu       sync.Mutex
+	promptedPassphrase *string
+)
+
+func readPassphrase() (string, error) {
+	if p, ok := os.LookupEnv(PassphraseEnv); ok {
+		return p, nil
+	}
+	passphraseMu.Lock()
+	defer passphraseMu.Unlock()
+	if promptedPassphrase != nil {
+		return *promptedPassphrase, nil
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return "", ErrPassphraseRequired
+	}
+	fmt.Fprint(os.Stderr, "Remote cache passphrase (will be hidden): ")
+	p, err := password.Read(os.Stdin)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	promptedPassphrase = &p
+	return p, nil
+}
+
+func passphraseKey(salt []byte) (*[cacheKeySize]byte, error) {
+	passphrase, err := readPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	if passphrase == "" {
+		return nil, ErrEmptyPassphrase
+	}
+	derived, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, cacheKeySize)
+	if err != nil {
+		return nil, err
+	}
+	var key [cacheKeySize]byte
+	copy(key[:], derived)
+	return &key, nil
+}
+
+func readKeyFile(path string) (*[cacheKeySize]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: %s", ErrCacheKeyNotFound, path)
+		}
+		return nil, err
+	}
+	if len(data) != cacheKeySize {
+		return nil, fmt.Errorf("%w: %s has the wrong size", ErrCacheDecryptionFailed, path)
+	}
+	var key [cacheKeySize]byte
+	copy(key[:], data)
+	return &key, nil
+}
+
+func readOrCreateKeyFile(path string) (*[cacheKeySize]byte, error) {
+	if key, err := readKeyFile(path); !errors.Is(err, ErrCacheKeyNotFound) {
+		return key, err
+	}
+	key := new([cacheKeySize]byte)
+	if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	// Write the key to a temporary file and link it into place, which fails
+	// if the key file exists. Another kit process creating the key at the
+	// same time either wins or loses, and the loser reads the winner's key.
+	f, err := os.CreateTemp(filepath.Dir(path), ".remote.key-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(key[:]); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(f.Name(), 0400); err != nil {
+		return nil, err
+	}
+	if err := os.Link(f.Name(), path); err != nil {
+		if os.IsExist(err) {
+			return readKeyFile(path)
+		}
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,128 @@
+package machinery_test
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/kralicky/kit/pkg/machinery"
+)
+
+var _ = Describe("Cache Encryption", func() {
+	var dir string
+	preserveEnv(machinery.PassphraseEnv)
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "kit-encryption")
+		Expect(err).NotTo(HaveOccurred())
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+	plaintext := []byte("latest:\n  users:\n    user1:\n      token: secret-token\n")
+
+	It("should encrypt and decrypt using a generated key file", func() {
+		conf := &machinery.CacheEncryptionConfig{
+			KeyFile: filepath.Join(dir, "remote.key"),
+		}
+		encrypted, err := machinery.EncryptCacheData(plaintext, conf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(machinery.IsEncryptedCache(encrypted)).To(BeTrue())
+		Expect(string(encrypted)).NotTo(ContainSubstring("secret-token"))
+
+		info, err := os.Stat(conf.KeyFile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0400)))
+
+		decrypted, err := machinery.DecryptCacheData(encrypted, conf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(decrypted).To(Equal(plaintext))
+	})
+	It("should fail to decrypt with a different key file", func() {
+		encrypted, err := machinery.EncryptCacheData(plaintext, &machinery.CacheEncryptionConfig{
+			KeyFile: filepath.Join(dir, "remote.key"),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = machinery.EncryptCacheData(plaintext, &machinery.CacheEncryptionConfig{
+			KeyFile: filepath.Join(dir, "other.key"),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = machinery.DecryptCacheData(encrypted, &machinery.CacheEncryptionConfig{
+			KeyFile: filepath.Join(dir, "other.key"),
+		})
+		Expect(err).To(MatchError(machinery.ErrCacheDecryptionFailed))
+		_, err = machinery.DecryptCacheData(encrypted, &machinery.CacheEncryptionConfig{
+			KeyFile: filepath.Join(dir, "missing.key"),
+		})
+		Expect(err).To(MatchError(machinery.ErrCacheKeyNotFound))
+	})
+	It("should encrypt and decrypt using a passphrase", func() {
+		conf := &machinery.CacheEncryptionConfig{
+			Passphrase: true,
+		}
+		os.Setenv(machinery.PassphraseEnv, "correct horse battery staple")
+		encrypted, err := machinery.EncryptCacheData(plaintext, conf)
+		Expect(err).NotTo(HaveOccurred())
+		decrypted, err := machinery.DecryptCacheData(encrypted, conf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(decrypted).To(Equal(plaintext))
+
+		os.Setenv(machinery.PassphraseEnv, "wrong")
+		_, err = machinery.DecryptCacheData(encrypted, conf)
+		Expect(err).To(MatchError(machinery.ErrCacheDecryptionFailed))
+	})
+	It("should create a single key file when written concurrently", func() {
+		conf := &machinery.CacheEncryptionConfig{
+			KeyFile: filepath.Join(dir, "remote.key"),
+		}
+		var wg sync.WaitGroup
+		encrypted := make([][]byte, 8)
+		errs := make([]error, len(encrypted))
+		for i := range encrypted {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				encrypted[i], errs[i] = machinery.EncryptCacheData(plaintext, conf)
+			}(i)
+		}
+		wg.Wait()
+		for i := range encrypted {
+			Expect(errs[i]).NotTo(HaveOccurred())
+			decrypted, err := machinery.DecryptCacheData(encrypted[i], conf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(decrypted).To(Equal(plaintext))
+		}
+		entries, err := os.ReadDir(dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+	})
+	It("should not prompt for a passphrase without a terminal", func() {
+		stdin := os.Stdin
+		defer func() { os.Stdin = stdin }()
+		r, w, err := os.Pipe()
+		Expect(err).NotTo(HaveOccurred())
+		defer r.Close()
+		defer w.Close()
+		os.Stdin = r
+
+		os.Unsetenv(machinery.PassphraseEnv)
+		config := &machinery.KitConfig{
+			CacheEncryption: &machinery.CacheEncryptionConfig{Passphrase: true},
+		}
+		Expect(config.UnlockCache()).To(MatchError(machinery.ErrPassphraseRequired))
+		_, err = machinery.EncryptCacheData(plaintext, config.CacheEncryption)
+		Expect(err).To(MatchError(machinery.ErrPassphraseRequired))
+
+		os.Setenv(machinery.PassphraseEnv, "correct horse battery staple")
+		Expect(config.UnlockCache()).To(Succeed())
+		Expect((&machinery.KitConfig{}).UnlockCache()).To(Succeed())
+	})
+	It("should detect plaintext caches", func() {
+		Expect(machinery.IsEncryptedCache(plaintext)).To(BeFalse())
+		_, err := machinery.DecryptCacheData(plaintext, nil)
+		Expect(err).To(MatchError(machinery.ErrCacheNotEncrypted))
+	})
+})
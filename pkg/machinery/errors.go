@@ -4,20 +4,89 @@ import "errors"
 
 var ErrAlreadyInitialized = errors.New("already initialized")
 
-var ErrMultipleKubeconfigs = errors.New("KUBECONFIG environment variable contains more than one path")
-var ErrKubeconfigDoesNotExist = errors.New("KUBECONFIG environment variable is set to a nonexistent file")
+var ErrKubeconfigDoesNotExist = errors.New("kubeconfig does not exist")
+var ErrKubeconfigLocked = errors.New("kubeconfig is locked by another process")
+var ErrIllFormedConfig = errors.New("config is ill-formed")
 
 func IsAlreadyInitialized(err error) bool {
 	return errors.Is(err, ErrAlreadyInitialized)
 }
 
+func IsKubeconfigLocked(err error) bool {
+	return errors.Is(err, ErrKubeconfigLocked)
+}
+
 var ErrVaultNotInitialized = errors.New("vault is not initialized")
 var ErrVaultSealed = errors.New("vault is sealed")
 var ErrVaultNoKVMount = errors.New("kv secret engine is not enabled in vault")
+var ErrVaultKVVersionMismatch = errors.New("kv secret engine version does not match the configured version")
+var ErrUnsupportedKVVersion = errors.New("unsupported kv secret engine version")
+var ErrUnsupportedAuthMethod = errors.New("unsupported auth method")
+var ErrInvalidAuthConfig = errors.New("invalid auth configuration")
+var ErrLoginNoToken = errors.New("login succeeded but vault did not return a token")
+var ErrRemoteAuthExpired = errors.New("vault token is expired or has been revoked")
+var ErrTransitNotConfigured = errors.New("remote data is encrypted with vault transit, but transit is not configured")
+var ErrTransitNoData = errors.New("vault transit returned no data")
 var ErrRemoteDataNotFound = errors.New("remote cache does not exist")
 
 func IsNotFound(err error) bool {
 	return errors.Is(err, ErrRemoteDataNotFound)
 }
 
+func IsAuthExpired(err error) bool {
+	return errors.Is(err, ErrRemoteAuthExpired)
+}
+
+var ErrCacheNotEncrypted = errors.New("remote cache is not encrypted")
+var ErrCacheDecryptionFailed = errors.New("failed to decrypt remote cache (wrong key or passphrase?)")
+var ErrCacheKeyNotFound = errors.New("remote cache key file not found")
+var ErrEmptyPassphrase = errors.New("passphrase must not be empty")
+var ErrPassphraseRequired = errors.New("the remote cache passphrase cannot be prompted for without a terminal (set KIT_PASSPHRASE)")
+
+var ErrNoIdentity = errors.New("no local identity exists (run 'kit identity' to create one)")
+var ErrNoRecipients = errors.New("at least one recipient is required")
+var ErrUnknownRecipient = errors.New("unknown recipient (expected a recipient name or public key)")
+var ErrNotARecipient = errors.New("context was not shared with the local identity")
+var ErrSealedDataInvalid = errors.New("failed to open sealed context")
+
+func IsNotARecipient(err error) bool {
+	return errors.Is(err, ErrNotARecipient)
+}
+
+var ErrUnsignedContext = errors.New("context is not signed")
+var ErrUntrustedSigner = errors.New("context is signed by an untrusted key")
+var ErrInvalidSignature = errors.New("context signature is invalid")
+var ErrInvalidSignaturePolicy = errors.New("invalid signature policy")
+
+func IsInvalidSignature(err error) bool {
+	return errors.Is(err, ErrInvalidSignature)
+}
+
+var ErrInvalidSyncFilter = errors.New("invalid sync filter")
+
+var ErrInvalidRemoteName = errors.New("invalid remote name")
+var ErrRemoteNotFound = errors.New("remote not found")
+var ErrRemoteAlreadyExists = errors.New("remote already exists")
+var ErrNoDefaultRemote = errors.New("no default remote is configured (use --remote or set defaultRemote)")
+
+var ErrInvalidSchema = errors.New("invalid file contents")
+var ErrUnsupportedAPIVersion = errors.New("unsupported apiVersion (was this file written by a newer version of kit?)")
+
+var ErrBackupNotFound = errors.New("backup not found")
+
+var ErrInvalidWatchPolicy = errors.New("invalid watch policy")
+
+var ErrDaemonNotRunning = errors.New("kit daemon is not running")
+var ErrDaemonAlreadyRunning = errors.New("kit daemon is already running")
+var ErrConflictNotFound = errors.New("conflict not found (it may have been resolved by a newer change)")
+
+func IsDaemonNotRunning(err error) bool {
+	return errors.Is(err, ErrDaemonNotRunning)
+}
+
 var ErrItemAlreadyExists = errors.New("an item with this name already exists")
+var ErrInvalidCandidate = errors.New("chosen context is not one of the candidates")
+
+var ErrInvalidPolicyName = errors.New("policy name must not be empty")
+var ErrInvalidPolicyAccess = errors.New("invalid policy access level")
+var ErrInvalidPolicyGlob = errors.New("invalid context glob (only a trailing '*' is supported)")
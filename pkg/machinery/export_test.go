@@ -0,0 +1,13 @@
+package machinery
+
+// SaveAuthMethods returns a function that restores the registered auth
+// methods, so that tests can register methods without affecting other tests.
+func SaveAuthMethods() func() {
+	saved := make(map[string]AuthMethod, len(authMethods))
+	for name, method := range authMethods {
+		saved[name] = method
+	}
+	return func() {
+		authMethods = saved
+	}
+}
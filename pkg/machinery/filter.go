@@ -0,0 +1,167 @@
+package machinery
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+const tagPrefix = "tag:"
+
+// SyncFilter selects which contexts are synced with the remote. Contexts that
+// do not match are local-only: they are never pushed, and pulls never modify
+// or delete them.
+type SyncFilter struct {
+	// Only sync contexts matching one of these patterns (default all)
+	Include []string `json:"include,omitempty"`
+	// Never sync contexts matching one of these patterns
+	Exclude []string `json:"exclude,omitempty"`
+	// Named groups of patterns, which can be referenced in Include and
+	// Exclude as "tag:<name>"
+	Tags map[string][]string `json:"tags,omitempty"`
+
+	// Compiled patterns, set by Validate
+	globs map[string]*regexp.Regexp
+}
+
+// Patterns are globs on context names, where '*' matches any sequence of
+// characters (including '/') and '?' matches a single character.
+func compileGlob(glob string) *regexp.Regexp {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.MustCompile(sb.String())
+}
+
+func (f *SyncFilter) Validate() error {
+	if f == nil {
+		return nil
+	}
+	for _, pattern := range append(append([]string{}, f.Include...), f.Exclude...) {
+		if pattern == "" {
+			return fmt.Errorf("%w: empty pattern", ErrInvalidSyncFilter)
+		}
+		if tag := strings.TrimPrefix(pattern, tagPrefix); tag != pattern {
+			if _, ok := f.Tags[tag]; !ok {
+				return fmt.Errorf("%w: unknown tag %q", ErrInvalidSyncFilter, tag)
+			}
+		}
+	}
+	for tag, patterns := range f.Tags {
+		for _, pattern := range patterns {
+			if pattern == "" || strings.HasPrefix(pattern, tagPrefix) {
+				return fmt.Errorf("%w: invalid pattern %q in tag %q", ErrInvalidSyncFilter, pattern, tag)
+			}
+		}
+	}
+	f.compile()
+	return nil
+}
+
+// compile compiles every pattern of the filter, so that Matches does not
+// have to compile them for each context.
+func (f *SyncFilter) compile() {
+	globs := map[string]*regexp.Regexp{}
+	add := func(patterns []string) {
+		for _, pattern := range patterns {
+			if !strings.HasPrefix(pattern, tagPrefix) {
+				globs[pattern] = compileGlob(pattern)
+			}
+		}
+	}
+	add(f.Include)
+	add(f.Exclude)
+	for _, patterns := range f.Tags {
+		add(patterns)
+	}
+	f.globs = globs
+}
+
+// Matches reports whether the named context should be synced. Patterns are
+// compiled by Validate, which must be called again if they are changed.
+func (f *SyncFilter) Matches(name string) bool {
+	if f == nil {
+		return true
+	}
+	if f.globs == nil {
+		f.compile()
+	}
+	if len(f.Include) > 0 && !f.matchesAny(f.Include, name) {
+		return false
+	}
+	return !f.matchesAny(f.Exclude, name)
+}
+
+func (f *SyncFilter) matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if tag := strings.TrimPrefix(pattern, tagPrefix); tag != pattern {
+			for _, tagged := range f.Tags[tag] {
+				if f.globs[tagged].MatchString(name) {
+					return true
+				}
+			}
+			continue
+		}
+		if f.globs[pattern].MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterConfig returns a copy of the config containing only the contexts
+// matched by the filter, and the clusters and auth infos they reference.
+func FilterConfig(config *api.Config, filter *SyncFilter) *api.Config {
+	out := api.NewConfig()
+	for name := range config.Contexts {
+		if filter.Matches(name) {
+			mergeConfig(out, ContextConfig(config, name))
+		}
+	}
+	return out
+}
+
+// ComputeFilteredDiff computes the diff between the contexts matched by the
+// filter on both sides. Local-only contexts are left out of the diff, but new
+// contexts are still checked for name conflicts against them.
+func ComputeFilteredDiff(existing, incoming *api.Config, filter *SyncFilter) (*Diff, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	diff, err := ComputeDiff(FilterConfig(existing, filter), FilterConfig(incoming, filter))
+	if err != nil {
+		return nil, err
+	}
+	markNameConflicts(diff, existing)
+	diff.Sort()
+	return diff, nil
+}
+
+// markNameConflicts marks new contexts whose names conflict with any context,
+// cluster or auth info in the existing config as requiring a rename.
+func markNameConflicts(diff *Diff, existing *api.Config) {
+	for i, item := range diff.Items {
+		if item.ChangeType&ChangeTypeNew == 0 {
+			continue
+		}
+		_, contextExists := existing.Contexts[item.AffectedIncoming.Name]
+		_, clusterExists := existing.Clusters[item.AffectedIncoming.Cluster]
+		_, authInfoExists := existing.AuthInfos[item.AffectedIncoming.AuthInfo]
+		if contextExists || clusterExists || authInfoExists {
+			diff.Items[i].ChangeType |= ChangeType(ComplexDiffRenameRequired)
+			diff.Items[i].Complex |= ComplexDiffRenameRequired
+		}
+	}
+}
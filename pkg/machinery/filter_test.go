@@ -0,0 +1,126 @@
+package machinery_test
+
+import (
+	"github.com/kralicky/kit/pkg/machinery"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Sync filters", func() {
+	It("should match context names", func() {
+		filter := &machinery.SyncFilter{
+			Exclude: []string{"kind-*", "minikube"},
+		}
+		Expect(filter.Matches("prod")).To(BeTrue())
+		Expect(filter.Matches("kind-dev")).To(BeFalse())
+		Expect(filter.Matches("minikube")).To(BeFalse())
+		Expect(filter.Matches("minikube2")).To(BeTrue())
+
+		filter = &machinery.SyncFilter{
+			Include: []string{"arn:aws:eks:*"},
+		}
+		Expect(filter.Matches("arn:aws:eks:us-east-1:123:cluster/prod")).To(BeTrue())
+		Expect(filter.Matches("prod")).To(BeFalse())
+
+		var none *machinery.SyncFilter
+		Expect(none.Matches("anything")).To(BeTrue())
+	})
+	It("should match tags", func() {
+		filter := &machinery.SyncFilter{
+			Include: []string{"tag:team"},
+			Exclude: []string{"tag:personal"},
+			Tags: map[string][]string{
+				"team":     {"prod-*", "staging-?"},
+				"personal": {"prod-sandbox"},
+			},
+		}
+		Expect(filter.Validate()).To(Succeed())
+		Expect(filter.Matches("prod-us")).To(BeTrue())
+		Expect(filter.Matches("staging-1")).To(BeTrue())
+		Expect(filter.Matches("staging-10")).To(BeFalse())
+		Expect(filter.Matches("prod-sandbox")).To(BeFalse())
+	})
+	It("should reject unknown tags", func() {
+		filter := &machinery.SyncFilter{
+			Include: []string{"tag:missing"},
+		}
+		Expect(filter.Validate()).To(MatchError(machinery.ErrInvalidSyncFilter))
+	})
+	It("should filter configs", func() {
+		filter := &machinery.SyncFilter{
+			Exclude: []string{"context2"},
+		}
+		filtered, expected := machinery.FilterConfig(sampleClusters(1, 2, 3), filter), sampleClusters(1, 3)
+		Expect(filtered.Contexts).To(Equal(expected.Contexts))
+		Expect(filtered.Clusters).To(Equal(expected.Clusters))
+		Expect(filtered.AuthInfos).To(Equal(expected.AuthInfos))
+	})
+	It("should not delete local-only contexts", func() {
+		existing, incoming := sampleClusters(1, 2), sampleClusters(1)
+		filter := &machinery.SyncFilter{
+			Exclude: []string{"context2"},
+		}
+		diff, err := machinery.ComputeFilteredDiff(existing, incoming, filter)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(diff.Items).To(BeEmpty())
+	})
+	It("should not pull excluded contexts", func() {
+		existing, incoming := sampleClusters(1), sampleClusters(1, 2)
+		filter := &machinery.SyncFilter{
+			Exclude: []string{"context2"},
+		}
+		diff, err := machinery.ComputeFilteredDiff(existing, incoming, filter)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(diff.Items).To(BeEmpty())
+	})
+	It("should detect name conflicts with local-only contexts", func() {
+		existing, incoming := sampleClusters(1, 2), sampleClusters(2)
+		incoming.Clusters["cluster2"].Server = "https://other:6443"
+		incoming.Clusters["cluster2"].CertificateAuthorityData = []byte("otherCA")
+		incoming.AuthInfos["authInfo2"].ClientKeyData = []byte("otherKey")
+		filter := &machinery.SyncFilter{
+			Include: []string{"context2"},
+		}
+		// context2 is excluded locally by renaming it out of the filter
+		existing.Contexts["local"] = existing.Contexts["context2"]
+		delete(existing.Contexts, "context2")
+		diff, err := machinery.ComputeFilteredDiff(existing, incoming, filter)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(diff.Items).To(HaveLen(1))
+		Expect(diff.Items[0].ChangeType & machinery.ChangeTypeNew).NotTo(BeZero())
+		Expect(diff.Items[0].Complex).To(Equal(machinery.ComplexDiffRenameRequired))
+
+		Expect(diff.Apply(existing, incoming, machinery.AutoResolver)).To(Succeed())
+		Expect(existing.Clusters["cluster2"].Server).To(Equal("https://host2:6443"))
+		Expect(existing.Contexts).To(HaveKey("local"))
+		Expect(existing.Contexts).To(HaveLen(3))
+	})
+	It("should keep clusters and auth infos used by local-only contexts", func() {
+		existing, incoming := sampleClusters(1, 2), sampleClusters(1)
+		existing.Contexts["kind-context2"] = existing.Contexts["context2"].DeepCopy()
+		filter := &machinery.SyncFilter{
+			Exclude: []string{"kind-*"},
+		}
+		diff, err := machinery.ComputeFilteredDiff(existing, incoming, filter)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(diff.Items).To(HaveLen(1))
+		Expect(diff.Items[0].ChangeType).To(Equal(machinery.ChangeTypeDelete))
+
+		Expect(diff.Apply(existing, incoming, machinery.AutoResolver)).To(Succeed())
+		Expect(existing.Contexts).NotTo(HaveKey("context2"))
+		Expect(existing.Contexts).To(HaveKey("kind-context2"))
+		Expect(existing.Clusters).To(HaveKey("cluster2"))
+		Expect(existing.AuthInfos).To(HaveKey("authInfo2"))
+	})
+	It("should use patterns changed before validating again", func() {
+		filter := &machinery.SyncFilter{
+			Exclude: []string{"kind-*"},
+		}
+		Expect(filter.Validate()).To(Succeed())
+		Expect(filter.Matches("minikube")).To(BeTrue())
+		filter.Exclude = append(filter.Exclude, "minikube")
+		Expect(filter.Validate()).To(Succeed())
+		Expect(filter.Matches("minikube")).To(BeFalse())
+		Expect(filter.Matches("kind-dev")).To(BeFalse())
+	})
+})
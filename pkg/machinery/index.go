@@ -0,0 +1,178 @@
+package machinery
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+// contextEntry is a context along with the cluster and auth info it
+// references.
+type contextEntry struct {
+	Name     string
+	Context  *api.Context
+	Cluster  *api.Cluster
+	AuthInfo *api.AuthInfo
+}
+
+func (e *contextEntry) named() NamedContext {
+	return NewNamedContext(e.Name, e.Context)
+}
+
+// contextIndex indexes the contexts of a config by the parts of their
+// cluster and auth info that ComputeDiff matches on, so that matches are
+// found with map lookups instead of comparing every pair of contexts.
+type contextIndex struct {
+	entries []*contextEntry
+	// Keyed by clusterKey (server and CA)
+	byCluster map[string][]*contextEntry
+	byCA      map[string][]*contextEntry
+	byServer  map[string][]*contextEntry
+	// Keyed by authInfoKey, which may collide
+	byAuth map[string][]*contextEntry
+	// Keyed by clusterKey and authInfoKey
+	byContext map[string][]*contextEntry
+}
+
+func newContextIndex() *contextIndex {
+	return &contextIndex{
+		byCluster: map[string][]*contextEntry{},
+		byCA:      map[string][]*contextEntry{},
+		byServer:  map[string][]*contextEntry{},
+		byAuth:    map[string][]*contextEntry{},
+		byContext: map[string][]*contextEntry{},
+	}
+}
+
+// indexConfig indexes the contexts in the config, except those named in
+// skip. Contexts are indexed in order of their names, so that when several
+// contexts match, the first match does not depend on map iteration order.
+// kind describes the config in the error returned if a context references a
+// missing cluster or auth info.
+func indexConfig(config *api.Config, kind string, skip map[string]bool) (*contextIndex, error) {
+	index := newContextIndex()
+	names := make([]string, 0, len(config.Contexts))
+	for name := range config.Contexts {
+		if !skip[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		context := config.Contexts[name]
+		cluster, ok := config.Clusters[context.Cluster]
+		if !ok {
+			return nil, fmt.Errorf("%s %w: context %s references nonexistent cluster %s",
+				kind, ErrIllFormedConfig, name, context.Cluster)
+		}
+		authInfo, ok := config.AuthInfos[context.AuthInfo]
+		if !ok {
+			return nil, fmt.Errorf("%s %w: context %s references nonexistent auth info %s",
+				kind, ErrIllFormedConfig, name, context.AuthInfo)
+		}
+		index.add(&contextEntry{
+			Name:     name,
+			Context:  context,
+			Cluster:  cluster,
+			AuthInfo: authInfo,
+		})
+	}
+	return index, nil
+}
+
+func (x *contextIndex) add(entry *contextEntry) {
+	x.entries = append(x.entries, entry)
+	cluster, auth := clusterKey(entry.Cluster), authInfoKey(entry.AuthInfo)
+	x.byCluster[cluster] = append(x.byCluster[cluster], entry)
+	x.byCA[string(entry.Cluster.CertificateAuthorityData)] = append(x.byCA[string(entry.Cluster.CertificateAuthorityData)], entry)
+	x.byServer[entry.Cluster.Server] = append(x.byServer[entry.Cluster.Server], entry)
+	x.byAuth[auth] = append(x.byAuth[auth], entry)
+	x.byContext[cluster+auth] = append(x.byContext[cluster+auth], entry)
+}
+
+// matchCluster returns the contexts whose cluster is equal to the given one.
+func (x *contextIndex) matchCluster(cluster *api.Cluster) []*contextEntry {
+	return x.byCluster[clusterKey(cluster)]
+}
+
+// matchAuthInfo returns the contexts whose auth info is equal to the given
+// one.
+func (x *contextIndex) matchAuthInfo(authInfo *api.AuthInfo) []*contextEntry {
+	return filterAuthInfo(x.byAuth[authInfoKey(authInfo)], authInfo)
+}
+
+// matchContext returns the contexts whose cluster and auth info are both
+// equal to the given ones.
+func (x *contextIndex) matchContext(cluster *api.Cluster, authInfo *api.AuthInfo) []*contextEntry {
+	return filterAuthInfo(x.byContext[clusterKey(cluster)+authInfoKey(authInfo)], authInfo)
+}
+
+func (x *contextIndex) matchCA(cluster *api.Cluster) []*contextEntry {
+	return x.byCA[string(cluster.CertificateAuthorityData)]
+}
+
+func (x *contextIndex) matchServer(cluster *api.Cluster) []*contextEntry {
+	return x.byServer[cluster.Server]
+}
+
+// mergeEntries returns the entries in either list, ordered by name.
+func mergeEntries(a, b []*contextEntry) []*contextEntry {
+	seen := map[string]bool{}
+	var out []*contextEntry
+	for _, entry := range append(append([]*contextEntry{}, a...), b...) {
+		if !seen[entry.Name] {
+			seen[entry.Name] = true
+			out = append(out, entry)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+func filterAuthInfo(entries []*contextEntry, authInfo *api.AuthInfo) []*contextEntry {
+	var out []*contextEntry
+	for _, entry := range entries {
+		if AuthInfosEqual(entry.AuthInfo, authInfo) {
+			out = append(out, entry)
+		}
+	}
+	return out
+}
+
+// clusterKey is equal for two clusters if and only if ClustersEqual is true.
+func clusterKey(cluster *api.Cluster) string {
+	sum := sha256.Sum256([]byte(cluster.Server + "\x00" + string(cluster.CertificateAuthorityData)))
+	return string(sum[:])
+}
+
+// authInfoKey hashes the credentials of an auth info. Auth infos for which
+// AuthInfosEqual is true always have the same key, but auth infos that only
+// differ in other fields may also share a key, so matches must be confirmed
+// with AuthInfosEqual.
+func authInfoKey(authInfo *api.AuthInfo) string {
+	fields := []string{
+		authInfo.ClientCertificate,
+		string(authInfo.ClientCertificateData),
+		authInfo.ClientKey,
+		string(authInfo.ClientKeyData),
+		authInfo.Token,
+		authInfo.TokenFile,
+		authInfo.Impersonate,
+		authInfo.Username,
+		authInfo.Password,
+	}
+	if authInfo.AuthProvider != nil {
+		fields = append(fields, authInfo.AuthProvider.Name)
+	}
+	if authInfo.Exec != nil {
+		fields = append(fields, authInfo.Exec.Command)
+		fields = append(fields, authInfo.Exec.Args...)
+	}
+	sum := sha256.Sum256([]byte(strings.Join(fields, "\x00")))
+	return string(sum[:])
+}
@@ -0,0 +1,419 @@
+package machinery
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+var unsafeFileNameChars = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+// KubeconfigPaths returns the local kubeconfig files. Like KUBECONFIG, the
+// kubeconfig path may be a list of files. Directories are expanded to the
+// files they contain.
+func (c *KitConfig) KubeconfigPaths() ([]string, error) {
+	var paths []string
+	for _, path := range filepath.SplitList(c.KubeconfigPath) {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err != nil || !info.IsDir() {
+			paths = append(paths, path)
+			continue
+		}
+		files, err := kubeconfigDirFiles(path)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, files...)
+	}
+	return paths, nil
+}
+
+// KubeconfigDir returns the kubeconfig directory if the kubeconfig path is a
+// single directory. In directory mode, each new context is written to its
+// own file, and files are deleted once they no longer contain any entries.
+func (c *KitConfig) KubeconfigDir() (string, bool) {
+	info, err := os.Stat(c.KubeconfigPath)
+	if err != nil || !info.IsDir() {
+		return "", false
+	}
+	return c.KubeconfigPath, true
+}
+
+// kubeconfigDirFiles lists the kubeconfig files in a directory, sorted by
+// name. Only .yaml and .yml files are read, which also leaves out lock
+// files; hidden files are skipped.
+func kubeconfigDirFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		if ext := filepath.Ext(name); ext != ".yaml" && ext != ".yml" {
+			continue
+		}
+		files = append(files, filepath.Join(dir, name))
+	}
+	return files, nil
+}
+
+// KubeconfigTargetPath returns the file that new entries are written to,
+// when not in directory mode.
+func (c *KitConfig) KubeconfigTargetPath() string {
+	if c.KubeconfigTarget != "" {
+		return c.KubeconfigTarget
+	}
+	if paths := filepath.SplitList(c.KubeconfigPath); len(paths) > 0 && paths[0] != "" {
+		return paths[0]
+	}
+	return DefaultKubeconfigPath()
+}
+
+// targetFunc returns the file a new entry of the given kind ("Cluster",
+// "AuthInfo" or "Context") should be written to.
+type targetFunc func(kind, name string) string
+
+func fixedTarget(path string) targetFunc {
+	return func(string, string) string {
+		return path
+	}
+}
+
+// dirTarget writes each new context to its own file in the directory, named
+// after the context. New clusters and auth infos are written to the file of
+// a context that references them.
+func dirTarget(dir string, merged *api.Config, existing []string) targetFunc {
+	taken := map[string]bool{}
+	for _, path := range existing {
+		taken[path] = true
+	}
+	contextFiles := map[string]string{}
+	contextFile := func(name string) string {
+		if path, ok := contextFiles[name]; ok {
+			return path
+		}
+		if context, ok := merged.Contexts[name]; ok && context.LocationOfOrigin != "" {
+			return context.LocationOfOrigin
+		}
+		base := unsafeFileNameChars.ReplaceAllString(name, "_")
+		path := filepath.Join(dir, base+".yaml")
+		for i := 2; taken[path]; i++ {
+			path = filepath.Join(dir, fmt.Sprintf("%s-%d.yaml", base, i))
+		}
+		taken[path] = true
+		contextFiles[name] = path
+		return path
+	}
+	return func(kind, name string) string {
+		if kind == "Context" {
+			return contextFile(name)
+		}
+		var referencing []string
+		for contextName, context := range merged.Contexts {
+			if (kind == "Cluster" && context.Cluster == name) ||
+				(kind == "AuthInfo" && context.AuthInfo == name) {
+				referencing = append(referencing, contextName)
+			}
+		}
+		if len(referencing) == 0 {
+			return contextFile(name)
+		}
+		sort.Strings(referencing)
+		return contextFile(referencing[0])
+	}
+}
+
+// loadKubeconfigs merges the given kubeconfig files using the same rules as
+// kubectl: the first file to define an entry or the current context wins.
+// Each entry records the file it came from in LocationOfOrigin.
+//
+// clientcmd.ClientConfigLoadingRules is not used, since with newer versions
+// of mergo it lets later files override entries from earlier ones.
+func loadKubeconfigs(paths []string) (*api.Config, error) {
+	files, err := readKubeconfigFiles(paths)
+	if err != nil {
+		return nil, err
+	}
+	return mergeKubeconfigFiles(files), nil
+}
+
+func mergeKubeconfigFiles(files []*kubeconfigFile) *api.Config {
+	merged := api.NewConfig()
+	for _, file := range files {
+		config := file.Config
+		if merged.CurrentContext == "" {
+			merged.CurrentContext = config.CurrentContext
+		}
+		for name, cluster := range config.Clusters {
+			if _, ok := merged.Clusters[name]; !ok {
+				merged.Clusters[name] = cluster
+			}
+		}
+		for name, authInfo := range config.AuthInfos {
+			if _, ok := merged.AuthInfos[name]; !ok {
+				merged.AuthInfos[name] = authInfo
+			}
+		}
+		for name, context := range config.Contexts {
+			if _, ok := merged.Contexts[name]; !ok {
+				merged.Contexts[name] = context
+			}
+		}
+	}
+	return merged
+}
+
+// kubeconfigFile is a single kubeconfig file as it exists on disk.
+type kubeconfigFile struct {
+	Path    string
+	Data    []byte
+	Config  *api.Config
+	Missing bool
+}
+
+func readKubeconfigFiles(paths []string) ([]*kubeconfigFile, error) {
+	files := make([]*kubeconfigFile, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return nil, err
+			}
+			files = append(files, &kubeconfigFile{
+				Path:    path,
+				Config:  api.NewConfig(),
+				Missing: true,
+			})
+			continue
+		}
+		file, err := loadKubeconfig(path, data)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// loadKubeconfig decodes the contents of a kubeconfig file, recording the
+// file in the LocationOfOrigin of each entry like clientcmd.LoadFromFile.
+func loadKubeconfig(path string, data []byte) (*kubeconfigFile, error) {
+	config, err := clientcmd.Load(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, cluster := range config.Clusters {
+		cluster.LocationOfOrigin = path
+	}
+	for _, authInfo := range config.AuthInfos {
+		authInfo.LocationOfOrigin = path
+	}
+	for _, context := range config.Contexts {
+		context.LocationOfOrigin = path
+	}
+	return &kubeconfigFile{
+		Path:   path,
+		Data:   data,
+		Config: config,
+	}, nil
+}
+
+// splitKubeconfig distributes the entries of a merged config over the files
+// it was loaded from. Entries are written back to the file they came from.
+// New entries replace an existing entry with the same name in the file that
+// contained it, and otherwise are written to the target file. Entries in a
+// file that were hidden by an entry with the same name in an earlier file are
+// kept as they are.
+func splitKubeconfig(merged *api.Config, files []*kubeconfigFile, target targetFunc) map[string]*api.Config {
+	out := map[string]*api.Config{}
+	for _, file := range files {
+		out[file.Path] = file.Config.DeepCopy()
+	}
+	dest := func(origin string, kind, name string, exists func(*api.Config) bool) string {
+		if _, ok := out[origin]; ok {
+			return origin
+		}
+		for _, file := range files {
+			if exists(file.Config) {
+				return file.Path
+			}
+		}
+		path := target(kind, name)
+		if _, ok := out[path]; !ok {
+			out[path] = api.NewConfig()
+		}
+		return path
+	}
+
+	// Remove entries that no longer exist, and entries that are visible in
+	// the merged config, which are added back below
+	for _, file := range files {
+		config := out[file.Path]
+		for name := range config.Clusters {
+			if c, ok := merged.Clusters[name]; !ok || dest(c.LocationOfOrigin, "Cluster", name, hasCluster(name)) == file.Path {
+				delete(config.Clusters, name)
+			}
+		}
+		for name := range config.AuthInfos {
+			if a, ok := merged.AuthInfos[name]; !ok || dest(a.LocationOfOrigin, "AuthInfo", name, hasAuthInfo(name)) == file.Path {
+				delete(config.AuthInfos, name)
+			}
+		}
+		for name := range config.Contexts {
+			if c, ok := merged.Contexts[name]; !ok || dest(c.LocationOfOrigin, "Context", name, hasContext(name)) == file.Path {
+				delete(config.Contexts, name)
+			}
+		}
+	}
+	for name, cluster := range merged.Clusters {
+		out[dest(cluster.LocationOfOrigin, "Cluster", name, hasCluster(name))].Clusters[name] = cluster
+	}
+	for name, authInfo := range merged.AuthInfos {
+		out[dest(authInfo.LocationOfOrigin, "AuthInfo", name, hasAuthInfo(name))].AuthInfos[name] = authInfo
+	}
+	for name, context := range merged.Contexts {
+		out[dest(context.LocationOfOrigin, "Context", name, hasContext(name))].Contexts[name] = context
+	}
+
+	// Like kubectl, the current context is written to the file that defines
+	// the context, and cleared from earlier files, which would otherwise take
+	// precedence. It is cleared everywhere if the context was deleted.
+	current := merged.CurrentContext
+	context, ok := merged.Contexts[current]
+	switch {
+	case current == "" || (!ok && definesContext(files, current)):
+		for _, config := range out {
+			config.CurrentContext = ""
+		}
+	case ok && currentContext(files) != current:
+		path := dest(context.LocationOfOrigin, "Context", current, hasContext(current))
+		for _, file := range files {
+			if file.Path == path {
+				break
+			}
+			out[file.Path].CurrentContext = ""
+		}
+		out[path].CurrentContext = current
+	}
+	return out
+}
+
+// currentContext returns the current context of the files when merged.
+func currentContext(files []*kubeconfigFile) string {
+	for _, file := range files {
+		if file.Config.CurrentContext != "" {
+			return file.Config.CurrentContext
+		}
+	}
+	return ""
+}
+
+func definesContext(files []*kubeconfigFile, name string) bool {
+	for _, file := range files {
+		if hasContext(name)(file.Config) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasCluster(name string) func(*api.Config) bool {
+	return func(c *api.Config) bool {
+		_, ok := c.Clusters[name]
+		return ok
+	}
+}
+
+func hasAuthInfo(name string) func(*api.Config) bool {
+	return func(c *api.Config) bool {
+		_, ok := c.AuthInfos[name]
+		return ok
+	}
+}
+
+func hasContext(name string) func(*api.Config) bool {
+	return func(c *api.Config) bool {
+		_, ok := c.Contexts[name]
+		return ok
+	}
+}
+
+// writeKubeconfigs writes the merged config back to the files it was loaded
+// from. Files whose contents did not change are not rewritten. If
+// removeEmpty is set, files that no longer contain any entries are deleted.
+//
+// All affected files are locked while they are read and written, and each
+// file is replaced atomically.
+func writeKubeconfigs(merged *api.Config, paths []string, target targetFunc, removeEmpty bool) (err error) {
+	locks := &fileLocks{}
+	defer func() {
+		if unlockErr := locks.unlock(); unlockErr != nil && err == nil {
+			err = unlockErr
+		}
+	}()
+	for _, path := range paths {
+		if err := locks.lock(path); err != nil {
+			return err
+		}
+	}
+	files, err := readKubeconfigFiles(paths)
+	if err != nil {
+		return err
+	}
+	split := splitKubeconfig(merged, files, target)
+	for path, config := range split {
+		updated, err := clientcmd.Write(*config)
+		if err != nil {
+			return err
+		}
+		var original []byte
+		var existing *kubeconfigFile
+		for _, file := range files {
+			if file.Path == path && !file.Missing {
+				if original, err = clientcmd.Write(*file.Config); err != nil {
+					return err
+				}
+				existing = file
+			}
+		}
+		if bytes.Equal(original, updated) || (existing == nil && isEmptyConfig(config)) {
+			continue
+		}
+		if err := locks.lock(path); err != nil {
+			return err
+		}
+		if removeEmpty && isEmptyConfig(config) {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			continue
+		}
+		if existing != nil {
+			// Keep comments and formatting of the existing file
+			if updated, err = patchKubeconfig(existing.Data, config); err != nil {
+				return err
+			}
+		}
+		if err := writeFileAtomic(path, updated, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isEmptyConfig(config *api.Config) bool {
+	return len(config.Clusters) == 0 && len(config.AuthInfos) == 0 && len(config.Contexts) == 0
+}
@@ -0,0 +1,273 @@
+package machinery_test
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/kralicky/kit/pkg/machinery"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+var _ = Describe("Multiple kubeconfig files", func() {
+	var dir, fileA, fileB string
+	var config *machinery.KitConfig
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "kit-kubeconfig")
+		Expect(err).NotTo(HaveOccurred())
+		fileA = filepath.Join(dir, "a.yaml")
+		fileB = filepath.Join(dir, "b.yaml")
+		a := sampleClusters(1, 2)
+		a.CurrentContext = "context1"
+		b := sampleClusters(3)
+		// Hidden by the entry in the first file
+		b.Clusters["cluster1"] = &api.Cluster{
+			Server: "https://hidden:6443",
+		}
+		Expect(clientcmd.WriteToFile(*a, fileA)).To(Succeed())
+		Expect(clientcmd.WriteToFile(*b, fileB)).To(Succeed())
+		config = &machinery.KitConfig{
+			KubeconfigPath: fileA + string(filepath.ListSeparator) + fileB,
+		}
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	load := func(path string) *api.Config {
+		c, err := clientcmd.LoadFromFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		return c
+	}
+
+	It("should merge all files", func() {
+		local, err := machinery.ReadLocalData(config)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(local.Config.Contexts).To(HaveLen(3))
+		Expect(local.Config.Contexts["context1"].LocationOfOrigin).To(Equal(fileA))
+		Expect(local.Config.Contexts["context3"].LocationOfOrigin).To(Equal(fileB))
+		Expect(local.Config.Clusters["cluster1"].Server).To(Equal("https://host1:6443"))
+		Expect(local.Config.CurrentContext).To(Equal("context1"))
+	})
+	It("should write changes back to the originating file", func() {
+		originalA, err := os.ReadFile(fileA)
+		Expect(err).NotTo(HaveOccurred())
+		local, err := machinery.ReadLocalData(config)
+		Expect(err).NotTo(HaveOccurred())
+		local.Config.Clusters["cluster3"].Server = "https://changed:6443"
+		Expect(machinery.WriteLocalData(config, local)).To(Succeed())
+
+		b := load(fileB)
+		Expect(b.Clusters["cluster3"].Server).To(Equal("https://changed:6443"))
+		Expect(b.Clusters["cluster1"].Server).To(Equal("https://hidden:6443"))
+		Expect(b.Contexts).To(HaveLen(1))
+		// Unchanged files are not rewritten
+		currentA, err := os.ReadFile(fileA)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(currentA).To(Equal(originalA))
+	})
+	It("should write new entries to the target file", func() {
+		config.KubeconfigTarget = fileB
+		local, err := machinery.ReadLocalData(config)
+		Expect(err).NotTo(HaveOccurred())
+		incoming := sampleClusters(4)
+		Expect(machinery.ComputeDiff(local.Config, incoming)).NotTo(BeNil())
+		local.Config.Clusters["cluster4"] = incoming.Clusters["cluster4"]
+		local.Config.AuthInfos["authInfo4"] = incoming.AuthInfos["authInfo4"]
+		local.Config.Contexts["context4"] = incoming.Contexts["context4"]
+		Expect(machinery.WriteLocalData(config, local)).To(Succeed())
+
+		Expect(load(fileA).Contexts).NotTo(HaveKey("context4"))
+		Expect(load(fileB).Contexts).To(HaveKey("context4"))
+		Expect(load(fileB).Clusters).To(HaveKey("cluster4"))
+	})
+	It("should replace modified entries in place", func() {
+		local, err := machinery.ReadLocalData(config)
+		Expect(err).NotTo(HaveOccurred())
+		// Entries copied from the remote have no origin
+		local.Config.AuthInfos["authInfo1"] = &api.AuthInfo{
+			Token: "new-token",
+		}
+		Expect(machinery.WriteLocalData(config, local)).To(Succeed())
+		Expect(load(fileA).AuthInfos["authInfo1"].Token).To(Equal("new-token"))
+		Expect(load(fileB).AuthInfos).NotTo(HaveKey("authInfo1"))
+	})
+	It("should delete entries from the originating file", func() {
+		local, err := machinery.ReadLocalData(config)
+		Expect(err).NotTo(HaveOccurred())
+		delete(local.Config.Contexts, "context2")
+		delete(local.Config.Clusters, "cluster2")
+		delete(local.Config.AuthInfos, "authInfo2")
+		Expect(machinery.WriteLocalData(config, local)).To(Succeed())
+		a := load(fileA)
+		Expect(a.Contexts).To(HaveLen(1))
+		Expect(a.Clusters).NotTo(HaveKey("cluster2"))
+		Expect(a.CurrentContext).To(Equal("context1"))
+		Expect(load(fileB).Contexts).To(HaveLen(1))
+	})
+	It("should write the current context to the file that defines it", func() {
+		local, err := machinery.ReadLocalData(config)
+		Expect(err).NotTo(HaveOccurred())
+		local.Config.CurrentContext = "context3"
+		Expect(machinery.WriteLocalData(config, local)).To(Succeed())
+		Expect(load(fileA).CurrentContext).To(BeEmpty())
+		Expect(load(fileB).CurrentContext).To(Equal("context3"))
+
+		local, err = machinery.ReadLocalData(config)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(local.Config.CurrentContext).To(Equal("context3"))
+	})
+	It("should clear the current context if it was deleted", func() {
+		local, err := machinery.ReadLocalData(config)
+		Expect(err).NotTo(HaveOccurred())
+		delete(local.Config.Contexts, "context1")
+		Expect(machinery.WriteLocalData(config, local)).To(Succeed())
+		Expect(load(fileA).CurrentContext).To(BeEmpty())
+		Expect(load(fileB).CurrentContext).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Kubeconfig directories", func() {
+	var dir string
+	var config *machinery.KitConfig
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "kit-kubeconfig-dir")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(clientcmd.WriteToFile(*sampleClusters(1), filepath.Join(dir, "one.yaml"))).To(Succeed())
+		Expect(clientcmd.WriteToFile(*sampleClusters(2), filepath.Join(dir, "two.yaml"))).To(Succeed())
+		// Not kubeconfigs
+		Expect(os.WriteFile(filepath.Join(dir, ".hidden"), []byte("invalid"), 0600)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "three.yaml.lock"), nil, 0600)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "README.md"), []byte("# Kubeconfigs"), 0600)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "two.yaml~"), []byte("invalid: ["), 0600)).To(Succeed())
+		config = &machinery.KitConfig{
+			KubeconfigPath: dir,
+		}
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should merge every file in the directory", func() {
+		local, err := machinery.ReadLocalData(config)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(local.Config.Contexts).To(HaveLen(2))
+		Expect(local.Config.Contexts["context2"].LocationOfOrigin).To(Equal(filepath.Join(dir, "two.yaml")))
+	})
+	It("should write new contexts to their own files", func() {
+		local, err := machinery.ReadLocalData(config)
+		Expect(err).NotTo(HaveOccurred())
+		incoming := sampleClusters(3)
+		incoming.Contexts["arn:aws:eks:us-east-1:123:cluster/prod"] = incoming.Contexts["context3"]
+		delete(incoming.Contexts, "context3")
+		diff, err := machinery.ComputeDiff(local.Config, incoming)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(diff.Apply(local.Config, incoming, machinery.AutoResolver)).To(Succeed())
+		Expect(machinery.WriteLocalData(config, local)).To(Succeed())
+
+		written, err := clientcmd.LoadFromFile(filepath.Join(dir, "arn_aws_eks_us-east-1_123_cluster_prod.yaml"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(written.Contexts).To(HaveKey("arn:aws:eks:us-east-1:123:cluster/prod"))
+		Expect(written.Clusters).To(HaveKey("cluster3"))
+		Expect(written.AuthInfos).To(HaveKey("authInfo3"))
+	})
+	It("should rewrite modified contexts", func() {
+		local, err := machinery.ReadLocalData(config)
+		Expect(err).NotTo(HaveOccurred())
+		local.Config.Clusters["cluster2"].Server = "https://changed:6443"
+		Expect(machinery.WriteLocalData(config, local)).To(Succeed())
+		written, err := clientcmd.LoadFromFile(filepath.Join(dir, "two.yaml"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(written.Clusters["cluster2"].Server).To(Equal("https://changed:6443"))
+	})
+	It("should delete files of deleted contexts", func() {
+		local, err := machinery.ReadLocalData(config)
+		Expect(err).NotTo(HaveOccurred())
+		diff, err := machinery.ComputeDiff(local.Config, sampleClusters(1))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(diff.Items).To(HaveLen(1))
+		Expect(diff.Apply(local.Config, sampleClusters(1), machinery.AutoResolver)).To(Succeed())
+		Expect(machinery.WriteLocalData(config, local)).To(Succeed())
+		Expect(filepath.Join(dir, "two.yaml")).NotTo(BeAnExistingFile())
+		Expect(filepath.Join(dir, "one.yaml")).To(BeAnExistingFile())
+	})
+})
+
+var _ = Describe("Kubeconfig writes", func() {
+	var dir, file string
+	var config *machinery.KitConfig
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "kit-kubeconfig-write")
+		Expect(err).NotTo(HaveOccurred())
+		file = filepath.Join(dir, "config")
+		Expect(clientcmd.WriteToFile(*sampleClusters(1), file)).To(Succeed())
+		Expect(os.Chmod(file, 0644)).To(Succeed())
+		config = &machinery.KitConfig{
+			KubeconfigPath: file,
+		}
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	modify := func() *machinery.LocalData {
+		local, err := machinery.ReadLocalData(config)
+		Expect(err).NotTo(HaveOccurred())
+		local.Config.Clusters["cluster1"].Server = "https://changed:6443"
+		return local
+	}
+
+	It("should fail if the kubeconfig is locked", func() {
+		local := modify()
+		Expect(os.WriteFile(file+".lock", nil, 0600)).To(Succeed())
+		before, err := os.ReadFile(file)
+		Expect(err).NotTo(HaveOccurred())
+
+		err = machinery.WriteLocalData(config, local)
+		Expect(machinery.IsKubeconfigLocked(err)).To(BeTrue())
+		after, err := os.ReadFile(file)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(after).To(Equal(before))
+		Expect(file + ".lock").To(BeAnExistingFile())
+	})
+	It("should release the lock after writing", func() {
+		Expect(machinery.WriteLocalData(config, modify())).To(Succeed())
+		Expect(file + ".lock").NotTo(BeAnExistingFile())
+		written, err := clientcmd.LoadFromFile(file)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(written.Clusters["cluster1"].Server).To(Equal("https://changed:6443"))
+	})
+	It("should preserve the file mode", func() {
+		Expect(machinery.WriteLocalData(config, modify())).To(Succeed())
+		info, err := os.Stat(file)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0644)))
+	})
+	It("should write through symlinks", func() {
+		link := filepath.Join(dir, "link")
+		Expect(os.Symlink("config", link)).To(Succeed())
+		config.KubeconfigPath = link
+		Expect(machinery.WriteLocalData(config, modify())).To(Succeed())
+
+		info, err := os.Lstat(link)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Mode() & os.ModeSymlink).NotTo(BeZero())
+		written, err := clientcmd.LoadFromFile(file)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(written.Clusters["cluster1"].Server).To(Equal("https://changed:6443"))
+		Expect(link + ".lock").NotTo(BeAnExistingFile())
+		Expect(file + ".lock").NotTo(BeAnExistingFile())
+	})
+	It("should not leave temporary files behind", func() {
+		Expect(machinery.WriteLocalData(config, modify())).To(Succeed())
+		entries, err := os.ReadDir(dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Name()).To(Equal("config"))
+	})
+})
@@ -0,0 +1,151 @@
+package machinery
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultMountPath = "kit"
+	DefaultKVVersion = 2
+
+	// Directory under the secret path that shared contexts are stored in
+	sharedDir = "shared"
+)
+
+// KVPaths computes the Vault API paths used to store kit data in a KV secret
+// engine. KV v2 prefixes data and metadata paths with "data/" and
+// "metadata/" respectively, while KV v1 stores secrets directly under the
+// mount.
+type KVPaths struct {
+	Mount   string
+	Prefix  string
+	Version int
+}
+
+func (c *KitConfig) KVPaths() KVPaths {
+	paths := KVPaths{
+		Mount:   strings.Trim(c.MountPath, "/"),
+		Prefix:  strings.Trim(c.SecretPath, "/"),
+		Version: c.KVVersion,
+	}
+	if paths.Mount == "" {
+		paths.Mount = DefaultMountPath
+	}
+	if paths.Version == 0 {
+		paths.Version = DefaultKVVersion
+	}
+	return paths
+}
+
+func (p KVPaths) Validate() error {
+	if p.Version != 1 && p.Version != 2 {
+		return fmt.Errorf("%w: %d", ErrUnsupportedKVVersion, p.Version)
+	}
+	return nil
+}
+
+// Data returns the path used to read and write the secret with the given name.
+func (p KVPaths) Data(name string) string {
+	return p.dataPath(escapeName(name))
+}
+
+// Metadata returns the metadata path for the secret with the given name.
+// KV v1 has no metadata, in which case this returns an empty string.
+func (p KVPaths) Metadata(name string) string {
+	return p.metadataPath(escapeName(name))
+}
+
+func (p KVPaths) dataPath(segment string) string {
+	if p.Version == 1 {
+		return path.Join(p.Mount, p.Prefix, segment)
+	}
+	return path.Join(p.Mount, "data", p.Prefix, segment)
+}
+
+func (p KVPaths) metadataPath(segment string) string {
+	if p.Version == 1 {
+		return ""
+	}
+	return path.Join(p.Mount, "metadata", p.Prefix, segment)
+}
+
+// Legacy returns the path of the secret that older versions of kit stored all
+// contexts in, before each context had its own secret. Those versions only
+// supported KV v2, so there is no such secret on KV v1, where the path would
+// also be that of a context named "data".
+func (p KVPaths) Legacy() (string, bool) {
+	if p.Version == 1 {
+		return "", false
+	}
+	return p.dataPath(""), true
+}
+
+// List returns the path used to list all secrets stored by kit.
+func (p KVPaths) List() string {
+	return p.listPath("")
+}
+
+// Shared returns the path of the copy of a context shared with a recipient.
+// Shared copies are stored under "shared/<recipient>/<name>", apart from the
+// copy readable by the rest of the team.
+func (p KVPaths) Shared(recipient, name string) string {
+	return p.dataPath(path.Join(sharedDir, escapeName(recipient), escapeName(name)))
+}
+
+// SharedList returns the path used to list the contexts shared with a
+// recipient.
+func (p KVPaths) SharedList(recipient string) string {
+	return p.listPath(path.Join(sharedDir, escapeName(recipient)))
+}
+
+func (p KVPaths) listPath(segment string) string {
+	if p.Version == 1 {
+		return path.Join(p.Mount, p.Prefix, segment) + "/"
+	}
+	return path.Join(p.Mount, "metadata", p.Prefix, segment) + "/"
+}
+
+// MountOptions returns the options used when creating the KV mount.
+func (p KVPaths) MountOptions() map[string]string {
+	return map[string]string{
+		"version": strconv.Itoa(p.Version),
+	}
+}
+
+// WrapData wraps secret data in the request format expected by the KV engine.
+func (p KVPaths) WrapData(data map[string]interface{}) map[string]interface{} {
+	if p.Version == 1 {
+		return data
+	}
+	return map[string]interface{}{
+		"data": data,
+	}
+}
+
+// UnwrapData extracts the secret data from a KV read response.
+func (p KVPaths) UnwrapData(data map[string]interface{}) (map[string]interface{}, bool) {
+	if p.Version == 1 {
+		return data, data != nil
+	}
+	inner, ok := data["data"].(map[string]interface{})
+	return inner, ok
+}
+
+// escapeName escapes a context name so it is stored as a single secret, even
+// if it contains "/" or is "." or "..".
+func escapeName(name string) string {
+	escaped := url.PathEscape(name)
+	if escaped == "." || escaped == ".." {
+		escaped = strings.ReplaceAll(escaped, ".", "%2E")
+	}
+	return escaped
+}
+
+// unescapeName returns the context name stored in a listed secret key.
+func unescapeName(key string) (string, error) {
+	return url.PathUnescape(key)
+}
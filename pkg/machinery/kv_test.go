@@ -0,0 +1,65 @@
+package machinery_test
+
+import (
+	"github.com/kralicky/kit/pkg/machinery"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("KV Paths", func() {
+	It("should use the default kit mount", func() {
+		paths := (&machinery.KitConfig{}).KVPaths()
+		Expect(paths.Validate()).To(Succeed())
+		Expect(paths.Data("context1")).To(Equal("kit/data/context1"))
+		Expect(paths.Metadata("context1")).To(Equal("kit/metadata/context1"))
+		Expect(paths.List()).To(Equal("kit/metadata/"))
+		legacy, ok := paths.Legacy()
+		Expect(ok).To(BeTrue())
+		Expect(legacy).To(Equal("kit/data"))
+	})
+	It("should handle a kv v2 mount with a secret prefix", func() {
+		paths := (&machinery.KitConfig{
+			MountPath:  "/secret/",
+			SecretPath: "/teams/platform/",
+			KVVersion:  2,
+		}).KVPaths()
+		Expect(paths.Data("context1")).To(Equal("secret/data/teams/platform/context1"))
+		Expect(paths.Metadata("context1")).To(Equal("secret/metadata/teams/platform/context1"))
+		Expect(paths.List()).To(Equal("secret/metadata/teams/platform/"))
+		legacy, _ := paths.Legacy()
+		Expect(legacy).To(Equal("secret/data/teams/platform"))
+		data := map[string]interface{}{"kubeconfig": "x"}
+		wrapped := paths.WrapData(data)
+		Expect(wrapped).To(Equal(map[string]interface{}{"data": data}))
+		unwrapped, ok := paths.UnwrapData(wrapped)
+		Expect(ok).To(BeTrue())
+		Expect(unwrapped).To(Equal(data))
+	})
+	It("should handle a kv v1 mount with a secret prefix", func() {
+		paths := (&machinery.KitConfig{
+			MountPath:  "secret",
+			SecretPath: "teams/platform",
+			KVVersion:  1,
+		}).KVPaths()
+		Expect(paths.Data("context1")).To(Equal("secret/teams/platform/context1"))
+		Expect(paths.Metadata("context1")).To(BeEmpty())
+		Expect(paths.List()).To(Equal("secret/teams/platform/"))
+		// Older versions of kit did not support KV v1
+		_, ok := paths.Legacy()
+		Expect(ok).To(BeFalse())
+		data := map[string]interface{}{"kubeconfig": "x"}
+		Expect(paths.WrapData(data)).To(Equal(data))
+		Expect(paths.MountOptions()).To(Equal(map[string]string{"version": "1"}))
+	})
+	It("should escape context names into a single path segment", func() {
+		paths := (&machinery.KitConfig{}).KVPaths()
+		Expect(paths.Data("arn:aws:eks:us-east-1:1234:cluster/prod")).
+			To(Equal("kit/data/arn:aws:eks:us-east-1:1234:cluster%2Fprod"))
+		Expect(paths.Metadata("team/dev")).To(Equal("kit/metadata/team%2Fdev"))
+		Expect(paths.Data("..")).To(Equal("kit/data/%2E%2E"))
+	})
+	It("should reject unsupported versions", func() {
+		paths := (&machinery.KitConfig{KVVersion: 3}).KVPaths()
+		Expect(paths.Validate()).To(MatchError(machinery.ErrUnsupportedKVVersion))
+	})
+})
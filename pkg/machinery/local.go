@@ -1,13 +1,14 @@
 package machinery
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
 
 	"github.com/mitchellh/go-homedir"
 	log "github.com/sirupsen/logrus"
 	"k8s.io/client-go/tools/clientcmd/api"
+	clientcmdv1 "k8s.io/client-go/tools/clientcmd/api/v1"
 	"sigs.k8s.io/yaml"
 )
 
@@ -16,15 +17,29 @@ type LocalData struct {
 }
 
 type RemoteCache struct {
-	Latest  api.Config   `json:"latest"`
-	History []api.Config `json:"history"`
+	TypeMeta
+
+	Latest  api.Config
+	History []api.Config
+	// Contexts that were left out of Latest because their signature was
+	// refused. They are kept locally instead of being deleted.
+	Refused []string
+}
+
+// remoteCacheFile is the remote cache as it is stored on disk.
+type remoteCacheFile struct {
+	TypeMeta `json:",inline"`
+
+	Latest  clientcmdv1.Config   `json:"latest"`
+	History []clientcmdv1.Config `json:"history"`
+	Refused []string             `json:"refused,omitempty"`
 }
 
-func InitRemote(client *RemoteClient) error {
+func InitRemote(conf *KitConfig, client *RemoteClient) error {
 	// Check if the remote cache exists, if not write an empty one
-	if _, err := os.Stat(RemoteCachePath()); err != nil {
+	if _, err := os.Stat(conf.RemoteCachePath()); err != nil {
 		// Write the empty cache
-		if err := (&RemoteCache{}).WriteToDisk(); err != nil {
+		if err := (&RemoteCache{}).WriteToDisk(conf); err != nil {
 			return err
 		}
 	} else {
@@ -43,16 +58,53 @@ func InitRemote(client *RemoteClient) error {
 	return nil
 }
 
-func RemoteCachePath() string {
-	return filepath.Join(DotKitPath(), "remote.yaml")
+// RemoteCachePath returns the location of the cache of a remote. The
+// default remote uses remote.yaml in the kit home directory, and named
+// remotes use remotes/<name>.yaml.
+func RemoteCachePath(home, remote string) string {
+	if remote != DefaultRemoteName {
+		return filepath.Join(home, "remotes", remote+".yaml")
+	}
+	return filepath.Join(home, "remote.yaml")
+}
+
+func (c *KitConfig) RemoteCachePath() string {
+	return RemoteCachePath(c.Home(), c.RemoteName())
 }
 
-func (cache *RemoteCache) WriteToDisk() error {
-	data, err := yaml.Marshal(cache)
+func (cache *RemoteCache) WriteToDisk(conf *KitConfig) error {
+	cache.APIVersion = RemoteCacheAPIVersion
+	cache.Kind = KindRemoteCache
+	file := &remoteCacheFile{
+		TypeMeta: cache.TypeMeta,
+		History:  make([]clientcmdv1.Config, 0, len(cache.History)),
+		Refused:  cache.Refused,
+	}
+	latest, err := toV1(&cache.Latest)
 	if err != nil {
 		return err
 	}
-	path := RemoteCachePath()
+	file.Latest = *latest
+	for i := range cache.History {
+		config, err := toV1(&cache.History[i])
+		if err != nil {
+			return err
+		}
+		file.History = append(file.History, *config)
+	}
+	data, err := yaml.Marshal(file)
+	if err != nil {
+		return err
+	}
+	// The cache contains credentials, so it is always encrypted at rest
+	data, err = EncryptCacheData(data, conf.cacheEncryption())
+	if err != nil {
+		return err
+	}
+	path := conf.RemoteCachePath()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
 	if _, err := os.Stat(path); err == nil {
 		// Make the file readable temporarily
 		if err := os.Chmod(path, 0600); err != nil {
@@ -63,21 +115,27 @@ func (cache *RemoteCache) WriteToDisk() error {
 	return os.WriteFile(path, data, 0600)
 }
 
-func InitLocal(remote string) error {
+// InitLocal writes a new kit config to the given file, unless it exists.
+func InitLocal(configPath string, remote string) error {
 	conf := &KitConfig{
 		RemoteURL: remote,
+		path:      configPath,
+		home:      HomeForConfig(configPath),
 	}
-	dotKit := DotKitPath()
-	// If ~/.kit/config.yaml exists, kit is already initialized
-	if _, err := os.Stat(KitConfigPath()); err == nil {
-		log.Warnf("Local config already exists in %s, nothing to do.", dotKit)
+	dotKit := conf.Home()
+	// If the config file exists, kit is already initialized
+	if _, err := os.Stat(configPath); err == nil {
+		log.Warnf("Local config already exists in %s, nothing to do.", configPath)
 		return nil
 	}
 
-	// Create the ~/.kit directory
+	// Create the kit home directory
 	if err := os.MkdirAll(dotKit, 0700); err != nil {
 		return err
 	}
+	if err := os.MkdirAll(filepath.Dir(configPath), 0700); err != nil {
+		return err
+	}
 
 	// Discover local kubeconfig store
 	store, err := FindKubeconfigStore()
@@ -90,23 +148,21 @@ func InitLocal(remote string) error {
 		return err
 	}
 
-	log.Infof("Initialized local configuration in %s", dotKit)
+	log.Infof("Initialized local configuration in %s", configPath)
 	return nil
 }
 
+// FindKubeconfigStore returns the local kubeconfig path. If KUBECONFIG is
+// set, it is used as is, and may list several files.
 func FindKubeconfigStore() (string, error) {
-	// If KUBECONFIG is set, check that it points to a single file
 	if env := os.Getenv("KUBECONFIG"); env != "" {
-		// Paths are separated by ":"
-		paths := strings.Split(env, ":")
-		if len(paths) > 1 {
-			return "", ErrMultipleKubeconfigs
+		// At least one of the listed files must exist
+		for _, path := range filepath.SplitList(env) {
+			if _, err := os.Stat(path); err == nil {
+				return env, nil
+			}
 		}
-		// If the path does not exist, return an error
-		if _, err := os.Stat(paths[0]); err != nil {
-			return "", ErrKubeconfigDoesNotExist
-		}
-		return paths[0], nil
+		return "", ErrKubeconfigDoesNotExist
 	}
 
 	// Return the default path
@@ -121,39 +177,104 @@ func DefaultKubeconfigPath() string {
 	return path
 }
 
+// ReadLocalData reads and merges the local kubeconfig files. Each entry
+// records the file it came from, so it can be written back to the same file.
 func ReadLocalData(conf *KitConfig) (*LocalData, error) {
-	path := conf.KubeconfigPath
-	// Sanity check to make sure the path exists
-	if _, err := os.Stat(path); err != nil {
+	paths, err := conf.KubeconfigPaths()
+	if err != nil {
+		return nil, err
+	}
+	// Sanity check to make sure at least one of the files exists. A
+	// kubeconfig directory may be empty.
+	_, exists := conf.KubeconfigDir()
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			exists = true
+			break
+		}
+	}
+	if !exists {
 		return nil, ErrKubeconfigDoesNotExist
 	}
-	// Unmarshal the config
-	data, err := os.ReadFile(path)
+	config, err := loadKubeconfigs(paths)
 	if err != nil {
 		return nil, err
 	}
-	localData := &LocalData{
-		Config: &api.Config{},
+	return &LocalData{
+		Config: config,
+	}, nil
+}
+
+// WriteLocalData writes each entry back to the file it was read from. New
+// entries are written to the kubeconfig target file, or in directory mode,
+// to a new file for each context.
+func WriteLocalData(conf *KitConfig, data *LocalData) error {
+	paths, err := conf.KubeconfigPaths()
+	if err != nil {
+		return err
 	}
-	if err := yaml.Unmarshal(data, localData.Config); err != nil {
-		return nil, err
+	if dir, ok := conf.KubeconfigDir(); ok {
+		return writeKubeconfigs(data.Config, paths, dirTarget(dir, data.Config, paths), true)
 	}
-	return localData, nil
+	return writeKubeconfigs(data.Config, paths, fixedTarget(conf.KubeconfigTargetPath()), false)
 }
 
-func RemoteCacheExists() bool {
-	_, err := os.Stat(RemoteCachePath())
+func RemoteCacheExists(conf *KitConfig) bool {
+	_, err := os.Stat(conf.RemoteCachePath())
 	return err == nil
 }
 
-func ReadRemoteCache() (*RemoteCache, error) {
-	data, err := os.ReadFile(RemoteCachePath())
+func ReadRemoteCache(conf *KitConfig) (*RemoteCache, error) {
+	path := conf.RemoteCachePath()
+	original, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	cache := &RemoteCache{}
-	if err := yaml.Unmarshal(data, cache); err != nil {
+	data := original
+	encrypted := IsEncryptedCache(data)
+	if encrypted {
+		if data, err = DecryptCacheData(data, conf.cacheEncryption()); err != nil {
+			return nil, err
+		}
+	}
+	migrated, upgraded, err := migrate(data, KindRemoteCache, remoteCacheMigrations)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	file := &remoteCacheFile{}
+	if err := unmarshalStrict(migrated, file, path); err != nil {
+		return nil, err
+	}
+	cache := &RemoteCache{
+		TypeMeta: file.TypeMeta,
+		Refused:  file.Refused,
+	}
+	latest, err := fromV1(&file.Latest)
+	if err != nil {
 		return nil, err
 	}
+	cache.Latest = *latest
+	for i := range file.History {
+		config, err := fromV1(&file.History[i])
+		if err != nil {
+			return nil, err
+		}
+		cache.History = append(cache.History, *config)
+	}
+	if !encrypted {
+		// Migrate caches written by older versions of kit in plaintext
+		log.Info("Encrypting plaintext remote cache")
+		// The backup must not contain plaintext credentials either
+		if original, err = EncryptCacheData(original, conf.cacheEncryption()); err != nil {
+			return nil, err
+		}
+		upgraded = true
+	}
+	if upgraded {
+		write := func() error { return cache.WriteToDisk(conf) }
+		if err := replaceMigrated(path, original, write); err != nil {
+			return nil, err
+		}
+	}
 	return cache, nil
 }
@@ -0,0 +1,145 @@
+package machinery
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// lockFile takes the same advisory lock that client-go takes when it writes
+// a kubeconfig (<file>.lock), so kubectl and other kit processes do not write
+// the file at the same time.
+func lockFile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(lockName(path), os.O_CREATE|os.O_EXCL, 0)
+	if err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("%w: %s (if no other kubectl or kit process is running, remove %s)",
+				ErrKubeconfigLocked, path, lockName(path))
+		}
+		return err
+	}
+	return f.Close()
+}
+
+func unlockFile(path string) error {
+	return os.Remove(lockName(path))
+}
+
+func lockName(path string) string {
+	return path + ".lock"
+}
+
+// fileLocks holds the locks of several files.
+type fileLocks struct {
+	paths []string
+}
+
+// lock locks the file. If the path is a symlink, the file it points to is
+// locked as well, since kubectl only locks the path it was given.
+func (l *fileLocks) lock(path string) error {
+	resolved, err := resolvePath(path)
+	if err != nil {
+		return err
+	}
+	for _, path := range []string{path, resolved} {
+		if l.locked(path) {
+			continue
+		}
+		if err := lockFile(path); err != nil {
+			return err
+		}
+		l.paths = append(l.paths, path)
+	}
+	return nil
+}
+
+func (l *fileLocks) locked(path string) bool {
+	for _, locked := range l.paths {
+		if locked == path {
+			return true
+		}
+	}
+	return false
+}
+
+// unlock releases all locks, returning the first error.
+func (l *fileLocks) unlock() error {
+	var err error
+	for _, path := range l.paths {
+		if unlockErr := unlockFile(path); unlockErr != nil && err == nil {
+			err = unlockErr
+		}
+	}
+	l.paths = nil
+	return err
+}
+
+// resolvePath returns the file the path refers to, following symlinks. If the
+// path is a symlink to a file that does not exist yet, the target of the
+// link is returned.
+func resolvePath(path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err == nil {
+		return resolved, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	target, err := os.Readlink(path)
+	if err != nil {
+		// Not a symlink, or does not exist
+		return path, nil
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(path), target)
+	}
+	return target, nil
+}
+
+// writeFileAtomic replaces the contents of a file by writing a temporary file
+// in the same directory and renaming it, so readers never see a partially
+// written file. The mode and ownership of an existing file are preserved. If
+// the path is a symlink, the file it points to is replaced instead of the
+// link.
+func writeFileAtomic(path string, data []byte, defaultMode os.FileMode) error {
+	path, err := resolvePath(path)
+	if err != nil {
+		return err
+	}
+	mode := defaultMode
+	info, err := os.Stat(path)
+	if err == nil {
+		mode = info.Mode().Perm()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	// The temporary file is hidden, so it is never read as a kubeconfig
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	if info != nil {
+		if err := chownLike(tmp.Name(), info); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp.Name(), path)
+}
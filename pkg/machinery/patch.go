@@ -0,0 +1,486 @@
+package machinery
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+// patchKubeconfig applies the changes between a kubeconfig file and its
+// updated contents to the original YAML document. Only the entries and
+// top-level fields that changed are rewritten; everything else, including
+// comments, key order and fields that client-go does not know about, is kept
+// byte for byte.
+//
+// Changes are computed as a three-way merge between the original document,
+// the original document as client-go would write it (the base), and the
+// updated config as client-go would write it. Keys that are not in the base
+// are unknown to client-go and are never removed.
+func patchKubeconfig(original []byte, updated *api.Config) ([]byte, error) {
+	fresh, err := clientcmd.Write(*updated)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(original, &doc); err != nil || len(doc.Content) != 1 ||
+		doc.Content[0].Kind != yaml.MappingNode || doc.Content[0].Style&yaml.FlowStyle != 0 {
+		// Empty, or JSON, which has no comments to preserve
+		return fresh, nil
+	}
+	originalConfig, err := clientcmd.Load(original)
+	if err != nil {
+		return nil, err
+	}
+	baseData, err := clientcmd.Write(*originalConfig)
+	if err != nil {
+		return nil, err
+	}
+	base, err := parseMapping(baseData)
+	if err != nil {
+		return nil, err
+	}
+	next, err := parseMapping(fresh)
+	if err != nil {
+		return nil, err
+	}
+
+	root := doc.Content[0]
+	p := &patcher{
+		lines: strings.SplitAfter(string(original), "\n"),
+	}
+	p.compact = p.usesCompactSequences(root)
+	for i := 0; i < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		start, end := p.keySpan(root, i)
+		baseValue := mappingValue(base, key.Value)
+		nextValue := mappingValue(next, key.Value)
+		switch {
+		case nextValue == nil && baseValue == nil:
+			// Unknown to client-go
+		case nextValue == nil:
+			p.replace(start, end, "")
+		case baseValue != nil && nodesEqual(baseValue, nextValue):
+		case value.Kind == yaml.SequenceNode && value.Style&yaml.FlowStyle == 0 &&
+			nextValue.Kind == yaml.SequenceNode && namedItems(value):
+			if !p.patchSequence(value, baseValue, nextValue, end) {
+				p.replace(start, end, p.renderPair(key, patchNode(value, baseValue, nextValue)))
+			}
+		default:
+			p.replace(start, end, p.renderPair(key, patchNode(value, baseValue, nextValue)))
+		}
+	}
+	// Fields that were not in the original document
+	for i := 0; i < len(next.Content); i += 2 {
+		key, value := next.Content[i], next.Content[i+1]
+		if mappingValue(root, key.Value) != nil || isEmptyNode(value) {
+			continue
+		}
+		p.insert(len(p.lines), p.renderPair(key, value))
+	}
+	return p.apply()
+}
+
+type lineEdit struct {
+	start, end int
+	text       string
+}
+
+// patcher collects edits to whole lines of the original document.
+type patcher struct {
+	lines []string
+	edits []lineEdit
+	// Whether sequences in mappings are written without indentation, like
+	// kubectl does
+	compact bool
+	// First error encountered while rendering an edit
+	err error
+}
+
+func (p *patcher) replace(start, end int, text string) {
+	p.edits = append(p.edits, lineEdit{start: start, end: end, text: text})
+}
+
+func (p *patcher) insert(at int, text string) {
+	p.replace(at, at, text)
+}
+
+func (p *patcher) apply() ([]byte, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	sort.SliceStable(p.edits, func(i, j int) bool {
+		return p.edits[i].start < p.edits[j].start
+	})
+	var out bytes.Buffer
+	line := 0
+	for _, edit := range p.edits {
+		for ; line < edit.start; line++ {
+			out.WriteString(p.lines[line])
+		}
+		if out.Len() > 0 && !bytes.HasSuffix(out.Bytes(), []byte("\n")) {
+			out.WriteString("\n")
+		}
+		out.WriteString(edit.text)
+		if edit.end > line {
+			line = edit.end
+		}
+	}
+	for ; line < len(p.lines); line++ {
+		out.WriteString(p.lines[line])
+	}
+	return out.Bytes(), nil
+}
+
+// keySpan returns the lines holding the i'th key of a mapping and its value,
+// including the comments directly above the key.
+func (p *patcher) keySpan(mapping *yaml.Node, i int) (int, int) {
+	key := mapping.Content[i]
+	indent := key.Column - 1
+	start := p.leadingComments(key.Line-1, indent)
+	next := len(p.lines)
+	if i+2 < len(mapping.Content) {
+		nextKey := mapping.Content[i+2]
+		next = p.leadingComments(nextKey.Line-1, nextKey.Column-1)
+	}
+	return start, p.contentEnd(start, next, indent)
+}
+
+// patchSequence patches the items of a block sequence in place, matching
+// items by name. It returns false if the layout of the sequence is not
+// understood.
+func (p *patcher) patchSequence(seq, base, next *yaml.Node, end int) bool {
+	type item struct {
+		node       *yaml.Node
+		start, end int
+	}
+	items := make([]item, len(seq.Content))
+	dash := -1
+	for i, node := range seq.Content {
+		indent := strings.LastIndex(p.lines[node.Line-1][:node.Column-1], "-")
+		if indent < 0 || (dash >= 0 && indent != dash) {
+			return false
+		}
+		dash = indent
+		items[i] = item{node: node, start: p.leadingComments(node.Line-1, indent)}
+	}
+	for i := range items {
+		next := end
+		if i+1 < len(items) {
+			next = items[i+1].start
+		}
+		items[i].end = p.contentEnd(items[i].start, next, dash)
+	}
+
+	for _, it := range items {
+		name := itemName(it.node)
+		nextItem := namedItem(next, name)
+		baseItem := namedItem(base, name)
+		switch {
+		case nextItem == nil && baseItem != nil:
+			p.replace(it.start, it.end, "")
+		case nextItem == nil:
+			// Unknown to client-go, e.g. a duplicate name
+		case baseItem != nil && nodesEqual(baseItem, nextItem):
+		default:
+			p.replace(it.start, it.end, p.renderItem(patchNode(it.node, baseItem, nextItem), dash))
+		}
+	}
+	insertAt := items[len(items)-1].end
+	for _, node := range next.Content {
+		if namedItem(seq, itemName(node)) == nil {
+			p.insert(insertAt, p.renderItem(node, dash))
+		}
+	}
+	return true
+}
+
+// leadingComments returns the first line of the comment block directly above
+// the given line, considering only comments indented at most as far as the
+// given indentation.
+func (p *patcher) leadingComments(line, indent int) int {
+	for line > 0 && isCommentLine(p.lines[line-1], indent) {
+		line--
+	}
+	return line
+}
+
+// contentEnd returns the end of the content between start and next. Trailing
+// blank lines, and comments that are not indented past the given indentation,
+// are not part of the content.
+func (p *patcher) contentEnd(start, next, indent int) int {
+	end := next
+	for end > start+1 {
+		line := p.lines[end-1]
+		if strings.TrimSpace(line) != "" && !isCommentLine(line, indent) {
+			break
+		}
+		end--
+	}
+	return end
+}
+
+func isCommentLine(line string, indent int) bool {
+	trimmed := strings.TrimLeft(line, " \t")
+	return strings.HasPrefix(trimmed, "#") && len(line)-len(trimmed) <= indent
+}
+
+func (p *patcher) renderPair(key, value *yaml.Node) string {
+	return p.render(&yaml.Node{
+		Kind:    yaml.MappingNode,
+		Content: []*yaml.Node{key, value},
+	}, 0)
+}
+
+func (p *patcher) renderItem(node *yaml.Node, indent int) string {
+	return p.render(&yaml.Node{
+		Kind:    yaml.SequenceNode,
+		Content: []*yaml.Node{node},
+	}, indent)
+}
+
+// render encodes a node, indenting every line by the given amount.
+func (p *patcher) render(node *yaml.Node, indent int) string {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(node); err != nil {
+		if p.err == nil {
+			p.err = err
+		}
+		return ""
+	}
+	enc.Close()
+	text := buf.String()
+	if p.compact {
+		text = compactSequences(text)
+	}
+	if indent == 0 {
+		return text
+	}
+	prefix := strings.Repeat(" ", indent)
+	lines := strings.SplitAfter(text, "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = prefix + line
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+// usesCompactSequences reports whether the first block sequence in the
+// document is indented at the same level as its key. Documents without one
+// are assumed to be written by kubectl.
+func (p *patcher) usesCompactSequences(root *yaml.Node) bool {
+	for i := 1; i < len(root.Content); i += 2 {
+		key, value := root.Content[i-1], root.Content[i]
+		if value.Kind != yaml.SequenceNode || value.Style&yaml.FlowStyle != 0 || len(value.Content) == 0 {
+			continue
+		}
+		item := value.Content[0]
+		dash := strings.LastIndex(p.lines[item.Line-1][:item.Column-1], "-")
+		return dash == key.Column-1
+	}
+	return true
+}
+
+// compactSequences removes the indentation of block sequences that are the
+// value of a mapping key, which the yaml encoder always adds.
+func compactSequences(text string) string {
+	lines := strings.SplitAfter(text, "\n")
+	// Indentation of the keys whose sequences are being dedented
+	var keys []int
+	for i, line := range lines {
+		trimmed := strings.TrimLeft(line, " ")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		indent := len(line) - len(trimmed)
+		comment := strings.HasPrefix(trimmed, "#")
+		for !comment && len(keys) > 0 && indent <= keys[len(keys)-1] {
+			keys = keys[:len(keys)-1]
+		}
+		shift := 2 * len(keys)
+		if shift > indent {
+			shift = indent
+		}
+		lines[i] = line[shift:]
+
+		// A key without a value on its line, followed by a sequence
+		keyIndent := indent
+		for strings.HasPrefix(trimmed, "- ") {
+			trimmed = trimmed[2:]
+			keyIndent += 2
+		}
+		if comment || !strings.HasSuffix(strings.TrimRight(trimmed, " \r\n"), ":") {
+			continue
+		}
+		for _, next := range lines[i+1:] {
+			if strings.TrimSpace(next) == "" || strings.HasPrefix(strings.TrimLeft(next, " "), "#") {
+				continue
+			}
+			if strings.HasPrefix(next, strings.Repeat(" ", keyIndent+2)+"- ") {
+				keys = append(keys, keyIndent)
+			}
+			break
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+// patchNode merges the changes from base to next into orig.
+func patchNode(orig, base, next *yaml.Node) *yaml.Node {
+	if base != nil && nodesEqual(base, next) {
+		return orig
+	}
+	switch {
+	case orig.Kind == yaml.MappingNode && next.Kind == yaml.MappingNode:
+		for i := 0; i < len(next.Content); i += 2 {
+			key, value := next.Content[i], next.Content[i+1]
+			baseValue := mappingValue(base, key.Value)
+			if origValue := mappingValue(orig, key.Value); origValue != nil {
+				setMappingValue(orig, key.Value, patchNode(origValue, baseValue, value))
+			} else if baseValue == nil || !nodesEqual(baseValue, value) {
+				// Defaults that were left out of the original stay out
+				orig.Content = append(orig.Content, key, value)
+			}
+		}
+		if base != nil && base.Kind == yaml.MappingNode {
+			for i := 0; i < len(base.Content); i += 2 {
+				if key := base.Content[i].Value; mappingValue(next, key) == nil {
+					deleteMappingValue(orig, key)
+				}
+			}
+		}
+		return orig
+	case orig.Kind == yaml.SequenceNode && next.Kind == yaml.SequenceNode && namedItems(orig) && namedItems(next):
+		var content []*yaml.Node
+		for _, item := range orig.Content {
+			name := itemName(item)
+			if nextItem := namedItem(next, name); nextItem != nil {
+				content = append(content, patchNode(item, namedItem(base, name), nextItem))
+			} else if namedItem(base, name) == nil {
+				content = append(content, item)
+			}
+		}
+		for _, item := range next.Content {
+			if namedItem(orig, itemName(item)) == nil {
+				content = append(content, item)
+			}
+		}
+		orig.Content = content
+		return orig
+	}
+	out := *next
+	out.HeadComment = orig.HeadComment
+	out.LineComment = orig.LineComment
+	out.FootComment = orig.FootComment
+	if orig.Kind == yaml.ScalarNode && next.Kind == yaml.ScalarNode {
+		out.Style = orig.Style
+	}
+	return &out
+}
+
+func parseMapping(data []byte) (*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return &yaml.Node{Kind: yaml.MappingNode}, nil
+	}
+	return doc.Content[0], nil
+}
+
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	if mapping == nil || mapping.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func setMappingValue(mapping *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			mapping.Content[i+1] = value
+			return
+		}
+	}
+}
+
+func deleteMappingValue(mapping *yaml.Node, key string) {
+	for i := 0; i < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			mapping.Content = append(mapping.Content[:i], mapping.Content[i+2:]...)
+			return
+		}
+	}
+}
+
+// namedItems reports whether every item of a sequence is a mapping with a
+// name, like the clusters, users and contexts of a kubeconfig.
+func namedItems(seq *yaml.Node) bool {
+	if len(seq.Content) == 0 {
+		return false
+	}
+	for _, item := range seq.Content {
+		if itemName(item) == "" {
+			return false
+		}
+	}
+	return true
+}
+
+func itemName(item *yaml.Node) string {
+	if name := mappingValue(item, "name"); name != nil && name.Kind == yaml.ScalarNode {
+		return name.Value
+	}
+	return ""
+}
+
+func namedItem(seq *yaml.Node, name string) *yaml.Node {
+	if seq == nil || seq.Kind != yaml.SequenceNode {
+		return nil
+	}
+	for _, item := range seq.Content {
+		if itemName(item) == name {
+			return item
+		}
+	}
+	return nil
+}
+
+// nodesEqual compares the contents of two nodes, ignoring style, comments
+// and positions.
+func nodesEqual(a, b *yaml.Node) bool {
+	if a.Kind != b.Kind || a.Value != b.Value || len(a.Content) != len(b.Content) {
+		return false
+	}
+	if a.Kind == yaml.ScalarNode && a.ShortTag() != b.ShortTag() {
+		return false
+	}
+	for i := range a.Content {
+		if !nodesEqual(a.Content[i], b.Content[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isEmptyNode(node *yaml.Node) bool {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return node.ShortTag() == "!!null" || node.Value == ""
+	case yaml.MappingNode, yaml.SequenceNode:
+		return len(node.Content) == 0
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package machinery_test
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+
+	"github.com/kralicky/kit/pkg/machinery"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden files")
+
+var _ = Describe("Kubeconfig patching", func() {
+	var dir, file string
+	var config *machinery.KitConfig
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "kit-patch")
+		Expect(err).NotTo(HaveOccurred())
+		input, err := os.ReadFile(filepath.Join("testdata", "patch", "input.yaml"))
+		Expect(err).NotTo(HaveOccurred())
+		file = filepath.Join(dir, "config")
+		Expect(os.WriteFile(file, input, 0600)).To(Succeed())
+		config = &machinery.KitConfig{
+			KubeconfigPath: file,
+		}
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	DescribeTable("should only rewrite changed entries",
+		func(name string, modify func(*api.Config)) {
+			local, err := machinery.ReadLocalData(config)
+			Expect(err).NotTo(HaveOccurred())
+			modify(local.Config)
+			Expect(machinery.WriteLocalData(config, local)).To(Succeed())
+			written, err := os.ReadFile(file)
+			Expect(err).NotTo(HaveOccurred())
+
+			golden := filepath.Join("testdata", "patch", name+".golden.yaml")
+			if *updateGolden {
+				Expect(os.WriteFile(golden, written, 0644)).To(Succeed())
+			}
+			expected, err := os.ReadFile(golden)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(written)).To(Equal(string(expected)))
+
+			// The patched file must decode to the same config
+			reread, err := machinery.ReadLocalData(config)
+			Expect(err).NotTo(HaveOccurred())
+			diff, err := machinery.ComputeDiff(local.Config, reread.Config)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(diff.Items).To(BeEmpty())
+		},
+		Entry("modified cluster", "modify-cluster", func(c *api.Config) {
+			c.Clusters["prod"].Server = "https://prod-2.example.com:6443"
+		}),
+		Entry("modified exec user", "modify-exec", func(c *api.Config) {
+			c.AuthInfos["prod-admin"].Exec.Args[3] = "prod-2"
+		}),
+		Entry("new context", "add-context", func(c *api.Config) {
+			c.Clusters["staging"] = &api.Cluster{
+				Server: "https://staging.example.com:6443",
+			}
+			c.AuthInfos["staging-admin"] = &api.AuthInfo{
+				Token: "staging-token",
+			}
+			c.Contexts["staging"] = &api.Context{
+				Cluster:  "staging",
+				AuthInfo: "staging-admin",
+			}
+		}),
+		Entry("deleted context", "delete-context", func(c *api.Config) {
+			delete(c.Contexts, "dev")
+			delete(c.Clusters, "dev")
+			delete(c.AuthInfos, "dev-admin")
+		}),
+		Entry("modified context", "modify-context", func(c *api.Config) {
+			c.Contexts["dev"].Namespace = "kube-system"
+		}),
+	)
+})
@@ -0,0 +1,95 @@
+package machinery
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+type PolicyAccess string
+
+const (
+	// Members can fetch and pull the matching contexts
+	PolicyAccessRead PolicyAccess = "read"
+
+	// Members can additionally push changes to the matching contexts
+	PolicyAccessPush PolicyAccess = "push"
+)
+
+// PolicyGroup describes a set of contexts (by name glob) that a Vault policy
+// should grant access to.
+type PolicyGroup struct {
+	Name     string
+	Contexts []string
+	Access   PolicyAccess
+}
+
+var policyCapabilities = map[PolicyAccess]struct {
+	Data     []string
+	Metadata []string
+}{
+	PolicyAccessRead: {
+		Data:     []string{"read"},
+		Metadata: []string{"read", "list"},
+	},
+	PolicyAccessPush: {
+		Data:     []string{"create", "read", "update"},
+		Metadata: []string{"read", "list", "delete"},
+	},
+}
+
+func GeneratePolicy(group PolicyGroup, paths KVPaths) (string, error) {
+	if group.Name == "" {
+		return "", ErrInvalidPolicyName
+	}
+	caps, ok := policyCapabilities[group.Access]
+	if !ok {
+		return "", fmt.Errorf("%w: %q", ErrInvalidPolicyAccess, group.Access)
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# kit policy %q (%s)\n", group.Name, group.Access)
+
+	// Listing the secret path is required to discover which contexts exist
+	writePolicyPath(&sb, paths.List(), []string{"list"})
+	for _, glob := range group.Contexts {
+		if err := validatePolicyGlob(glob); err != nil {
+			return "", err
+		}
+		// Escape the glob the same way context names are, keeping the
+		// trailing wildcard
+		segment := escapeName(glob)
+		if prefix := strings.TrimSuffix(glob, "*"); prefix != glob {
+			segment = url.PathEscape(prefix) + "*"
+		}
+		writePolicyPath(&sb, paths.dataPath(segment), caps.Data)
+		if metadata := paths.metadataPath(segment); metadata != "" {
+			writePolicyPath(&sb, metadata, caps.Metadata)
+		}
+	}
+	return sb.String(), nil
+}
+
+func (r *RemoteClient) WritePolicy(group PolicyGroup) error {
+	rules, err := GeneratePolicy(group, r.Paths)
+	if err != nil {
+		return err
+	}
+	return r.checkAuth(r.VaultClient.Sys().PutPolicy(group.Name, rules))
+}
+
+func writePolicyPath(sb *strings.Builder, path string, capabilities []string) {
+	quoted := make([]string, len(capabilities))
+	for i, c := range capabilities {
+		quoted[i] = fmt.Sprintf("%q", c)
+	}
+	fmt.Fprintf(sb, "\npath %q {\n  capabilities = [%s]\n}\n",
+		path, strings.Join(quoted, ", "))
+}
+
+func validatePolicyGlob(glob string) error {
+	// Vault only supports a glob character at the end of a policy path
+	if glob == "" || strings.Contains(strings.TrimSuffix(glob, "*"), "*") {
+		return fmt.Errorf("%w: %q", ErrInvalidPolicyGlob, glob)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package machinery_test
+
+import (
+	"github.com/kralicky/kit/pkg/machinery"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Policy", func() {
+	defaultPaths := (&machinery.KitConfig{}).KVPaths()
+	It("should generate a read-only policy", func() {
+		policy, err := machinery.GeneratePolicy(machinery.PolicyGroup{
+			Name:     "support",
+			Contexts: []string{"prod-*"},
+			Access:   machinery.PolicyAccessRead,
+		}, defaultPaths)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(policy).To(Equal(`# kit policy "support" (read)
+
+path "kit/metadata/" {
+  capabilities = ["list"]
+}
+
+path "kit/data/prod-*" {
+  capabilities = ["read"]
+}
+
+path "kit/metadata/prod-*" {
+  capabilities = ["read", "list"]
+}
+`))
+	})
+	It("should generate a push policy", func() {
+		policy, err := machinery.GeneratePolicy(machinery.PolicyGroup{
+			Name:     "platform",
+			Contexts: []string{"prod-*", "staging"},
+			Access:   machinery.PolicyAccessPush,
+		}, defaultPaths)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(policy).To(ContainSubstring(`path "kit/data/prod-*" {
+  capabilities = ["create", "read", "update"]
+}`))
+		Expect(policy).To(ContainSubstring(`path "kit/metadata/staging" {
+  capabilities = ["read", "list", "delete"]
+}`))
+	})
+	It("should generate a policy for a kv v1 mount", func() {
+		paths := (&machinery.KitConfig{
+			MountPath:  "secret",
+			SecretPath: "teams/platform",
+			KVVersion:  1,
+		}).KVPaths()
+		policy, err := machinery.GeneratePolicy(machinery.PolicyGroup{
+			Name:     "support",
+			Contexts: []string{"prod-*"},
+			Access:   machinery.PolicyAccessRead,
+		}, paths)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(policy).To(Equal(`# kit policy "support" (read)
+
+path "secret/teams/platform/" {
+  capabilities = ["list"]
+}
+
+path "secret/teams/platform/prod-*" {
+  capabilities = ["read"]
+}
+`))
+	})
+	It("should escape context names in policy paths", func() {
+		policy, err := machinery.GeneratePolicy(machinery.PolicyGroup{
+			Name:     "eks",
+			Contexts: []string{"arn:aws:eks:us-east-1:1234:cluster/*", "team/dev"},
+			Access:   machinery.PolicyAccessRead,
+		}, defaultPaths)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(policy).To(ContainSubstring(`path "kit/data/arn:aws:eks:us-east-1:1234:cluster%2F*"`))
+		Expect(policy).To(ContainSubstring(`path "kit/metadata/team%2Fdev"`))
+	})
+	It("should reject unsupported globs", func() {
+		_, err := machinery.GeneratePolicy(machinery.PolicyGroup{
+			Name:     "bad",
+			Contexts: []string{"*-prod"},
+			Access:   machinery.PolicyAccessRead,
+		}, defaultPaths)
+		Expect(err).To(MatchError(machinery.ErrInvalidPolicyGlob))
+	})
+	It("should reject unknown access levels", func() {
+		_, err := machinery.GeneratePolicy(machinery.PolicyGroup{
+			Name:     "bad",
+			Contexts: []string{"*"},
+			Access:   "admin",
+		}, defaultPaths)
+		Expect(err).To(MatchError(machinery.ErrInvalidPolicyAccess))
+	})
+})
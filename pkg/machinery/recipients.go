@@ -0,0 +1,202 @@
+package machinery
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Recipient is a named X25519 public key that contexts can be shared with.
+type Recipient struct {
+	Name      string `json:"name"`
+	PublicKey string `json:"publicKey"`
+}
+
+// Identity is the local X25519 key pair used to open contexts shared with
+// this user.
+type Identity struct {
+	PublicKey  *[32]byte
+	PrivateKey *[32]byte
+}
+
+func GenerateIdentity() (*Identity, error) {
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{
+		PublicKey:  pub,
+		PrivateKey: priv,
+	}, nil
+}
+
+func LoadIdentity(path string) (*Identity, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := decodeKey(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity file %s: %w", path, err)
+	}
+	pub := new([32]byte)
+	// The public key is derived from the private key
+	curve25519.ScalarBaseMult(pub, priv)
+	return &Identity{
+		PublicKey:  pub,
+		PrivateKey: priv,
+	}, nil
+}
+
+func (i *Identity) WriteToDisk(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(encodeKey(i.PrivateKey)+"\n"), 0400)
+}
+
+// Recipient returns the encoded public key that others can share contexts to.
+func (i *Identity) Recipient() string {
+	return encodeKey(i.PublicKey)
+}
+
+func DefaultIdentityPath(home string) string {
+	return filepath.Join(home, "identity")
+}
+
+// SealContext encrypts a serialized context so that only the given recipients
+// can open it. The context is encrypted with a random data key, which is then
+// sealed to each recipient's public key.
+func SealContext(kubeconfig []byte, recipients []string) (map[string]interface{}, error) {
+	if len(recipients) == 0 {
+		return nil, ErrNoRecipients
+	}
+	var dataKey [32]byte
+	if _, err := io.ReadFull(rand.Reader, dataKey[:]); err != nil {
+		return nil, err
+	}
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+	sealedKeys := map[string]interface{}{}
+	for _, recipient := range recipients {
+		pub, err := decodeKey(recipient)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recipient %q: %w", recipient, err)
+		}
+		sealedKey, err := box.SealAnonymous(nil, dataKey[:], pub, rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		sealedKeys[encodeKey(pub)] = base64.StdEncoding.EncodeToString(sealedKey)
+	}
+	sealed := secretbox.Seal(nonce[:], kubeconfig, &nonce, &dataKey)
+	return map[string]interface{}{
+		"sealed":     base64.StdEncoding.EncodeToString(sealed),
+		"recipients": sealedKeys,
+	}, nil
+}
+
+// OpenContext decrypts a context sealed with SealContext. It returns
+// ErrNotARecipient if the context was not shared with the identity.
+func OpenContext(data map[string]interface{}, identity *Identity) ([]byte, error) {
+	if identity == nil {
+		return nil, ErrNotARecipient
+	}
+	sealedKeys, _ := data["recipients"].(map[string]interface{})
+	encodedKey, ok := sealedKeys[identity.Recipient()].(string)
+	if !ok {
+		return nil, ErrNotARecipient
+	}
+	sealedKey, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := box.OpenAnonymous(nil, sealedKey, identity.PublicKey, identity.PrivateKey)
+	if !ok || len(key) != 32 {
+		return nil, ErrSealedDataInvalid
+	}
+	var dataKey [32]byte
+	copy(dataKey[:], key)
+	encoded, _ := data["sealed"].(string)
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < 24 {
+		return nil, ErrSealedDataInvalid
+	}
+	var nonce [24]byte
+	copy(nonce[:], sealed)
+	plaintext, ok := secretbox.Open(nil, sealed[24:], &nonce, &dataKey)
+	if !ok {
+		return nil, ErrSealedDataInvalid
+	}
+	return plaintext, nil
+}
+
+// SealedRecipients returns the public keys a sealed context was shared with.
+func SealedRecipients(data map[string]interface{}) []string {
+	sealedKeys, _ := data["recipients"].(map[string]interface{})
+	keys := make([]string, 0, len(sealedKeys))
+	for key := range sealedKeys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func isSealed(data map[string]interface{}) bool {
+	_, ok := data["sealed"]
+	return ok
+}
+
+// ResolveRecipient looks up a recipient by name in the kit config, or
+// otherwise parses it as an encoded public key.
+func (c *KitConfig) ResolveRecipient(nameOrKey string) (string, error) {
+	for _, r := range c.Recipients {
+		if r.Name == nameOrKey {
+			nameOrKey = r.PublicKey
+			break
+		}
+	}
+	key, err := decodeKey(nameOrKey)
+	if err != nil {
+		return "", fmt.Errorf("%w: %q", ErrUnknownRecipient, nameOrKey)
+	}
+	return encodeKey(key), nil
+}
+
+func (c *KitConfig) IdentityPath() string {
+	if c.IdentityFile != "" {
+		return c.IdentityFile
+	}
+	return DefaultIdentityPath(c.Home())
+}
+
+func encodeKey(key *[32]byte) string {
+	return base64.StdEncoding.EncodeToString(key[:])
+}
+
+func decodeKey(s string) (*[32]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != 32 {
+		return nil, fmt.Errorf("expected a 32 byte key, got %d bytes", len(data))
+	}
+	key := new([32]byte)
+	copy(key[:], data)
+	return key, nil
+}
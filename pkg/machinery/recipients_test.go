@@ -0,0 +1,70 @@
+package machinery_test
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/kralicky/kit/pkg/machinery"
+)
+
+var _ = Describe("Recipients", func() {
+	var alice, bob, mallory *machinery.Identity
+	BeforeEach(func() {
+		var err error
+		alice, err = machinery.GenerateIdentity()
+		Expect(err).NotTo(HaveOccurred())
+		bob, err = machinery.GenerateIdentity()
+		Expect(err).NotTo(HaveOccurred())
+		mallory, err = machinery.GenerateIdentity()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should only allow recipients to open a sealed context", func() {
+		plaintext := []byte("sample kubeconfig")
+		data, err := machinery.SealContext(plaintext, []string{alice.Recipient(), bob.Recipient()})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(machinery.SealedRecipients(data)).To(ConsistOf(alice.Recipient(), bob.Recipient()))
+
+		for _, identity := range []*machinery.Identity{alice, bob} {
+			opened, err := machinery.OpenContext(data, identity)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(opened).To(Equal(plaintext))
+		}
+		_, err = machinery.OpenContext(data, mallory)
+		Expect(err).To(MatchError(machinery.ErrNotARecipient))
+		_, err = machinery.OpenContext(data, nil)
+		Expect(err).To(MatchError(machinery.ErrNotARecipient))
+	})
+	It("should require at least one recipient", func() {
+		_, err := machinery.SealContext([]byte("x"), nil)
+		Expect(err).To(MatchError(machinery.ErrNoRecipients))
+	})
+	It("should save and load identities", func() {
+		dir, err := os.MkdirTemp("", "kit-identity")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "identity")
+		Expect(alice.WriteToDisk(path)).To(Succeed())
+		loaded, err := machinery.LoadIdentity(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(loaded).To(Equal(alice))
+	})
+	It("should resolve recipients by name or public key", func() {
+		config := &machinery.KitConfig{
+			Recipients: []machinery.Recipient{
+				{Name: "bob", PublicKey: bob.Recipient()},
+			},
+		}
+		key, err := config.ResolveRecipient("bob")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(key).To(Equal(bob.Recipient()))
+		key, err = config.ResolveRecipient(alice.Recipient())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(key).To(Equal(alice.Recipient()))
+		_, err = config.ResolveRecipient("carol")
+		Expect(err).To(MatchError(machinery.ErrUnknownRecipient))
+	})
+})
@@ -0,0 +1,232 @@
+package machinery
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+const redactedPrefix = "REDACTED "
+
+// Auth provider config keys and exec flags that hold credentials
+var secretKeys = []string{"token", "secret", "password", "key"}
+
+// Fingerprint returns a short identifier for a value that can be printed in
+// place of the value itself.
+func Fingerprint(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])[:12]
+}
+
+// AuthInfoFingerprint returns a fingerprint of all fields of an auth info,
+// so changes to its credentials can be shown without printing them.
+func AuthInfoFingerprint(authInfo *api.AuthInfo) string {
+	if authInfo == nil {
+		return ""
+	}
+	data, err := json.Marshal(authInfo)
+	if err != nil {
+		return ""
+	}
+	return Fingerprint(data)
+}
+
+// Redact returns a copy of the config with all credentials replaced by their
+// fingerprints, which is safe to print or log. Extensions are dropped, since
+// their contents are unknown.
+func Redact(config *api.Config) *api.Config {
+	out := config.DeepCopy()
+	out.Extensions = nil
+	out.Preferences.Extensions = nil
+	for _, cluster := range out.Clusters {
+		cluster.ProxyURL = redactURL(cluster.ProxyURL)
+		cluster.Extensions = nil
+	}
+	for _, context := range out.Contexts {
+		context.Extensions = nil
+	}
+	for _, authInfo := range out.AuthInfos {
+		authInfo.Extensions = nil
+		authInfo.ClientKeyData = redactBytes(authInfo.ClientKeyData)
+		authInfo.Token = redactString(authInfo.Token)
+		authInfo.Password = redactString(authInfo.Password)
+		if authInfo.AuthProvider != nil {
+			for k, v := range authInfo.AuthProvider.Config {
+				if isSecretKey(k) {
+					authInfo.AuthProvider.Config[k] = redactString(v)
+				}
+			}
+		}
+		if authInfo.Exec != nil {
+			redactArgs(authInfo.Exec.Args)
+			for i := range authInfo.Exec.Env {
+				authInfo.Exec.Env[i].Value = redactString(authInfo.Exec.Env[i].Value)
+			}
+		}
+	}
+	return out
+}
+
+// FormatConfig renders a redacted, human readable summary of each context in
+// the config, sorted by name.
+func FormatConfig(config *api.Config) string {
+	config = Redact(config)
+	names := make([]string, 0, len(config.Contexts))
+	for name := range config.Contexts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		context := config.Contexts[name]
+		fmt.Fprintf(&b, "context: %s\n", name)
+		fmt.Fprintf(&b, "  cluster: %s\n", context.Cluster)
+		if cluster, ok := config.Clusters[context.Cluster]; ok {
+			writeField(&b, "server", cluster.Server)
+			writeField(&b, "certificate-authority-data", Fingerprint(cluster.CertificateAuthorityData))
+		}
+		fmt.Fprintf(&b, "  user: %s\n", context.AuthInfo)
+		if authInfo, ok := config.AuthInfos[context.AuthInfo]; ok {
+			writeField(&b, "client-certificate-data", Fingerprint(authInfo.ClientCertificateData))
+			writeField(&b, "client-key-data", string(authInfo.ClientKeyData))
+			writeField(&b, "token", authInfo.Token)
+			writeField(&b, "username", authInfo.Username)
+			writeField(&b, "password", authInfo.Password)
+			if authInfo.AuthProvider != nil {
+				writeField(&b, "auth-provider", authInfo.AuthProvider.Name)
+			}
+			if authInfo.Exec != nil {
+				writeField(&b, "exec", authInfo.Exec.Command)
+				for _, env := range authInfo.Exec.Env {
+					writeField(&b, "  "+env.Name, env.Value)
+				}
+			}
+		}
+	}
+	return b.String()
+}
+
+// FormatDiffItem describes a diff item in a single line. Credentials are
+// shown as fingerprints so that changes remain visible.
+func FormatDiffItem(item DiffItem, existing, incoming *api.Config) string {
+	out := formatChange(item, existing, incoming)
+	if item.ChangeType&ChangeTypeAmbiguous != 0 {
+		names := make([]string, len(item.Candidates))
+		for i, candidate := range item.Candidates {
+			names[i] = candidate.Name
+		}
+		out += fmt.Sprintf(" (ambiguous, could be any of %s)", strings.Join(names, ", "))
+	}
+	return out
+}
+
+func formatChange(item DiffItem, existing, incoming *api.Config) string {
+	existingName := item.AffectedExisting.Name
+	incomingName := item.AffectedIncoming.Name
+	switch {
+	case item.ChangeType&ChangeTypeNew != 0:
+		if item.Complex&ComplexDiffRenameRequired != 0 {
+			return fmt.Sprintf("new     %s (name conflicts with an existing context)", incomingName)
+		}
+		return fmt.Sprintf("new     %s", incomingName)
+	case item.ChangeType&ChangeTypeRename != 0:
+		return fmt.Sprintf("rename  %s -> %s", existingName, incomingName)
+	case item.ChangeType&ChangeTypeDelete != 0:
+		return fmt.Sprintf("delete  %s", existingName)
+	case item.ChangeType&ChangeTypeReplace != 0:
+		return fmt.Sprintf("replace %s -> %s", existingName, incomingName)
+	case item.ChangeType&ChangeTypeModify != 0:
+		var changes []string
+		existingCluster := existing.Clusters[item.AffectedExisting.Cluster]
+		incomingCluster := incoming.Clusters[item.AffectedIncoming.Cluster]
+		if item.Complex&ComplexDiffServerChanged != 0 && existingCluster != nil && incomingCluster != nil {
+			changes = append(changes, fmt.Sprintf("server %s -> %s",
+				existingCluster.Server, incomingCluster.Server))
+		}
+		if item.Complex&ComplexDiffClusterCAChanged != 0 && existingCluster != nil && incomingCluster != nil {
+			changes = append(changes, fmt.Sprintf("ca %s -> %s",
+				Fingerprint(existingCluster.CertificateAuthorityData),
+				Fingerprint(incomingCluster.CertificateAuthorityData)))
+		}
+		if item.Complex&ComplexDiffUserAuthChanged != 0 {
+			changes = append(changes, fmt.Sprintf("user %s -> %s",
+				AuthInfoFingerprint(existing.AuthInfos[item.AffectedExisting.AuthInfo]),
+				AuthInfoFingerprint(incoming.AuthInfos[item.AffectedIncoming.AuthInfo])))
+		}
+		return fmt.Sprintf("modify  %s: %s", existingName, strings.Join(changes, ", "))
+	}
+	return fmt.Sprintf("unknown change to %s", existingName)
+}
+
+func redactString(s string) string {
+	if s == "" {
+		return ""
+	}
+	return redactedPrefix + Fingerprint([]byte(s))
+}
+
+func redactBytes(data []byte) []byte {
+	if len(data) == 0 {
+		return nil
+	}
+	return []byte(redactedPrefix + Fingerprint(data))
+}
+
+// redactURL redacts the userinfo of a URL. URLs that cannot be parsed are
+// redacted entirely.
+func redactURL(s string) string {
+	if s == "" {
+		return ""
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return redactString(s)
+	}
+	if u.User != nil {
+		u.User = url.User(strings.TrimSpace(redactedPrefix))
+	}
+	return u.String()
+}
+
+// redactArgs redacts the values of credential flags in place, both in the
+// "--token=value" and "--token value" forms, and "key=value" arguments with
+// a credential key.
+func redactArgs(args []string) {
+	for i, arg := range args {
+		if eq := strings.Index(arg, "="); eq > 0 {
+			if isSecretKey(arg[:eq]) {
+				args[i] = arg[:eq+1] + redactString(arg[eq+1:])
+			}
+			continue
+		}
+		if strings.HasPrefix(arg, "-") && isSecretKey(arg) &&
+			i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+			args[i+1] = redactString(args[i+1])
+		}
+	}
+}
+
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range secretKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeField(b *strings.Builder, name, value string) {
+	if value != "" {
+		fmt.Fprintf(b, "    %s: %s\n", name, value)
+	}
+}
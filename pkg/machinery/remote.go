@@ -1,17 +1,43 @@
 package machinery
 
 import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
 	vaultapi "github.com/hashicorp/vault/api"
-	"github.com/hashicorp/vault/command/token"
-	"sigs.k8s.io/yaml"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/clientcmd/api"
 )
 
 type RemoteClient struct {
 	VaultConfig *vaultapi.Config
 	VaultClient *vaultapi.Client
+	Paths       KVPaths
+
+	// Transit encryption settings, if enabled
+	transit *TransitConfig
+	// Local identity used to open shared contexts, if one exists
+	identity *Identity
+	// Key used to sign pushes, if one exists
+	signingKey      ed25519.PrivateKey
+	trustedKeys     []TrustedKey
+	signaturePolicy SignaturePolicy
+
+	// Whether a login method is configured, used to give better hints when
+	// the token expires
+	canLogin bool
 }
 
 func NewRemoteClient(config *KitConfig) (*RemoteClient, error) {
+	paths := config.KVPaths()
+	if err := paths.Validate(); err != nil {
+		return nil, err
+	}
 	conf := vaultapi.DefaultConfig()
 	conf.Address = config.RemoteURL
 	if err := conf.ReadEnvironment(); err != nil {
@@ -22,21 +48,46 @@ func NewRemoteClient(config *KitConfig) (*RemoteClient, error) {
 	if err != nil {
 		return nil, err
 	}
+	// The client picks up VAULT_NAMESPACE on its own, but the namespace in
+	// the kit config takes precedence, like the remote URL.
+	if config.Namespace != "" {
+		client.SetNamespace(config.Namespace)
+	}
 	if client.Token() == "" {
-		helper, err := token.NewInternalTokenHelper()
-		if err != nil {
-			return nil, err
-		}
-		token, err := helper.Get()
+		token, err := loadToken(config)
 		if err != nil {
 			return nil, err
 		}
 		client.SetToken(token)
 	}
-	return &RemoteClient{
-		VaultConfig: conf,
-		VaultClient: client,
-	}, nil
+	identity, err := LoadIdentity(config.IdentityPath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	signingKey, err := LoadSigningKey(config.SigningKeyPath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	policy := config.SignaturePolicy
+	switch policy {
+	case "":
+		policy = SignaturePolicyWarn
+	case SignaturePolicyWarn, SignaturePolicyRequire:
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrInvalidSignaturePolicy, policy)
+	}
+	rc := &RemoteClient{
+		VaultConfig:     conf,
+		VaultClient:     client,
+		Paths:           paths,
+		transit:         config.Transit,
+		identity:        identity,
+		signingKey:      signingKey,
+		trustedKeys:     config.TrustedKeys,
+		signaturePolicy: policy,
+		canLogin:        config.Auth != nil,
+	}
+	return rc, nil
 }
 
 func (r *RemoteClient) CheckConnection() error {
@@ -58,40 +109,412 @@ func (r *RemoteClient) KitMountExists() (bool, error) {
 	sys := r.VaultClient.Sys()
 	mounts, err := sys.ListMounts()
 	if err != nil {
-		return false, err
+		return false, r.checkAuth(err)
+	}
+	mount, ok := mounts[r.Paths.Mount+"/"]
+	if !ok {
+		return false, nil
+	}
+	if mount.Type != "kv" {
+		return false, fmt.Errorf("mount %s is not a kv secret engine (type %s)", r.Paths.Mount, mount.Type)
+	}
+	// KV mounts created without a version option are version 1
+	version := mount.Options["version"]
+	if version == "" {
+		version = "1"
+	}
+	if version != r.Paths.MountOptions()["version"] {
+		return false, fmt.Errorf("%w: mount %s is version %s, expected %d",
+			ErrVaultKVVersionMismatch, r.Paths.Mount, version, r.Paths.Version)
 	}
-	_, ok := mounts["kit/"]
-	return ok, nil
+	return true, nil
 }
 
 func (r *RemoteClient) CreateKitMount() error {
-	return r.VaultClient.Sys().Mount("kit", &vaultapi.MountInput{
-		Type: "kv",
-		Config: vaultapi.MountConfigInput{
-			Options: map[string]string{
-				"version": "2",
-			},
-		},
-	})
+	return r.checkAuth(r.VaultClient.Sys().Mount(r.Paths.Mount, &vaultapi.MountInput{
+		Type:    "kv",
+		Options: r.Paths.MountOptions(),
+	}))
 }
 
 func (r *RemoteClient) LoadRemoteData() (*RemoteCache, error) {
-	logical := r.VaultClient.Logical()
+	// Each context is stored in its own secret so that access can be scoped
+	// to individual contexts using Vault policies.
+	names, err := r.listContexts()
+	if err != nil {
+		return nil, err
+	}
+	shared, err := r.loadSharedContexts()
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 && len(shared.Contexts) == 0 {
+		return r.loadLegacyData()
+	}
+	cache := &RemoteCache{
+		Latest: *api.NewConfig(),
+	}
+	for _, name := range names {
+		data, err := r.readSecret(r.Paths.Data(name))
+		if err != nil {
+			if isPermissionDenied(err) {
+				log.Debugf("Skipping context %s: permission denied", name)
+				continue
+			}
+			return nil, err
+		}
+		if data == nil {
+			continue
+		}
+		if err := r.checkSignature(name, data); err != nil {
+			log.Errorf("Ignoring %v", err)
+			cache.Refused = append(cache.Refused, name)
+			continue
+		}
+		config, err := r.decodeContext(name, data)
+		if err != nil {
+			if IsNotARecipient(err) {
+				log.Debugf("Skipping context %s: not shared with the local identity", name)
+				continue
+			}
+			return nil, err
+		}
+		if err := mergeRemoteConfig(&cache.Latest, config); err != nil {
+			return nil, fmt.Errorf("context %s: %w", name, err)
+		}
+	}
+	// Shared copies are only used for contexts the team copy of which could
+	// not be read
+	for name := range shared.Contexts {
+		if _, ok := cache.Latest.Contexts[name]; !ok {
+			if err := mergeRemoteConfig(&cache.Latest, ContextConfig(shared, name)); err != nil {
+				return nil, fmt.Errorf("shared context %s: %w", name, err)
+			}
+		}
+	}
+	return cache, nil
+}
 
-	sec, err := logical.Read("/kit/data")
+// loadSharedContexts reads the contexts shared with the local identity.
+func (r *RemoteClient) loadSharedContexts() (*api.Config, error) {
+	shared := api.NewConfig()
+	if r.identity == nil {
+		return shared, nil
+	}
+	recipient := r.identity.Recipient()
+	names, err := r.listSecrets(r.Paths.SharedList(recipient))
 	if err != nil {
+		if isPermissionDenied(err) {
+			log.Debug("Skipping shared contexts: permission denied")
+			return shared, nil
+		}
 		return nil, err
 	}
+	for _, name := range names {
+		data, err := r.readSecret(r.Paths.Shared(recipient, name))
+		if err != nil {
+			if isPermissionDenied(err) {
+				log.Debugf("Skipping shared context %s: permission denied", name)
+				continue
+			}
+			return nil, err
+		}
+		if data == nil {
+			continue
+		}
+		if err := r.checkSignature(name, data); err != nil {
+			log.Errorf("Ignoring shared %v", err)
+			continue
+		}
+		config, err := r.decodeContext(name, data)
+		if err != nil {
+			if IsNotARecipient(err) {
+				log.Debugf("Skipping shared context %s: not shared with the local identity", name)
+				continue
+			}
+			return nil, err
+		}
+		if err := mergeRemoteConfig(shared, config); err != nil {
+			return nil, fmt.Errorf("shared context %s: %w", name, err)
+		}
+	}
+	return shared, nil
+}
+
+// loadLegacyData reads remote data stored in a single secret, under the key
+// "latest", by older versions of kit. It is only read until the contexts have
+// been pushed to their own secrets, after which it is ignored.
+func (r *RemoteClient) loadLegacyData() (*RemoteCache, error) {
+	legacyPath, ok := r.Paths.Legacy()
+	if !ok {
+		return nil, ErrRemoteDataNotFound
+	}
+	sec, err := r.VaultClient.Logical().Read(legacyPath)
+	if err != nil {
+		if isPermissionDenied(err) {
+			return nil, ErrRemoteDataNotFound
+		}
+		return nil, r.checkAuth(err)
+	}
 	if sec == nil || sec.Data == nil {
 		return nil, ErrRemoteDataNotFound
 	}
-	if data, ok := sec.Data["latest"]; ok {
-		cache := &RemoteCache{}
-		if err := yaml.Unmarshal(data.([]byte), &cache.Latest); err != nil {
+	fields := sec.Data
+	if nested, ok := fields["data"].(map[string]interface{}); ok {
+		// KV version 2 nests the secret's fields
+		fields = nested
+	}
+	var data []byte
+	switch latest := fields["latest"].(type) {
+	case string:
+		data = []byte(latest)
+	case []byte:
+		data = latest
+	default:
+		return nil, ErrRemoteDataNotFound
+	}
+	// Older versions of kit did not sign anything, so the old secret can not
+	// be verified. Anyone who can delete the per-context secrets could write
+	// it instead.
+	if r.signaturePolicy == SignaturePolicyRequire {
+		return nil, fmt.Errorf("remote data in the old single-secret layout: %w", ErrUnsignedContext)
+	}
+	log.Warn("WARNING: remote data in the old single-secret layout cannot be verified")
+	config, err := decodeKubeconfig(data)
+	if err != nil {
+		return nil, err
+	}
+	cache := &RemoteCache{
+		Latest: *config,
+	}
+	log.Info("Remote data is stored in the old single-secret layout (run 'kit push' to migrate it)")
+	return cache, nil
+}
+
+func (r *RemoteClient) PushRemoteData(config *api.Config) error {
+	for name := range config.Contexts {
+		data, err := r.encodeContext(ContextConfig(config, name))
+		if err != nil {
+			return err
+		}
+		if err := r.writeSecret(r.Paths.Data(name), name, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ShareContext stores a copy of the named context for each of the given
+// recipients, sealed to the recipient and the local identity. The copy read
+// by the rest of the team is left as is. Shared copies are not updated by
+// pushes; the context has to be shared again after it changes.
+func (r *RemoteClient) ShareContext(config *api.Config, name string, recipients []string) error {
+	if _, ok := config.Contexts[name]; !ok {
+		return fmt.Errorf("context %s does not exist", name)
+	}
+	if r.identity == nil {
+		return ErrNoIdentity
+	}
+	for _, recipient := range recipients {
+		data, err := r.encodeSealedContext(ContextConfig(config, name),
+			[]string{recipient, r.identity.Recipient()})
+		if err != nil {
+			return err
+		}
+		if err := r.writeSecret(r.Paths.Shared(recipient, name), name, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *RemoteClient) encodeSealedContext(config *api.Config, recipients []string) (map[string]interface{}, error) {
+	kubeconfig, err := clientcmd.Write(*config)
+	if err != nil {
+		return nil, err
+	}
+	return SealContext(kubeconfig, recipients)
+}
+
+// encodeContext serializes a single-context config into the secret data
+// stored in Vault.
+func (r *RemoteClient) encodeContext(config *api.Config) (map[string]interface{}, error) {
+	kubeconfig, err := clientcmd.Write(*config)
+	if err != nil {
+		return nil, err
+	}
+	if r.transit != nil {
+		ciphertext, err := r.transitEncrypt(kubeconfig)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"ciphertext": ciphertext,
+		}, nil
+	}
+	return map[string]interface{}{
+		"kubeconfig": string(kubeconfig),
+	}, nil
+}
+
+func (r *RemoteClient) decodeContext(name string, data map[string]interface{}) (*api.Config, error) {
+	var kubeconfig []byte
+	if isSealed(data) {
+		plaintext, err := OpenContext(data, r.identity)
+		if err != nil {
+			return nil, err
+		}
+		kubeconfig = plaintext
+	} else if ciphertext, ok := data["ciphertext"].(string); ok {
+		if r.transit == nil {
+			return nil, fmt.Errorf("%w (context %s)", ErrTransitNotConfigured, name)
+		}
+		plaintext, err := r.transitDecrypt(ciphertext)
+		if err != nil {
 			return nil, err
 		}
-		return cache, nil
+		kubeconfig = plaintext
+	} else if plaintext, ok := data["kubeconfig"].(string); ok {
+		kubeconfig = []byte(plaintext)
 	} else {
-		return nil, ErrRemoteDataNotFound
+		return nil, fmt.Errorf("remote data for context %s is malformed", name)
+	}
+	config, err := decodeKubeconfig(kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("remote data for context %s is malformed: %w", name, err)
+	}
+	return config, nil
+}
+
+func (r *RemoteClient) listContexts() ([]string, error) {
+	names, err := r.listSecrets(r.Paths.List())
+	if err != nil {
+		return nil, r.checkAuth(err)
+	}
+	return names, nil
+}
+
+// listSecrets returns the names of the secrets stored directly under the
+// given list path.
+func (r *RemoteClient) listSecrets(listPath string) ([]string, error) {
+	list, err := r.VaultClient.Logical().List(listPath)
+	if err != nil {
+		return nil, err
+	}
+	if list == nil || list.Data == nil {
+		return nil, nil
 	}
+	keys, _ := list.Data["keys"].([]interface{})
+	names := make([]string, 0, len(keys))
+	for _, key := range keys {
+		key, ok := key.(string)
+		if !ok || strings.HasSuffix(key, "/") {
+			continue
+		}
+		name, err := unescapeName(key)
+		if err != nil {
+			log.Warnf("Skipping remote secret %q with a malformed name", key)
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// readContext returns the unwrapped secret data for the named context, or
+// nil if it does not exist.
+func (r *RemoteClient) readContext(name string) (map[string]interface{}, error) {
+	return r.readSecret(r.Paths.Data(name))
+}
+
+// readSecret returns the unwrapped data of the secret at the given path, or
+// nil if it does not exist.
+func (r *RemoteClient) readSecret(dataPath string) (map[string]interface{}, error) {
+	sec, err := r.VaultClient.Logical().Read(dataPath)
+	if err != nil {
+		return nil, err
+	}
+	if sec == nil || sec.Data == nil {
+		return nil, nil
+	}
+	data, ok := r.Paths.UnwrapData(sec.Data)
+	if !ok {
+		return nil, nil
+	}
+	return data, nil
+}
+
+func (r *RemoteClient) writeContext(name string, data map[string]interface{}) error {
+	return r.writeSecret(r.Paths.Data(name), name, data)
+}
+
+// writeSecret signs the data of the named context, if a signing key exists,
+// and writes it to the given path. Without a signing key, an existing
+// signature is kept if it still covers the data.
+func (r *RemoteClient) writeSecret(dataPath, name string, data map[string]interface{}) error {
+	if r.signingKey != nil {
+		if err := SignContext(name, data, r.signingKey); err != nil {
+			return err
+		}
+	} else if !signatureIntact(name, data) {
+		log.Warnf("No signing key found, pushing context %s unsigned", name)
+		delete(data, "signature")
+		delete(data, "signer")
+	}
+	_, err := r.VaultClient.Logical().Write(dataPath, r.Paths.WrapData(data))
+	return r.checkAuth(err)
+}
+
+// ContextConfig returns a config containing only the named context and the
+// cluster and auth info it references.
+func ContextConfig(config *api.Config, name string) *api.Config {
+	out := api.NewConfig()
+	context, ok := config.Contexts[name]
+	if !ok {
+		return out
+	}
+	out.Contexts[name] = context.DeepCopy()
+	if cluster, ok := config.Clusters[context.Cluster]; ok {
+		out.Clusters[context.Cluster] = cluster.DeepCopy()
+	}
+	if authInfo, ok := config.AuthInfos[context.AuthInfo]; ok {
+		out.AuthInfos[context.AuthInfo] = authInfo.DeepCopy()
+	}
+	return out
+}
+
+// mergeRemoteConfig merges a config read from its own secret into dest.
+// Secrets are written separately, so two of them can define different
+// clusters or auth infos under the same name, which is rejected rather than
+// letting one silently replace the other.
+func mergeRemoteConfig(dest, src *api.Config) error {
+	for name, cluster := range src.Clusters {
+		if other, ok := dest.Clusters[name]; ok && !ClustersEqual(other, cluster) {
+			return fmt.Errorf("%w: cluster %s is defined differently by another context", ErrIllFormedConfig, name)
+		}
+	}
+	for name, authInfo := range src.AuthInfos {
+		if other, ok := dest.AuthInfos[name]; ok && !AuthInfosEqual(other, authInfo) {
+			return fmt.Errorf("%w: auth info %s is defined differently by another context", ErrIllFormedConfig, name)
+		}
+	}
+	mergeConfig(dest, src)
+	return nil
+}
+
+func mergeConfig(dest, src *api.Config) {
+	for name, cluster := range src.Clusters {
+		dest.Clusters[name] = cluster
+	}
+	for name, authInfo := range src.AuthInfos {
+		dest.AuthInfos[name] = authInfo
+	}
+	for name, context := range src.Contexts {
+		dest.Contexts[name] = context
+	}
+}
+
+func isPermissionDenied(err error) bool {
+	var respErr *vaultapi.ResponseError
+	return errors.As(err, &respErr) && respErr.StatusCode == http.StatusForbidden
 }
@@ -0,0 +1,393 @@
+package machinery_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"sigs.k8s.io/yaml"
+
+	"github.com/kralicky/kit/pkg/machinery"
+)
+
+type stubRequest struct {
+	Method    string
+	Path      string
+	Namespace string
+	Token     string
+	Body      map[string]interface{}
+}
+
+// stubVault is a minimal fake Vault HTTP API. Responses are keyed by
+// "<METHOD> <path>", where list requests use the LIST method.
+type stubVault struct {
+	*httptest.Server
+	mu        sync.Mutex
+	requests  []stubRequest
+	responses map[string]interface{}
+}
+
+func newStubVault(responses map[string]interface{}) *stubVault {
+	s := &stubVault{
+		responses: responses,
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method := r.Method
+		if r.URL.Query().Get("list") == "true" {
+			method = "LIST"
+		}
+		req := stubRequest{
+			Method:    method,
+			Path:      r.URL.Path,
+			Namespace: r.Header.Get("X-Vault-Namespace"),
+			Token:     r.Header.Get("X-Vault-Token"),
+		}
+		json.NewDecoder(r.Body).Decode(&req.Body)
+		s.mu.Lock()
+		s.requests = append(s.requests, req)
+		resp, ok := s.responses[method+" "+r.URL.Path]
+		s.mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+			return
+		}
+		if status, ok := resp.(int); ok {
+			w.WriteHeader(status)
+			w.Write([]byte(`{"errors":["stub error"]}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	return s
+}
+
+func (s *stubVault) Requests() []stubRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]stubRequest(nil), s.requests...)
+}
+
+// preserveEnv restores the given environment variables after each spec
+func preserveEnv(keys ...string) {
+	saved := map[string]*string{}
+	BeforeEach(func() {
+		for _, key := range keys {
+			if value, ok := os.LookupEnv(key); ok {
+				saved[key] = &value
+			} else {
+				saved[key] = nil
+			}
+		}
+	})
+	AfterEach(func() {
+		for key, value := range saved {
+			if value != nil {
+				os.Setenv(key, *value)
+			} else {
+				os.Unsetenv(key)
+			}
+		}
+	})
+}
+
+var _ = Describe("Remote", func() {
+	var vault *stubVault
+	preserveEnv("VAULT_TOKEN", "VAULT_NAMESPACE")
+	BeforeEach(func() {
+		kubeconfig, err := yaml.Marshal(machinery.ContextConfig(sampleClusters(1), "context1"))
+		Expect(err).NotTo(HaveOccurred())
+		vault = newStubVault(map[string]interface{}{
+			"GET /v1/sys/health": map[string]interface{}{
+				"initialized": true,
+				"sealed":      false,
+			},
+			"GET /v1/sys/mounts": map[string]interface{}{
+				"data": map[string]interface{}{
+					"kit/": map[string]interface{}{
+						"type":    "kv",
+						"options": map[string]string{"version": "2"},
+					},
+				},
+			},
+			"LIST /v1/kit/metadata": map[string]interface{}{
+				"data": map[string]interface{}{
+					"keys": []string{"context1"},
+				},
+			},
+			"GET /v1/kit/data/context1": map[string]interface{}{
+				"data": map[string]interface{}{
+					"data": map[string]interface{}{
+						"kubeconfig": string(kubeconfig),
+					},
+				},
+			},
+			"PUT /v1/kit/data/context1": map[string]interface{}{},
+		})
+		os.Setenv("VAULT_TOKEN", "test-token")
+		os.Unsetenv("VAULT_NAMESPACE")
+	})
+	AfterEach(func() {
+		vault.Close()
+	})
+
+	Context("with a namespace", func() {
+		exerciseClient := func(config *machinery.KitConfig) {
+			client, err := machinery.NewRemoteClient(config)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(client.CheckConnection()).To(Succeed())
+			exists, err := client.KitMountExists()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exists).To(BeTrue())
+			cache, err := client.LoadRemoteData()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cache.Latest.Contexts).To(HaveKey("context1"))
+			Expect(client.PushRemoteData(&cache.Latest)).To(Succeed())
+		}
+		It("should send the configured namespace with every request", func() {
+			exerciseClient(&machinery.KitConfig{
+				RemoteURL: vault.URL,
+				Namespace: "team-a",
+			})
+			requests := vault.Requests()
+			Expect(requests).To(HaveLen(5))
+			for _, req := range requests {
+				Expect(req.Namespace).To(Equal("team-a"), "%s %s", req.Method, req.Path)
+			}
+		})
+		It("should honor VAULT_NAMESPACE", func() {
+			os.Setenv("VAULT_NAMESPACE", "team-b")
+			exerciseClient(&machinery.KitConfig{
+				RemoteURL: vault.URL,
+			})
+			for _, req := range vault.Requests() {
+				Expect(req.Namespace).To(Equal("team-b"), "%s %s", req.Method, req.Path)
+			}
+		})
+		It("should prefer the configured namespace over VAULT_NAMESPACE", func() {
+			os.Setenv("VAULT_NAMESPACE", "team-b")
+			exerciseClient(&machinery.KitConfig{
+				RemoteURL: vault.URL,
+				Namespace: "team-a",
+			})
+			for _, req := range vault.Requests() {
+				Expect(req.Namespace).To(Equal("team-a"), "%s %s", req.Method, req.Path)
+			}
+		})
+		It("should not send a namespace by default", func() {
+			exerciseClient(&machinery.KitConfig{
+				RemoteURL: vault.URL,
+			})
+			for _, req := range vault.Requests() {
+				Expect(req.Namespace).To(BeEmpty())
+			}
+		})
+	})
+
+	Context("with context names containing slashes", func() {
+		It("should store each context in a single escaped secret", func() {
+			config := sampleClusters(1)
+			config.Contexts["team/dev"] = config.Contexts["context1"]
+			delete(config.Contexts, "context1")
+			kubeconfig, err := yaml.Marshal(machinery.ContextConfig(config, "team/dev"))
+			Expect(err).NotTo(HaveOccurred())
+			vault.responses["LIST /v1/kit/metadata"] = map[string]interface{}{
+				"data": map[string]interface{}{
+					"keys": []string{"team%2Fdev"},
+				},
+			}
+			vault.responses["GET /v1/kit/data/team%2Fdev"] = map[string]interface{}{
+				"data": map[string]interface{}{
+					"data": map[string]interface{}{
+						"kubeconfig": string(kubeconfig),
+					},
+				},
+			}
+			vault.responses["PUT /v1/kit/data/team%2Fdev"] = map[string]interface{}{}
+
+			client, err := machinery.NewRemoteClient(&machinery.KitConfig{
+				RemoteURL: vault.URL,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			cache, err := client.LoadRemoteData()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cache.Latest.Contexts).To(HaveKey("team/dev"))
+			Expect(client.PushRemoteData(&cache.Latest)).To(Succeed())
+			requests := vault.Requests()
+			Expect(requests[len(requests)-1].Method).To(Equal("PUT"))
+			Expect(requests[len(requests)-1].Path).To(Equal("/v1/kit/data/team%2Fdev"))
+		})
+	})
+
+	It("should reject contexts that define a shared cluster differently", func() {
+		// context2 uses the same cluster as context1
+		config := sampleClusters(1, 2)
+		config.Contexts["context2"].Cluster = "cluster1"
+		vault.responses["LIST /v1/kit/metadata"] = map[string]interface{}{
+			"data": map[string]interface{}{
+				"keys": []string{"context1", "context2"},
+			},
+		}
+		setContext2 := func() {
+			kubeconfig, err := yaml.Marshal(machinery.ContextConfig(config, "context2"))
+			Expect(err).NotTo(HaveOccurred())
+			vault.responses["GET /v1/kit/data/context2"] = map[string]interface{}{
+				"data": map[string]interface{}{
+					"data": map[string]interface{}{
+						"kubeconfig": string(kubeconfig),
+					},
+				},
+			}
+		}
+		client, err := machinery.NewRemoteClient(&machinery.KitConfig{
+			RemoteURL: vault.URL,
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		setContext2()
+		cache, err := client.LoadRemoteData()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cache.Latest.Contexts).To(HaveLen(2))
+		Expect(cache.Latest.Clusters).To(HaveLen(1))
+
+		config.Clusters["cluster1"].Server = "https://other:6443"
+		setContext2()
+		_, err = client.LoadRemoteData()
+		Expect(err).To(MatchError(machinery.ErrIllFormedConfig))
+		Expect(err.Error()).To(ContainSubstring("cluster cluster1"))
+	})
+
+	Context("with the old single-secret layout", func() {
+		It("should read all contexts from the old secret", func() {
+			latest, err := yaml.Marshal(sampleClusters(1, 2))
+			Expect(err).NotTo(HaveOccurred())
+			delete(vault.responses, "LIST /v1/kit/metadata")
+			vault.responses["GET /v1/kit/data"] = map[string]interface{}{
+				"data": map[string]interface{}{
+					"data": map[string]interface{}{
+						"latest": string(latest),
+					},
+				},
+			}
+
+			client, err := machinery.NewRemoteClient(&machinery.KitConfig{
+				RemoteURL: vault.URL,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			cache, err := client.LoadRemoteData()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cache.Latest.Contexts).To(HaveLen(2))
+			Expect(cache.Latest.Contexts).To(HaveKey("context1"))
+			Expect(cache.Latest.Contexts).To(HaveKey("context2"))
+
+			// The old secret is never signed
+			client, err = machinery.NewRemoteClient(&machinery.KitConfig{
+				RemoteURL:       vault.URL,
+				SignaturePolicy: machinery.SignaturePolicyRequire,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = client.LoadRemoteData()
+			Expect(err).To(MatchError(machinery.ErrUnsignedContext))
+		})
+		It("should not read the old secret on a KV v1 mount", func() {
+			// On KV v1, kit/data is a context named "data"
+			vault.responses["GET /v1/kit/data"] = map[string]interface{}{
+				"data": map[string]interface{}{
+					"latest": "{}",
+				},
+			}
+			client, err := machinery.NewRemoteClient(&machinery.KitConfig{
+				RemoteURL: vault.URL,
+				KVVersion: 1,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = client.LoadRemoteData()
+			Expect(err).To(MatchError(machinery.ErrRemoteDataNotFound))
+		})
+		It("should report missing data when neither layout exists", func() {
+			delete(vault.responses, "LIST /v1/kit/metadata")
+			client, err := machinery.NewRemoteClient(&machinery.KitConfig{
+				RemoteURL: vault.URL,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = client.LoadRemoteData()
+			Expect(err).To(MatchError(machinery.ErrRemoteDataNotFound))
+		})
+	})
+
+	Context("with shared contexts", func() {
+		var alice, bob, mallory *machinery.Identity
+		var dir string
+		BeforeEach(func() {
+			var err error
+			alice, err = machinery.GenerateIdentity()
+			Expect(err).NotTo(HaveOccurred())
+			bob, err = machinery.GenerateIdentity()
+			Expect(err).NotTo(HaveOccurred())
+			mallory, err = machinery.GenerateIdentity()
+			Expect(err).NotTo(HaveOccurred())
+			dir, err = os.MkdirTemp("", "kit-share")
+			Expect(err).NotTo(HaveOccurred())
+		})
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+		clientFor := func(name string, identity *machinery.Identity) *machinery.RemoteClient {
+			path := filepath.Join(dir, name)
+			Expect(identity.WriteToDisk(path)).To(Succeed())
+			client, err := machinery.NewRemoteClient(&machinery.KitConfig{
+				RemoteURL:    vault.URL,
+				IdentityFile: path,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return client
+		}
+		sharedPath := func(identity *machinery.Identity) string {
+			return "/v1/kit/data/shared/" + url.PathEscape(identity.Recipient()) + "/context1"
+		}
+
+		It("should store shares apart from the team copy", func() {
+			vault.responses["PUT "+sharedPath(bob)] = map[string]interface{}{}
+			client := clientFor("alice", alice)
+			Expect(client.ShareContext(sampleClusters(1), "context1", []string{bob.Recipient()})).To(Succeed())
+
+			var share map[string]interface{}
+			for _, req := range vault.Requests() {
+				Expect(req.Path).NotTo(Equal("/v1/kit/data/context1"), "%s %s", req.Method, req.Path)
+				if req.Method == "PUT" && req.Path == sharedPath(bob) {
+					share = req.Body
+				}
+			}
+			Expect(share).NotTo(BeNil())
+
+			// Bob can no longer read the team copy, but can open the share
+			vault.responses["GET /v1/kit/data/context1"] = http.StatusForbidden
+			vault.responses["LIST /v1/kit/metadata/shared/"+url.PathEscape(bob.Recipient())] = map[string]interface{}{
+				"data": map[string]interface{}{
+					"keys": []string{"context1"},
+				},
+			}
+			vault.responses["GET "+sharedPath(bob)] = map[string]interface{}{
+				"data": share,
+			}
+			cache, err := clientFor("bob", bob).LoadRemoteData()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cache.Latest.Contexts).To(HaveKey("context1"))
+		})
+		It("should still load the team copy for other users after sharing", func() {
+			vault.responses["PUT "+sharedPath(bob)] = map[string]interface{}{}
+			Expect(clientFor("alice", alice).ShareContext(sampleClusters(1), "context1", []string{bob.Recipient()})).To(Succeed())
+
+			cache, err := clientFor("mallory", mallory).LoadRemoteData()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cache.Latest.Contexts).To(HaveKey("context1"))
+		})
+	})
+})
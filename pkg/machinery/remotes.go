@@ -0,0 +1,297 @@
+package machinery
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"k8s.io/client-go/tools/clientcmd/api"
+	"sigs.k8s.io/yaml"
+)
+
+// Name of the remote configured by the top-level fields of the kit config
+const DefaultRemoteName = "default"
+
+var remoteNameRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// RemoteConfig is a named Vault remote. Unset mount, secret path, KV version
+// and namespace fields fall back to the corresponding top-level fields of the
+// kit config. Auth, transit and sync settings are never inherited: when unset,
+// the remote uses token auth with no transit encryption or sync filter.
+type RemoteConfig struct {
+	Name       string         `json:"name"`
+	URL        string         `json:"url"`
+	MountPath  string         `json:"mountPath,omitempty"`
+	SecretPath string         `json:"secretPath,omitempty"`
+	KVVersion  int            `json:"kvVersion,omitempty"`
+	Namespace  string         `json:"namespace,omitempty"`
+	Auth       *AuthConfig    `json:"auth,omitempty"`
+	Transit    *TransitConfig `json:"transit,omitempty"`
+	Sync       *SyncFilter    `json:"sync,omitempty"`
+}
+
+func ValidateRemoteName(name string) error {
+	if !remoteNameRegex.MatchString(name) {
+		return fmt.Errorf("%w: %q", ErrInvalidRemoteName, name)
+	}
+	return nil
+}
+
+// ForRemote returns a copy of the kit config with the settings of the named
+// remote applied to the top-level fields. If name is empty, the default
+// remote is used.
+func (c *KitConfig) ForRemote(name string) (*KitConfig, error) {
+	if name == "" {
+		name = c.DefaultRemote
+	}
+	out := *c
+	out.Remotes = nil
+	if name == "" || name == DefaultRemoteName {
+		if c.RemoteURL == "" && len(c.Remotes) > 0 {
+			return nil, ErrNoDefaultRemote
+		}
+		out.remoteName = DefaultRemoteName
+		return &out, nil
+	}
+	remote := c.findRemote(name)
+	if remote == nil {
+		return nil, fmt.Errorf("%w: %s", ErrRemoteNotFound, name)
+	}
+	out.remoteName = remote.Name
+	out.RemoteURL = remote.URL
+	if remote.MountPath != "" {
+		out.MountPath = remote.MountPath
+	}
+	if remote.SecretPath != "" {
+		out.SecretPath = remote.SecretPath
+	}
+	if remote.KVVersion != 0 {
+		out.KVVersion = remote.KVVersion
+	}
+	if remote.Namespace != "" {
+		out.Namespace = remote.Namespace
+	}
+	out.Auth = remote.Auth
+	out.Transit = remote.Transit
+	out.Sync = remote.Sync
+	return &out, nil
+}
+
+// RemoteName returns the name of the remote selected with ForRemote.
+func (c *KitConfig) RemoteName() string {
+	if c.remoteName == "" {
+		return DefaultRemoteName
+	}
+	return c.remoteName
+}
+
+// TokenPath returns the location of the stored Vault token of a named remote.
+// The token is encrypted like the remote cache.
+func TokenPath(home, remote string) string {
+	return filepath.Join(home, "remotes", remote+".token")
+}
+
+func (c *KitConfig) TokenPath() string {
+	return TokenPath(c.Home(), c.RemoteName())
+}
+
+func (c *KitConfig) AddRemote(remote RemoteConfig) error {
+	if err := ValidateRemoteName(remote.Name); err != nil {
+		return err
+	}
+	if remote.Name == DefaultRemoteName || c.findRemote(remote.Name) != nil {
+		return fmt.Errorf("%w: %s", ErrRemoteAlreadyExists, remote.Name)
+	}
+	if remote.URL == "" {
+		return fmt.Errorf("remote %s has no URL", remote.Name)
+	}
+	if err := remote.Sync.Validate(); err != nil {
+		return err
+	}
+	c.Remotes = append(c.Remotes, remote)
+	return nil
+}
+
+// RemoveRemote removes the named remote from the config. Contexts pulled
+// from it are left untouched.
+func (c *KitConfig) RemoveRemote(name string) error {
+	for i, remote := range c.Remotes {
+		if remote.Name == name {
+			c.Remotes = append(c.Remotes[:i], c.Remotes[i+1:]...)
+			if c.DefaultRemote == name {
+				c.DefaultRemote = ""
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrRemoteNotFound, name)
+}
+
+// ListRemotes returns all configured remotes, including the default remote
+// if the top-level remote URL is set.
+func (c *KitConfig) ListRemotes() []RemoteConfig {
+	var remotes []RemoteConfig
+	if c.RemoteURL != "" {
+		remotes = append(remotes, RemoteConfig{
+			Name:       DefaultRemoteName,
+			URL:        c.RemoteURL,
+			MountPath:  c.MountPath,
+			SecretPath: c.SecretPath,
+			KVVersion:  c.KVVersion,
+			Namespace:  c.Namespace,
+			Auth:       c.Auth,
+			Transit:    c.Transit,
+			Sync:       c.Sync,
+		})
+	}
+	return append(remotes, c.Remotes...)
+}
+
+func (c *KitConfig) findRemote(name string) *RemoteConfig {
+	for i := range c.Remotes {
+		if c.Remotes[i].Name == name {
+			return &c.Remotes[i]
+		}
+	}
+	return nil
+}
+
+// Ownership records which remote each local context was pulled from or
+// pushed to, so that syncing with one remote never touches contexts that
+// belong to another.
+type Ownership struct {
+	Contexts map[string]string `json:"contexts"`
+}
+
+func OwnershipPath(home string) string {
+	return filepath.Join(home, "owners.yaml")
+}
+
+func ReadOwnership(home string) (*Ownership, error) {
+	o := &Ownership{
+		Contexts: map[string]string{},
+	}
+	data, err := os.ReadFile(OwnershipPath(home))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return o, nil
+		}
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, o); err != nil {
+		return nil, err
+	}
+	if o.Contexts == nil {
+		o.Contexts = map[string]string{}
+	}
+	return o, nil
+}
+
+func (o *Ownership) WriteToDisk(home string) error {
+	data, err := yaml.Marshal(o)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(OwnershipPath(home), data, 0600)
+}
+
+// Owner returns the remote that owns the named context, or "" if the
+// context has never been synced.
+func (o *Ownership) Owner(name string) string {
+	return o.Contexts[name]
+}
+
+// Filter returns a copy of the config containing only the contexts that the
+// remote may modify: those it owns and those with no owner.
+func (o *Ownership) Filter(config *api.Config, remote string) *api.Config {
+	out := api.NewConfig()
+	for name := range config.Contexts {
+		if owner := o.Owner(name); owner == "" || owner == remote {
+			mergeConfig(out, ContextConfig(config, name))
+		}
+	}
+	return out
+}
+
+// Claim marks local contexts that are identical to a context in the remote
+// config as owned by the remote, and forgets contexts that no longer exist.
+func (o *Ownership) Claim(local, remoteConfig *api.Config, remote string) {
+	for name := range o.Contexts {
+		if _, ok := local.Contexts[name]; !ok {
+			delete(o.Contexts, name)
+		}
+	}
+	// Remote contexts are indexed like in ComputeDiff, so that claiming does
+	// not compare every pair of contexts
+	index := newContextIndex()
+	for name, context := range remoteConfig.Contexts {
+		cluster := remoteConfig.Clusters[context.Cluster]
+		authInfo := remoteConfig.AuthInfos[context.AuthInfo]
+		if cluster == nil || authInfo == nil {
+			continue
+		}
+		index.add(&contextEntry{
+			Name:     name,
+			Context:  context,
+			Cluster:  cluster,
+			AuthInfo: authInfo,
+		})
+	}
+	for localName, localContext := range local.Contexts {
+		if owner := o.Owner(localName); owner != "" && owner != remote {
+			continue
+		}
+		localCluster := local.Clusters[localContext.Cluster]
+		localAuth := local.AuthInfos[localContext.AuthInfo]
+		if localCluster == nil || localAuth == nil {
+			continue
+		}
+		if len(index.matchContext(localCluster, localAuth)) > 0 {
+			o.Contexts[localName] = remote
+		}
+	}
+}
+
+// OwnedBy returns the names of the contexts owned by the remote, sorted.
+func (o *Ownership) OwnedBy(remote string) []string {
+	var names []string
+	for name, owner := range o.Contexts {
+		if owner == remote {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ComputeRemoteDiff computes the diff between the local config and the data
+// of a single remote. Contexts owned by other remotes are left out, and only
+// contexts owned by this remote can be deleted. Contexts whose signature was
+// refused are never deleted.
+func ComputeRemoteDiff(existing *api.Config, cache *RemoteCache, filter *SyncFilter, owners *Ownership, remote string) (*Diff, error) {
+	diff, err := ComputeFilteredDiff(owners.Filter(existing, remote), &cache.Latest, filter)
+	if err != nil {
+		return nil, err
+	}
+	refused := make(map[string]bool, len(cache.Refused))
+	for _, name := range cache.Refused {
+		refused[name] = true
+	}
+	items := diff.Items[:0]
+	for _, item := range diff.Items {
+		if item.ChangeType&ChangeTypeDelete != 0 {
+			name := item.AffectedExisting.Name
+			if owners.Owner(name) != remote || refused[name] {
+				continue
+			}
+		}
+		items = append(items, item)
+	}
+	diff.Items = items
+	// New contexts must not conflict with contexts owned by other remotes
+	markNameConflicts(diff, existing)
+	diff.Sort()
+	return diff, nil
+}
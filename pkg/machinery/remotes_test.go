@@ -0,0 +1,203 @@
+package machinery_test
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/kralicky/kit/pkg/machinery"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Remotes", func() {
+	var config *machinery.KitConfig
+	BeforeEach(func() {
+		config = &machinery.KitConfig{
+			RemoteURL: "https://platform.example.com",
+			Namespace: "platform",
+		}
+		Expect(config.AddRemote(machinery.RemoteConfig{
+			Name:      "support",
+			URL:       "https://support.example.com",
+			MountPath: "support-kit",
+			Sync: &machinery.SyncFilter{
+				Exclude: []string{"kind-*"},
+			},
+		})).To(Succeed())
+	})
+
+	It("should apply the settings of a named remote", func() {
+		support, err := config.ForRemote("support")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(support.RemoteName()).To(Equal("support"))
+		Expect(support.RemoteURL).To(Equal("https://support.example.com"))
+		Expect(support.KVPaths().Mount).To(Equal("support-kit"))
+		Expect(support.Namespace).To(Equal("platform"))
+		Expect(support.Sync.Matches("kind-dev")).To(BeFalse())
+		Expect(filepath.Base(support.RemoteCachePath())).To(Equal("support.yaml"))
+
+		def, err := config.ForRemote("")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(def.RemoteName()).To(Equal(machinery.DefaultRemoteName))
+		Expect(def.RemoteURL).To(Equal("https://platform.example.com"))
+		Expect(filepath.Base(def.RemoteCachePath())).To(Equal("remote.yaml"))
+	})
+	It("should not inherit auth, transit or sync settings", func() {
+		config.Auth = &machinery.AuthConfig{
+			Method:     "approle",
+			RoleIDFile: "/etc/kit/role-id",
+		}
+		config.Transit = &machinery.TransitConfig{Key: "kit"}
+		config.Sync = &machinery.SyncFilter{Include: []string{"prod-*"}}
+		Expect(config.AddRemote(machinery.RemoteConfig{
+			Name: "personal",
+			URL:  "https://personal.example.com",
+		})).To(Succeed())
+		personal, err := config.ForRemote("personal")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(personal.Auth).To(BeNil())
+		Expect(personal.Transit).To(BeNil())
+		Expect(personal.Sync).To(BeNil())
+	})
+	Context("with a stored token", func() {
+		var dir string
+		preserveEnv(machinery.HomeEnv, "VAULT_TOKEN")
+		BeforeEach(func() {
+			var err error
+			dir, err = os.MkdirTemp("", "kit-remotes")
+			Expect(err).NotTo(HaveOccurred())
+			os.Setenv(machinery.HomeEnv, dir)
+			os.Unsetenv("VAULT_TOKEN")
+		})
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+		It("should encrypt the tokens of named remotes", func() {
+			support, err := config.ForRemote("support")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(machinery.StoreToken(support, "s.support-token")).To(Succeed())
+			data, err := os.ReadFile(support.TokenPath())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(machinery.IsEncryptedCache(data)).To(BeTrue())
+			Expect(string(data)).NotTo(ContainSubstring("s.support-token"))
+
+			client, err := machinery.NewRemoteClient(support)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(client.VaultClient.Token()).To(Equal("s.support-token"))
+		})
+		It("should encrypt plaintext tokens stored by older versions", func() {
+			support, err := config.ForRemote("support")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.MkdirAll(filepath.Dir(support.TokenPath()), 0700)).To(Succeed())
+			Expect(os.WriteFile(support.TokenPath(), []byte("s.support-token\n"), 0600)).To(Succeed())
+
+			client, err := machinery.NewRemoteClient(support)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(client.VaultClient.Token()).To(Equal("s.support-token"))
+			data, err := os.ReadFile(support.TokenPath())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(machinery.IsEncryptedCache(data)).To(BeTrue())
+		})
+	})
+	It("should use the configured default remote", func() {
+		config.DefaultRemote = "support"
+		remote, err := config.ForRemote("")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(remote.RemoteName()).To(Equal("support"))
+	})
+	It("should reject unknown and duplicate remotes", func() {
+		_, err := config.ForRemote("missing")
+		Expect(err).To(MatchError(machinery.ErrRemoteNotFound))
+		Expect(config.AddRemote(machinery.RemoteConfig{
+			Name: "support",
+			URL:  "https://other.example.com",
+		})).To(MatchError(machinery.ErrRemoteAlreadyExists))
+		Expect(config.AddRemote(machinery.RemoteConfig{
+			Name: "bad/name",
+			URL:  "https://other.example.com",
+		})).To(MatchError(machinery.ErrInvalidRemoteName))
+	})
+	It("should remove remotes", func() {
+		Expect(config.RemoveRemote("support")).To(Succeed())
+		Expect(config.ListRemotes()).To(HaveLen(1))
+		Expect(config.RemoveRemote("support")).To(MatchError(machinery.ErrRemoteNotFound))
+	})
+	It("should require a remote if there is no default", func() {
+		config.RemoteURL = ""
+		_, err := config.ForRemote("")
+		Expect(err).To(MatchError(machinery.ErrNoDefaultRemote))
+	})
+})
+
+var _ = Describe("Ownership", func() {
+	It("should not delete contexts owned by another remote", func() {
+		existing := sampleClusters(1, 2, 3)
+		owners := &machinery.Ownership{
+			Contexts: map[string]string{
+				"context1": "platform",
+				"context2": "support",
+				"context3": "platform",
+			},
+		}
+		// context3 was deleted from the platform remote
+		diff, err := machinery.ComputeRemoteDiff(existing, &machinery.RemoteCache{Latest: *sampleClusters(1)}, nil, owners, "platform")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(diff.Items).To(HaveLen(1))
+		Expect(diff.Items[0].ChangeType).To(Equal(machinery.ChangeTypeDelete))
+		Expect(diff.Items[0].AffectedExisting.Name).To(Equal("context3"))
+
+		diff, err = machinery.ComputeRemoteDiff(existing, &machinery.RemoteCache{Latest: *sampleClusters(2)}, nil, owners, "support")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(diff.Items).To(BeEmpty())
+	})
+	It("should not delete contexts that have never been synced", func() {
+		owners := &machinery.Ownership{
+			Contexts: map[string]string{},
+		}
+		diff, err := machinery.ComputeRemoteDiff(sampleClusters(1, 2), &machinery.RemoteCache{Latest: *sampleClusters(1)}, nil, owners, "platform")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(diff.Items).To(BeEmpty())
+	})
+	It("should sort items after marking name conflicts", func() {
+		owners := &machinery.Ownership{
+			Contexts: map[string]string{
+				"context1": "support",
+			},
+		}
+		// context1 conflicts with the context owned by the support remote
+		diff, err := machinery.ComputeRemoteDiff(sampleClusters(1), &machinery.RemoteCache{Latest: *sampleClusters(1, 2)}, nil, owners, "platform")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(diff.Items).To(HaveLen(2))
+		Expect(diff.Items[0].AffectedIncoming.Name).To(Equal("context2"))
+		Expect(diff.Items[0].Complex).To(Equal(machinery.ComplexDiffTypeNone))
+		Expect(diff.Items[1].AffectedIncoming.Name).To(Equal("context1"))
+		Expect(diff.Items[1].Complex).To(Equal(machinery.ComplexDiffRenameRequired))
+	})
+	It("should claim matching contexts", func() {
+		owners := &machinery.Ownership{
+			Contexts: map[string]string{
+				"context2": "support",
+				"removed":  "platform",
+			},
+		}
+		local := sampleClusters(1, 2, 3)
+		owners.Claim(local, sampleClusters(1, 2), "platform")
+		Expect(owners.Contexts).To(Equal(map[string]string{
+			"context1": "platform",
+			"context2": "support",
+		}))
+		Expect(owners.OwnedBy("platform")).To(Equal([]string{"context1"}))
+	})
+	It("should claim matching contexts among many contexts", func() {
+		owners := &machinery.Ownership{
+			Contexts: map[string]string{},
+		}
+		// 10 local contexts were deleted from the remote and 10 have a new
+		// token there
+		local, remote := largeConfigs(2000)
+		owners.Claim(local, remote, "platform")
+		Expect(owners.OwnedBy("platform")).To(HaveLen(1980))
+		Expect(owners.Owner("context1")).To(BeEmpty())
+		Expect(owners.Owner("context1990")).To(Equal("platform"))
+	})
+})
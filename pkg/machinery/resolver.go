@@ -7,6 +7,9 @@ import (
 
 type ConflictResolver interface {
 	Rename(kind string, oldName string, validator func(string) error) string
+	// Choose returns which of the item's candidates the incoming context
+	// corresponds to, for items marked with ChangeTypeAmbiguous.
+	Choose(item DiffItem) NamedContext
 }
 
 type autoResolver struct{}
@@ -25,4 +28,10 @@ func (r *autoResolver) Rename(
 	panic(fmt.Sprintf("failed to rename %s %s", kind, oldName))
 }
 
+// Choose keeps the candidate chosen by ComputeDiff, which is the first one by
+// name.
+func (r *autoResolver) Choose(item DiffItem) NamedContext {
+	return item.AffectedExisting
+}
+
 var AutoResolver = &autoResolver{}
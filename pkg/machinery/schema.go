@@ -0,0 +1,160 @@
+package machinery
+
+import (
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	APIVersion = "kit/v1"
+	// The remote cache stores configs in the kubeconfig format since kit/v2
+	RemoteCacheAPIVersion = "kit/v2"
+
+	KindKitConfig   = "KitConfig"
+	KindRemoteCache = "RemoteCache"
+)
+
+// TypeMeta identifies the schema of a file written by kit.
+type TypeMeta struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+}
+
+// Migration upgrades a document from one apiVersion to the next. Files
+// written before versioning was introduced have an empty apiVersion.
+type Migration struct {
+	From    string
+	To      string
+	Migrate func(doc map[string]interface{}) error
+}
+
+var configMigrations = []Migration{
+	{
+		From:    "",
+		To:      "kit/v1",
+		Migrate: setTypeMeta(KindKitConfig),
+	},
+}
+
+var remoteCacheMigrations = []Migration{
+	{
+		From:    "",
+		To:      "kit/v1",
+		Migrate: setTypeMeta(KindRemoteCache),
+	},
+	{
+		From:    "kit/v1",
+		To:      "kit/v2",
+		Migrate: convertCacheConfigs,
+	},
+}
+
+func setTypeMeta(kind string) func(map[string]interface{}) error {
+	return func(doc map[string]interface{}) error {
+		doc["kind"] = kind
+		return nil
+	}
+}
+
+// convertCacheConfigs converts the configs in a remote cache from the
+// internal format to the kubeconfig format.
+func convertCacheConfigs(doc map[string]interface{}) error {
+	if latest, ok := doc["latest"]; ok && latest != nil {
+		converted, err := convertLegacyConfig(latest)
+		if err != nil {
+			return err
+		}
+		doc["latest"] = converted
+	}
+	history, _ := doc["history"].([]interface{})
+	for i, config := range history {
+		converted, err := convertLegacyConfig(config)
+		if err != nil {
+			return err
+		}
+		history[i] = converted
+	}
+	return nil
+}
+
+// currentVersion returns the apiVersion that the last migration upgrades to.
+func currentVersion(migrations []Migration) string {
+	if len(migrations) == 0 {
+		return APIVersion
+	}
+	return migrations[len(migrations)-1].To
+}
+
+// migrate upgrades a document of the given kind to the current apiVersion.
+// It returns the upgraded document and whether any migrations were applied.
+func migrate(data []byte, kind string, migrations []Migration) ([]byte, bool, error) {
+	doc := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, false, err
+	}
+	if doc == nil {
+		doc = map[string]interface{}{}
+	}
+	version, _ := doc["apiVersion"].(string)
+	if k, ok := doc["kind"].(string); ok && version != "" && k != kind {
+		return nil, false, fmt.Errorf("%w: expected kind %s, got %s", ErrInvalidSchema, kind, k)
+	}
+	migrated := false
+	for version != currentVersion(migrations) {
+		var next *Migration
+		for i := range migrations {
+			if migrations[i].From == version {
+				next = &migrations[i]
+				break
+			}
+		}
+		if next == nil {
+			return nil, false, fmt.Errorf("%w: %s %q", ErrUnsupportedAPIVersion, kind, version)
+		}
+		if err := next.Migrate(doc); err != nil {
+			return nil, false, fmt.Errorf("migrating %s from %q to %q: %w", kind, next.From, next.To, err)
+		}
+		doc["apiVersion"] = next.To
+		version = next.To
+		migrated = true
+	}
+	if !migrated {
+		return data, false, nil
+	}
+	out, err := yaml.Marshal(doc)
+	if err != nil {
+		return nil, false, err
+	}
+	return out, true, nil
+}
+
+// unmarshalStrict decodes a document, rejecting unknown fields.
+func unmarshalStrict(data []byte, obj interface{}, path string) error {
+	if err := yaml.UnmarshalStrict(data, obj); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrInvalidSchema, path, err)
+	}
+	return nil
+}
+
+// MigrationBackupPath returns where the contents of a file are saved before
+// it is migrated.
+func MigrationBackupPath(path string) string {
+	return path + ".bak"
+}
+
+// replaceMigrated saves a backup of a file's original contents, then
+// overwrites the file with its migrated contents.
+func replaceMigrated(path string, original []byte, write func() error) error {
+	backup := MigrationBackupPath(path)
+	if err := os.WriteFile(backup, original, 0600); err != nil {
+		return err
+	}
+	if err := write(); err != nil {
+		return err
+	}
+	log.Infof("Upgraded %s (backup saved to %s)", path, backup)
+	return nil
+}
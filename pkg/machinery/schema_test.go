@@ -0,0 +1,83 @@
+package machinery_test
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/kralicky/kit/pkg/machinery"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Schema", func() {
+	var dir, path string
+	preserveEnv(machinery.HomeEnv)
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "kit-schema")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "config.yaml")
+		os.Unsetenv(machinery.HomeEnv)
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should upgrade unversioned configs and keep a backup", func() {
+		legacy := "remoteUrl: https://vault.example.com\nkubeconfigPath: /tmp/kubeconfig\n"
+		Expect(os.WriteFile(path, []byte(legacy), 0600)).To(Succeed())
+		config, err := machinery.ReadConfig(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config.APIVersion).To(Equal(machinery.APIVersion))
+		Expect(config.Kind).To(Equal(machinery.KindKitConfig))
+		Expect(config.RemoteURL).To(Equal("https://vault.example.com"))
+
+		backup, err := os.ReadFile(machinery.MigrationBackupPath(path))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(backup)).To(Equal(legacy))
+		upgraded, err := os.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(upgraded)).To(ContainSubstring("apiVersion: " + machinery.APIVersion))
+		Expect(string(upgraded)).To(ContainSubstring("kind: KitConfig"))
+	})
+	It("should not rewrite current configs", func() {
+		Expect(machinery.InitLocal(path, "https://vault.example.com")).To(Succeed())
+		_, err := machinery.ReadConfig(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(machinery.MigrationBackupPath(path)).NotTo(BeAnExistingFile())
+	})
+	It("should report unknown fields", func() {
+		data := "apiVersion: kit/v1\nkind: KitConfig\nremoteUrl: https://vault.example.com\nremoteUri: typo\n"
+		Expect(os.WriteFile(path, []byte(data), 0600)).To(Succeed())
+		_, err := machinery.ReadConfig(path)
+		Expect(err).To(MatchError(machinery.ErrInvalidSchema))
+		Expect(err.Error()).To(ContainSubstring("remoteUri"))
+	})
+	It("should reject unknown versions and kinds", func() {
+		Expect(os.WriteFile(path, []byte("apiVersion: kit/v9\nkind: KitConfig\n"), 0600)).To(Succeed())
+		_, err := machinery.ReadConfig(path)
+		Expect(err).To(MatchError(machinery.ErrUnsupportedAPIVersion))
+
+		Expect(os.WriteFile(path, []byte("apiVersion: kit/v1\nkind: RemoteCache\n"), 0600)).To(Succeed())
+		_, err = machinery.ReadConfig(path)
+		Expect(err).To(MatchError(machinery.ErrInvalidSchema))
+	})
+	It("should upgrade plaintext remote caches without a plaintext backup", func() {
+		Expect(machinery.InitLocal(path, "https://vault.example.com")).To(Succeed())
+		config, err := machinery.ReadConfig(path)
+		Expect(err).NotTo(HaveOccurred())
+		legacy := "latest:\n  clusters: {}\n  users: {}\n  contexts: {}\n  preferences: {}\nhistory: []\n"
+		Expect(os.WriteFile(config.RemoteCachePath(), []byte(legacy), 0600)).To(Succeed())
+
+		cache, err := machinery.ReadRemoteCache(config)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cache.Kind).To(Equal(machinery.KindRemoteCache))
+
+		backup, err := os.ReadFile(machinery.MigrationBackupPath(config.RemoteCachePath()))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(machinery.IsEncryptedCache(backup)).To(BeTrue())
+		data, err := os.ReadFile(config.RemoteCachePath())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(machinery.IsEncryptedCache(data)).To(BeTrue())
+	})
+})
@@ -0,0 +1,155 @@
+package machinery
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type SignaturePolicy string
+
+const (
+	// Unsigned or untrusted contexts are pulled with a warning
+	SignaturePolicyWarn SignaturePolicy = "warn"
+
+	// Unsigned or untrusted contexts are never pulled
+	SignaturePolicyRequire SignaturePolicy = "require"
+)
+
+// TrustedKey is a named ed25519 public key whose pushes are trusted.
+type TrustedKey struct {
+	Name      string `json:"name"`
+	PublicKey string `json:"publicKey"`
+}
+
+func GenerateSigningKey() (ed25519.PrivateKey, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	return priv, err
+}
+
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid signing key file %s", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func WriteSigningKey(path string, key ed25519.PrivateKey) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key.Seed())+"\n"), 0400)
+}
+
+func SigningPublicKey(key ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+}
+
+func DefaultSigningKeyPath(home string) string {
+	return filepath.Join(home, "signing.key")
+}
+
+func (c *KitConfig) SigningKeyPath() string {
+	if c.SigningKeyFile != "" {
+		return c.SigningKeyFile
+	}
+	return DefaultSigningKeyPath(c.Home())
+}
+
+// SignContext adds a signature over the context name and its secret data.
+// The signature and the signer's public key are stored alongside the data.
+func SignContext(name string, data map[string]interface{}, key ed25519.PrivateKey) error {
+	message, err := signedMessage(name, data)
+	if err != nil {
+		return err
+	}
+	data["signature"] = base64.StdEncoding.EncodeToString(ed25519.Sign(key, message))
+	data["signer"] = SigningPublicKey(key)
+	return nil
+}
+
+// VerifyContext checks the signature of a context's secret data against the
+// trusted keys, returning the name of the trusted key that signed it.
+func VerifyContext(name string, data map[string]interface{}, trusted []TrustedKey) (string, error) {
+	signature, _ := data["signature"].(string)
+	signer, _ := data["signer"].(string)
+	if signature == "" || signer == "" {
+		return "", ErrUnsignedContext
+	}
+	pub, err := base64.StdEncoding.DecodeString(signer)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return "", ErrInvalidSignature
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return "", ErrInvalidSignature
+	}
+	message, err := signedMessage(name, data)
+	if err != nil {
+		return "", err
+	}
+	if !ed25519.Verify(pub, message, sig) {
+		return "", ErrInvalidSignature
+	}
+	for _, key := range trusted {
+		if strings.TrimSpace(key.PublicKey) == signer {
+			return key.Name, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrUntrustedSigner, signer)
+}
+
+// signatureIntact reports whether the data carries a signature that is valid
+// for its contents, whether or not the signer is trusted.
+func signatureIntact(name string, data map[string]interface{}) bool {
+	_, err := VerifyContext(name, data, nil)
+	return errors.Is(err, ErrUntrustedSigner)
+}
+
+// signedMessage returns the bytes covered by a context's signature. Encoding
+// the data as JSON sorts its keys, so the message is stable.
+func signedMessage(name string, data map[string]interface{}) ([]byte, error) {
+	unsigned := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		if k != "signature" && k != "signer" {
+			unsigned[k] = v
+		}
+	}
+	payload, err := json.Marshal(unsigned)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(name+"\n"), payload...), nil
+}
+
+// checkSignature applies the configured signature policy to a context read
+// from the remote. It returns an error if the context must not be used.
+func (r *RemoteClient) checkSignature(name string, data map[string]interface{}) error {
+	signer, err := VerifyContext(name, data, r.trustedKeys)
+	switch {
+	case err == nil:
+		log.Debugf("Context %s is signed by %s", name, signer)
+		return nil
+	case IsInvalidSignature(err):
+		// A bad signature means the data was tampered with
+		return fmt.Errorf("context %s: %w", name, err)
+	case r.signaturePolicy == SignaturePolicyRequire:
+		return fmt.Errorf("context %s: %w", name, err)
+	default:
+		log.Warnf("WARNING: context %s cannot be verified: %v", name, err)
+		return nil
+	}
+}
@@ -0,0 +1,177 @@
+package machinery_test
+
+import (
+	"crypto/ed25519"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"sigs.k8s.io/yaml"
+
+	"github.com/kralicky/kit/pkg/machinery"
+)
+
+var _ = Describe("Signing", func() {
+	var key, otherKey ed25519.PrivateKey
+	var trusted []machinery.TrustedKey
+	var data map[string]interface{}
+	BeforeEach(func() {
+		var err error
+		key, err = machinery.GenerateSigningKey()
+		Expect(err).NotTo(HaveOccurred())
+		otherKey, err = machinery.GenerateSigningKey()
+		Expect(err).NotTo(HaveOccurred())
+		trusted = []machinery.TrustedKey{
+			{Name: "alice", PublicKey: machinery.SigningPublicKey(key)},
+		}
+		kubeconfig, err := yaml.Marshal(machinery.ContextConfig(sampleClusters(1), "context1"))
+		Expect(err).NotTo(HaveOccurred())
+		data = map[string]interface{}{
+			"kubeconfig": string(kubeconfig),
+		}
+	})
+
+	It("should verify contexts signed by a trusted key", func() {
+		Expect(machinery.SignContext("context1", data, key)).To(Succeed())
+		signer, err := machinery.VerifyContext("context1", data, trusted)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(signer).To(Equal("alice"))
+	})
+	It("should reject contexts signed by an untrusted key", func() {
+		Expect(machinery.SignContext("context1", data, otherKey)).To(Succeed())
+		_, err := machinery.VerifyContext("context1", data, trusted)
+		Expect(err).To(MatchError(machinery.ErrUntrustedSigner))
+	})
+	It("should reject unsigned contexts", func() {
+		_, err := machinery.VerifyContext("context1", data, trusted)
+		Expect(err).To(MatchError(machinery.ErrUnsignedContext))
+	})
+	It("should reject tampered contexts", func() {
+		Expect(machinery.SignContext("context1", data, key)).To(Succeed())
+		data["kubeconfig"] = "tampered"
+		_, err := machinery.VerifyContext("context1", data, trusted)
+		Expect(err).To(MatchError(machinery.ErrInvalidSignature))
+	})
+	It("should reject signed data moved to a different context", func() {
+		Expect(machinery.SignContext("context1", data, key)).To(Succeed())
+		_, err := machinery.VerifyContext("prod", data, trusted)
+		Expect(err).To(MatchError(machinery.ErrInvalidSignature))
+	})
+
+	Context("with a remote", func() {
+		var vault *stubVault
+		var config *machinery.KitConfig
+		var dir string
+		preserveEnv(machinery.HomeEnv, "VAULT_TOKEN", "VAULT_NAMESPACE")
+		BeforeEach(func() {
+			vault = newStubVault(map[string]interface{}{
+				"LIST /v1/kit/metadata": map[string]interface{}{
+					"data": map[string]interface{}{
+						"keys": []string{"context1"},
+					},
+				},
+				"GET /v1/kit/data/context1": map[string]interface{}{
+					"data": map[string]interface{}{
+						"data": data,
+					},
+				},
+				"PUT /v1/kit/data/context1": map[string]interface{}{},
+			})
+			os.Setenv("VAULT_TOKEN", "test-token")
+			os.Unsetenv("VAULT_NAMESPACE")
+			var err error
+			dir, err = os.MkdirTemp("", "kit-signing")
+			Expect(err).NotTo(HaveOccurred())
+			config = &machinery.KitConfig{
+				RemoteURL:      vault.URL,
+				SigningKeyFile: filepath.Join(dir, "signing.key"),
+				TrustedKeys:    trusted,
+			}
+		})
+		AfterEach(func() {
+			vault.Close()
+			os.RemoveAll(dir)
+		})
+
+		It("should sign pushed contexts", func() {
+			Expect(machinery.WriteSigningKey(config.SigningKeyFile, key)).To(Succeed())
+			client, err := machinery.NewRemoteClient(config)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(client.PushRemoteData(sampleClusters(1))).To(Succeed())
+			var written map[string]interface{}
+			for _, req := range vault.Requests() {
+				if req.Method == "PUT" {
+					written = req.Body["data"].(map[string]interface{})
+				}
+			}
+			Expect(written).To(HaveKeyWithValue("signer", machinery.SigningPublicKey(key)))
+			_, err = machinery.VerifyContext("context1", written, trusted)
+			Expect(err).NotTo(HaveOccurred())
+		})
+		It("should pull unsigned contexts with the warn policy", func() {
+			client, err := machinery.NewRemoteClient(config)
+			Expect(err).NotTo(HaveOccurred())
+			cache, err := client.LoadRemoteData()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cache.Latest.Contexts).To(HaveKey("context1"))
+		})
+		It("should refuse unsigned contexts with the require policy", func() {
+			config.SignaturePolicy = machinery.SignaturePolicyRequire
+			client, err := machinery.NewRemoteClient(config)
+			Expect(err).NotTo(HaveOccurred())
+			cache, err := client.LoadRemoteData()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cache.Latest.Contexts).To(BeEmpty())
+		})
+		It("should refuse contexts with invalid signatures regardless of policy", func() {
+			Expect(machinery.SignContext("context1", data, key)).To(Succeed())
+			data["kubeconfig"] = "tampered"
+			client, err := machinery.NewRemoteClient(config)
+			Expect(err).NotTo(HaveOccurred())
+			cache, err := client.LoadRemoteData()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cache.Latest.Contexts).To(BeEmpty())
+		})
+		It("should keep refused contexts in the local kubeconfig", func() {
+			os.Setenv(machinery.HomeEnv, filepath.Join(dir, "home"))
+			Expect(machinery.SignContext("context1", data, key)).To(Succeed())
+			data["kubeconfig"] = "tampered"
+			config.KubeconfigPath = filepath.Join(dir, "config")
+			Expect(machinery.WriteLocalData(config, &machinery.LocalData{
+				Config: sampleClusters(1),
+			})).To(Succeed())
+			before, err := os.ReadFile(config.KubeconfigPath)
+			Expect(err).NotTo(HaveOccurred())
+
+			client, err := machinery.NewRemoteClient(config)
+			Expect(err).NotTo(HaveOccurred())
+			cache, err := client.LoadRemoteData()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cache.Refused).To(ConsistOf("context1"))
+			Expect(cache.WriteToDisk(config)).To(Succeed())
+			cache, err = machinery.ReadRemoteCache(config)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cache.Refused).To(ConsistOf("context1"))
+
+			local, err := machinery.ReadLocalData(config)
+			Expect(err).NotTo(HaveOccurred())
+			owners := &machinery.Ownership{
+				Contexts: map[string]string{"context1": machinery.DefaultRemoteName},
+			}
+			diff, err := machinery.ComputeRemoteDiff(local.Config, cache, nil, owners, machinery.DefaultRemoteName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(diff.Items).To(BeEmpty())
+			Expect(diff.Apply(local.Config, &cache.Latest, machinery.AutoResolver)).To(Succeed())
+			Expect(machinery.WriteLocalData(config, local)).To(Succeed())
+			after, err := os.ReadFile(config.KubeconfigPath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(after).To(Equal(before))
+		})
+		It("should reject unknown signature policies", func() {
+			config.SignaturePolicy = "sometimes"
+			_, err := machinery.NewRemoteClient(config)
+			Expect(err).To(MatchError(machinery.ErrInvalidSignaturePolicy))
+		})
+	})
+})
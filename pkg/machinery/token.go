@@ -0,0 +1,113 @@
+package machinery
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	log "github.com/sirupsen/logrus"
+)
+
+type TokenStatus struct {
+	// Remaining lifetime of the token. Zero if the token does not expire.
+	TTL       time.Duration
+	Renewable bool
+}
+
+// LookupToken inspects the client's current token using lookup-self.
+func (r *RemoteClient) LookupToken() (*TokenStatus, error) {
+	sec, err := r.VaultClient.Auth().Token().LookupSelf()
+	if err != nil {
+		if isPermissionDenied(err) {
+			return nil, r.authExpiredError()
+		}
+		return nil, err
+	}
+	if sec == nil || sec.Data == nil {
+		return nil, r.authExpiredError()
+	}
+	ttl, err := sec.TokenTTL()
+	if err != nil {
+		return nil, err
+	}
+	renewable, err := sec.TokenIsRenewable()
+	if err != nil {
+		return nil, err
+	}
+	return &TokenStatus{
+		TTL:       ttl,
+		Renewable: renewable,
+	}, nil
+}
+
+// WatchToken keeps the client's token alive in the background by renewing it
+// before its TTL expires, until the context is canceled. Tokens that cannot be
+// renewed are left to expire; once that happens, remote operations will fail
+// with ErrRemoteAuthExpired.
+func (r *RemoteClient) WatchToken(ctx context.Context) error {
+	status, err := r.LookupToken()
+	if err != nil {
+		return err
+	}
+	if status.TTL == 0 {
+		// The token does not expire
+		return nil
+	}
+	if !status.Renewable {
+		log.Warnf("Vault token is not renewable and expires in %s", status.TTL.Round(time.Second))
+		return nil
+	}
+	watcher, err := r.VaultClient.NewLifetimeWatcher(&vaultapi.LifetimeWatcherInput{
+		Secret: &vaultapi.Secret{
+			Auth: &vaultapi.SecretAuth{
+				ClientToken:   r.VaultClient.Token(),
+				Renewable:     status.Renewable,
+				LeaseDuration: int(status.TTL.Seconds()),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	go watcher.Start()
+	go func() {
+		defer watcher.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case renewal := <-watcher.RenewCh():
+				log.Debugf("Renewed vault token (ttl %ds)", renewal.Secret.Auth.LeaseDuration)
+			case err := <-watcher.DoneCh():
+				if err != nil {
+					log.WithError(err).Warn("Failed to renew vault token")
+				} else {
+					log.Warn("Vault token can no longer be renewed and will expire soon")
+				}
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// checkAuth converts permission denied errors into ErrRemoteAuthExpired if
+// the client's token is no longer valid.
+func (r *RemoteClient) checkAuth(err error) error {
+	if err == nil || !isPermissionDenied(err) {
+		return err
+	}
+	if _, lookupErr := r.LookupToken(); IsAuthExpired(lookupErr) {
+		return lookupErr
+	}
+	return err
+}
+
+func (r *RemoteClient) authExpiredError() error {
+	hint := "run 'vault login' to log in again"
+	if r.canLogin {
+		hint = "run 'kit login' to log in again"
+	}
+	return fmt.Errorf("%w: %s", ErrRemoteAuthExpired, hint)
+}
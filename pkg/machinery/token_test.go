@@ -0,0 +1,110 @@
+package machinery_test
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/kralicky/kit/pkg/machinery"
+)
+
+var _ = Describe("Token", func() {
+	var vault *stubVault
+	var client *machinery.RemoteClient
+	preserveEnv("VAULT_TOKEN", "VAULT_NAMESPACE")
+	newClient := func(config *machinery.KitConfig) {
+		config.RemoteURL = vault.URL
+		var err error
+		client, err = machinery.NewRemoteClient(config)
+		Expect(err).NotTo(HaveOccurred())
+	}
+	BeforeEach(func() {
+		os.Setenv("VAULT_TOKEN", "test-token")
+		os.Unsetenv("VAULT_NAMESPACE")
+	})
+	AfterEach(func() {
+		vault.Close()
+	})
+
+	Context("when the token is valid", func() {
+		BeforeEach(func() {
+			vault = newStubVault(map[string]interface{}{
+				"GET /v1/auth/token/lookup-self": map[string]interface{}{
+					"data": map[string]interface{}{
+						"ttl":       3600,
+						"renewable": true,
+					},
+				},
+				"PUT /v1/auth/token/renew-self": map[string]interface{}{
+					"auth": map[string]interface{}{
+						"client_token":   "test-token",
+						"renewable":      true,
+						"lease_duration": 3600,
+					},
+				},
+				"LIST /v1/kit/metadata": http.StatusForbidden,
+			})
+			newClient(&machinery.KitConfig{})
+		})
+		It("should look up the token", func() {
+			status, err := client.LookupToken()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status).To(Equal(&machinery.TokenStatus{
+				TTL:       time.Hour,
+				Renewable: true,
+			}))
+		})
+		It("should renew the token in the background", func() {
+			ctx, ca := context.WithCancel(context.Background())
+			defer ca()
+			Expect(client.WatchToken(ctx)).To(Succeed())
+			Eventually(func() []string {
+				var paths []string
+				for _, req := range vault.Requests() {
+					paths = append(paths, req.Path)
+				}
+				return paths
+			}).Should(ContainElement("/v1/auth/token/renew-self"))
+		})
+		It("should not treat other permission errors as expired auth", func() {
+			_, err := client.LoadRemoteData()
+			Expect(err).To(HaveOccurred())
+			Expect(machinery.IsAuthExpired(err)).To(BeFalse())
+		})
+	})
+
+	Context("when the token is expired", func() {
+		BeforeEach(func() {
+			vault = newStubVault(map[string]interface{}{
+				"GET /v1/auth/token/lookup-self": http.StatusForbidden,
+				"GET /v1/sys/mounts":             http.StatusForbidden,
+				"LIST /v1/kit/metadata":          http.StatusForbidden,
+			})
+		})
+		It("should return ErrRemoteAuthExpired", func() {
+			newClient(&machinery.KitConfig{})
+			_, err := client.LookupToken()
+			Expect(err).To(MatchError(machinery.ErrRemoteAuthExpired))
+			Expect(err.Error()).To(ContainSubstring("vault login"))
+			Expect(client.WatchToken(context.Background())).To(MatchError(machinery.ErrRemoteAuthExpired))
+		})
+		It("should convert permission errors from remote operations", func() {
+			newClient(&machinery.KitConfig{})
+			_, err := client.KitMountExists()
+			Expect(err).To(MatchError(machinery.ErrRemoteAuthExpired))
+			_, err = client.LoadRemoteData()
+			Expect(err).To(MatchError(machinery.ErrRemoteAuthExpired))
+		})
+		It("should suggest kit login if an auth method is configured", func() {
+			newClient(&machinery.KitConfig{
+				Auth: &machinery.AuthConfig{Method: "approle"},
+			})
+			_, err := client.LookupToken()
+			Expect(err.Error()).To(ContainSubstring("kit login"))
+		})
+	})
+})
@@ -0,0 +1,170 @@
+package machinery
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const DefaultTransitMount = "transit"
+
+// TransitConfig enables envelope encryption of remote data using Vault's
+// Transit secret engine. When enabled, contexts are stored as Transit
+// ciphertext, so read access to the KV mount alone is not enough to use the
+// credentials.
+type TransitConfig struct {
+	// Path of the Transit secret engine mount (default "transit")
+	Mount string `json:"mount,omitempty"`
+	// Name of the Transit encryption key
+	Key string `json:"key"`
+}
+
+func (t *TransitConfig) path(op string) string {
+	mount := strings.Trim(t.Mount, "/")
+	if mount == "" {
+		mount = DefaultTransitMount
+	}
+	return path.Join(mount, op, t.Key)
+}
+
+func (r *RemoteClient) transitEncrypt(plaintext []byte) (string, error) {
+	sec, err := r.VaultClient.Logical().Write(r.transit.path("encrypt"), map[string]interface{}{
+		"plaintext": base64.StdEncoding.EncodeToString(plaintext),
+	})
+	if err != nil {
+		return "", r.checkAuth(err)
+	}
+	if sec == nil || sec.Data == nil {
+		return "", ErrTransitNoData
+	}
+	ciphertext, ok := sec.Data["ciphertext"].(string)
+	if !ok {
+		return "", ErrTransitNoData
+	}
+	return ciphertext, nil
+}
+
+func (r *RemoteClient) transitDecrypt(ciphertext string) ([]byte, error) {
+	sec, err := r.VaultClient.Logical().Write(r.transit.path("decrypt"), map[string]interface{}{
+		"ciphertext": ciphertext,
+	})
+	if err != nil {
+		return nil, r.checkAuth(err)
+	}
+	if sec == nil || sec.Data == nil {
+		return nil, ErrTransitNoData
+	}
+	plaintext, ok := sec.Data["plaintext"].(string)
+	if !ok {
+		return nil, ErrTransitNoData
+	}
+	return base64.StdEncoding.DecodeString(plaintext)
+}
+
+func (r *RemoteClient) transitLatestVersion() (int, error) {
+	sec, err := r.VaultClient.Logical().Read(r.transit.path("keys"))
+	if err != nil {
+		return 0, r.checkAuth(err)
+	}
+	if sec == nil || sec.Data == nil {
+		return 0, fmt.Errorf("%w: key %s not found", ErrTransitNoData, r.transit.Key)
+	}
+	version, ok := sec.Data["latest_version"].(json.Number)
+	if !ok {
+		return 0, ErrTransitNoData
+	}
+	v, err := version.Int64()
+	return int(v), err
+}
+
+// RewrapRemoteData re-encrypts all remote contexts whose ciphertext was
+// produced by an older version of the Transit key, so that old key versions
+// can be retired after a rotation. Contexts stored in plaintext are encrypted.
+// It returns the number of contexts that were rewritten.
+func (r *RemoteClient) RewrapRemoteData() (int, error) {
+	if r.transit == nil {
+		return 0, ErrTransitNotConfigured
+	}
+	latest, err := r.transitLatestVersion()
+	if err != nil {
+		return 0, err
+	}
+	names, err := r.listContexts()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, name := range names {
+		data, err := r.readContext(name)
+		if err != nil {
+			if isPermissionDenied(err) {
+				log.Debugf("Skipping context %s: permission denied", name)
+				continue
+			}
+			return count, err
+		}
+		if data == nil || isSealed(data) {
+			// Shared contexts are encrypted to their recipients instead
+			continue
+		}
+		// Rewrapping re-signs the context, so it must not be used to sign
+		// tampered data
+		if err := r.checkSignature(name, data); err != nil {
+			log.Errorf("Not rewrapping %v", err)
+			continue
+		}
+		if _, signed := data["signature"]; signed && r.signingKey == nil {
+			log.Warnf("Not rewrapping context %s: it is signed, and there is no signing key to sign it again", name)
+			continue
+		}
+		ciphertext, ok := data["ciphertext"].(string)
+		if !ok {
+			// Stored before transit encryption was enabled
+			config, err := r.decodeContext(name, data)
+			if err != nil {
+				return count, err
+			}
+			if data, err = r.encodeContext(config); err != nil {
+				return count, err
+			}
+		} else {
+			if transitKeyVersion(ciphertext) >= latest {
+				continue
+			}
+			sec, err := r.VaultClient.Logical().Write(r.transit.path("rewrap"), map[string]interface{}{
+				"ciphertext": ciphertext,
+			})
+			if err != nil {
+				return count, r.checkAuth(err)
+			}
+			if sec == nil || sec.Data == nil {
+				return count, ErrTransitNoData
+			}
+			data["ciphertext"] = sec.Data["ciphertext"]
+		}
+		if err := r.writeContext(name, data); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// transitKeyVersion returns the key version from a ciphertext of the form
+// "vault:v<version>:<data>", or 0 if it cannot be determined.
+func transitKeyVersion(ciphertext string) int {
+	parts := strings.SplitN(ciphertext, ":", 3)
+	if len(parts) != 3 || parts[0] != "vault" || !strings.HasPrefix(parts[1], "v") {
+		return 0
+	}
+	version, err := strconv.Atoi(strings.TrimPrefix(parts[1], "v"))
+	if err != nil {
+		return 0
+	}
+	return version
+}
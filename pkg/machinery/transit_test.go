@@ -0,0 +1,196 @@
+package machinery_test
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"sigs.k8s.io/yaml"
+
+	"github.com/kralicky/kit/pkg/machinery"
+)
+
+var _ = Describe("Transit", func() {
+	var vault *stubVault
+	var config *machinery.KitConfig
+	preserveEnv("VAULT_TOKEN", "VAULT_NAMESPACE")
+	BeforeEach(func() {
+		kubeconfig, err := yaml.Marshal(machinery.ContextConfig(sampleClusters(1), "context1"))
+		Expect(err).NotTo(HaveOccurred())
+		vault = newStubVault(map[string]interface{}{
+			"LIST /v1/kit/metadata": map[string]interface{}{
+				"data": map[string]interface{}{
+					"keys": []string{"context1"},
+				},
+			},
+			"GET /v1/kit/data/context1": map[string]interface{}{
+				"data": map[string]interface{}{
+					"data": map[string]interface{}{
+						"ciphertext": "vault:v1:Y2lwaGVydGV4dA==",
+					},
+				},
+			},
+			"PUT /v1/kit/data/context1": map[string]interface{}{},
+			"PUT /v1/transit/encrypt/kit": map[string]interface{}{
+				"data": map[string]interface{}{
+					"ciphertext": "vault:v1:Y2lwaGVydGV4dA==",
+				},
+			},
+			"PUT /v1/transit/decrypt/kit": map[string]interface{}{
+				"data": map[string]interface{}{
+					"plaintext": base64.StdEncoding.EncodeToString(kubeconfig),
+				},
+			},
+			"GET /v1/transit/keys/kit": map[string]interface{}{
+				"data": map[string]interface{}{
+					"latest_version": 2,
+				},
+			},
+			"PUT /v1/transit/rewrap/kit": map[string]interface{}{
+				"data": map[string]interface{}{
+					"ciphertext": "vault:v2:cmV3cmFwcGVk",
+				},
+			},
+		})
+		os.Setenv("VAULT_TOKEN", "test-token")
+		os.Unsetenv("VAULT_NAMESPACE")
+		config = &machinery.KitConfig{
+			RemoteURL: vault.URL,
+			Transit: &machinery.TransitConfig{
+				Key: "kit",
+			},
+		}
+	})
+	AfterEach(func() {
+		vault.Close()
+	})
+	findRequest := func(method, path string) *stubRequest {
+		for _, req := range vault.Requests() {
+			if req.Method == method && req.Path == path {
+				req := req
+				return &req
+			}
+		}
+		return nil
+	}
+
+	It("should store encrypted contexts", func() {
+		client, err := machinery.NewRemoteClient(config)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(client.PushRemoteData(sampleClusters(1))).To(Succeed())
+		encrypt := findRequest("PUT", "/v1/transit/encrypt/kit")
+		Expect(encrypt).NotTo(BeNil())
+		Expect(encrypt.Body).To(HaveKey("plaintext"))
+		write := findRequest("PUT", "/v1/kit/data/context1")
+		Expect(write).NotTo(BeNil())
+		Expect(write.Body).To(Equal(map[string]interface{}{
+			"data": map[string]interface{}{
+				"ciphertext": "vault:v1:Y2lwaGVydGV4dA==",
+			},
+		}))
+	})
+	It("should decrypt contexts when loading", func() {
+		client, err := machinery.NewRemoteClient(config)
+		Expect(err).NotTo(HaveOccurred())
+		cache, err := client.LoadRemoteData()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cache.Latest.Contexts).To(HaveKey("context1"))
+		Expect(cache.Latest.AuthInfos["authInfo1"].ClientKeyData).To(Equal([]byte("user1ClientKey")))
+	})
+	It("should fail to load encrypted contexts if transit is not configured", func() {
+		config.Transit = nil
+		client, err := machinery.NewRemoteClient(config)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = client.LoadRemoteData()
+		Expect(err).To(MatchError(machinery.ErrTransitNotConfigured))
+	})
+	It("should rewrap contexts encrypted with an older key version", func() {
+		client, err := machinery.NewRemoteClient(config)
+		Expect(err).NotTo(HaveOccurred())
+		count, err := client.RewrapRemoteData()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(count).To(Equal(1))
+		write := findRequest("PUT", "/v1/kit/data/context1")
+		Expect(write).NotTo(BeNil())
+		Expect(write.Body).To(Equal(map[string]interface{}{
+			"data": map[string]interface{}{
+				"ciphertext": "vault:v2:cmV3cmFwcGVk",
+			},
+		}))
+	})
+	It("should not rewrap contexts encrypted with the latest key version", func() {
+		vault.responses["GET /v1/transit/keys/kit"] = map[string]interface{}{
+			"data": map[string]interface{}{
+				"latest_version": 1,
+			},
+		}
+		client, err := machinery.NewRemoteClient(config)
+		Expect(err).NotTo(HaveOccurred())
+		count, err := client.RewrapRemoteData()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(count).To(BeZero())
+		Expect(findRequest("PUT", "/v1/transit/rewrap/kit")).To(BeNil())
+	})
+	Context("with signed contexts", func() {
+		var dir string
+		var data map[string]interface{}
+		var key ed25519.PrivateKey
+		BeforeEach(func() {
+			var err error
+			dir, err = os.MkdirTemp("", "kit-transit")
+			Expect(err).NotTo(HaveOccurred())
+			key, err = machinery.GenerateSigningKey()
+			Expect(err).NotTo(HaveOccurred())
+			data = map[string]interface{}{
+				"ciphertext": "vault:v1:Y2lwaGVydGV4dA==",
+			}
+			Expect(machinery.SignContext("context1", data, key)).To(Succeed())
+			vault.responses["GET /v1/kit/data/context1"] = map[string]interface{}{
+				"data": map[string]interface{}{
+					"data": data,
+				},
+			}
+			config.SigningKeyFile = filepath.Join(dir, "signing.key")
+			config.TrustedKeys = []machinery.TrustedKey{
+				{Name: "test", PublicKey: machinery.SigningPublicKey(key)},
+			}
+		})
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("should sign rewrapped contexts again", func() {
+			Expect(machinery.WriteSigningKey(config.SigningKeyFile, key)).To(Succeed())
+			client, err := machinery.NewRemoteClient(config)
+			Expect(err).NotTo(HaveOccurred())
+			count, err := client.RewrapRemoteData()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(Equal(1))
+			written := findRequest("PUT", "/v1/kit/data/context1").Body["data"].(map[string]interface{})
+			Expect(written["ciphertext"]).To(Equal("vault:v2:cmV3cmFwcGVk"))
+			_, err = machinery.VerifyContext("context1", written, config.TrustedKeys)
+			Expect(err).NotTo(HaveOccurred())
+		})
+		It("should not rewrap tampered contexts", func() {
+			Expect(machinery.WriteSigningKey(config.SigningKeyFile, key)).To(Succeed())
+			data["ciphertext"] = "vault:v1:dGFtcGVyZWQ="
+			client, err := machinery.NewRemoteClient(config)
+			Expect(err).NotTo(HaveOccurred())
+			count, err := client.RewrapRemoteData()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(BeZero())
+			Expect(findRequest("PUT", "/v1/kit/data/context1")).To(BeNil())
+		})
+		It("should not remove signatures without a signing key", func() {
+			client, err := machinery.NewRemoteClient(config)
+			Expect(err).NotTo(HaveOccurred())
+			count, err := client.RewrapRemoteData()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(BeZero())
+			Expect(findRequest("PUT", "/v1/kit/data/context1")).To(BeNil())
+		})
+	})
+})
@@ -38,6 +38,10 @@ const (
 
 	// Some additional things need to be taken care of
 	ChangeTypeComplex
+
+	// Several existing contexts match the incoming one, and a different one
+	// than AffectedExisting may be the one that changed
+	ChangeTypeAmbiguous
 )
 
 type ComplexDiffType int
@@ -59,6 +63,9 @@ const (
 
 	// The kubeconfig needs to be renamed as it conflicts with an existing one
 	ComplexDiffRenameRequired
+
+	// Several existing contexts match the incoming one (see Candidates)
+	ComplexDiffAmbiguousMatch
 )
 
 type Diff struct {
@@ -70,4 +77,7 @@ type DiffItem struct {
 	AffectedExisting NamedContext
 	ChangeType       ChangeType
 	Complex          ComplexDiffType
+	// Existing contexts that match equally well, including AffectedExisting,
+	// if the match is ambiguous
+	Candidates []NamedContext
 }
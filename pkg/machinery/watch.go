@@ -0,0 +1,129 @@
+package machinery
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Time to wait for a burst of writes to the kubeconfig to end, if not
+// configured
+const DefaultWatchDebounce = 2 * time.Second
+
+type WatchPolicy string
+
+const (
+	// Unpushed changes are reported
+	WatchPolicyNotify WatchPolicy = "notify"
+
+	// Unpushed changes are pushed automatically
+	WatchPolicyPush WatchPolicy = "push"
+)
+
+// WatchConfig controls how 'kit watch' reacts to changes to the local
+// kubeconfig.
+type WatchConfig struct {
+	// Either "notify" (default) or "push"
+	Policy WatchPolicy `json:"policy,omitempty"`
+	// Time to wait after a change before reacting to it (default 2s)
+	Debounce *metav1.Duration `json:"debounce,omitempty"`
+}
+
+// WatchPolicy returns the configured watch policy.
+func (c *KitConfig) WatchPolicy() (WatchPolicy, error) {
+	if c.Watch == nil || c.Watch.Policy == "" {
+		return WatchPolicyNotify, nil
+	}
+	switch c.Watch.Policy {
+	case WatchPolicyNotify, WatchPolicyPush:
+		return c.Watch.Policy, nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrInvalidWatchPolicy, c.Watch.Policy)
+}
+
+func (c *KitConfig) WatchDebounce() time.Duration {
+	if c.Watch == nil || c.Watch.Debounce == nil {
+		return DefaultWatchDebounce
+	}
+	return c.Watch.Debounce.Duration
+}
+
+// WatchKubeconfig calls onChange whenever the local kubeconfig files change,
+// until the context is canceled. Changes are debounced, so that a tool
+// rewriting several files, or the same file several times, only results in
+// a single call.
+//
+// The directories containing the kubeconfig files are watched rather than
+// the files themselves, since most tools replace the file instead of
+// writing to it.
+func WatchKubeconfig(ctx context.Context, conf *KitConfig, debounce time.Duration, onChange func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	files := map[string]bool{}
+	dirs := map[string]bool{}
+	kubeconfigDir, isDir := conf.KubeconfigDir()
+	if isDir {
+		kubeconfigDir = filepath.Clean(kubeconfigDir)
+		dirs[kubeconfigDir] = true
+	} else {
+		for _, path := range filepath.SplitList(conf.KubeconfigPath) {
+			if path == "" {
+				continue
+			}
+			files[filepath.Clean(path)] = true
+			dirs[filepath.Dir(path)] = true
+		}
+	}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			return fmt.Errorf("watching %s: %w", dir, err)
+		}
+	}
+	relevant := func(event fsnotify.Event) bool {
+		if event.Op == fsnotify.Chmod {
+			return false
+		}
+		path := filepath.Clean(event.Name)
+		// Lock files and temporary files written while replacing a file
+		base := filepath.Base(path)
+		if strings.HasPrefix(base, ".") || strings.HasSuffix(base, ".lock") {
+			return false
+		}
+		if isDir {
+			return filepath.Dir(path) == kubeconfigDir
+		}
+		return files[path]
+	}
+
+	var fire <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if relevant(event) {
+				fire = time.After(debounce)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			return err
+		case <-fire:
+			fire = nil
+			onChange()
+		}
+	}
+}
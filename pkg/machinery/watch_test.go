@@ -0,0 +1,95 @@
+package machinery_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/kralicky/kit/pkg/machinery"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+var _ = Describe("Watch", func() {
+	var dir string
+	var calls int32
+	var cancel context.CancelFunc
+	var done chan error
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "kit-watch")
+		Expect(err).NotTo(HaveOccurred())
+		atomic.StoreInt32(&calls, 0)
+	})
+	AfterEach(func() {
+		cancel()
+		Eventually(done).Should(Receive(BeNil()))
+		os.RemoveAll(dir)
+	})
+	watch := func(path string) {
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		done = make(chan error, 1)
+		config := &machinery.KitConfig{KubeconfigPath: path}
+		go func() {
+			done <- machinery.WatchKubeconfig(ctx, config, 100*time.Millisecond, func() {
+				atomic.AddInt32(&calls, 1)
+			})
+		}()
+		// Give the watcher time to start
+		time.Sleep(50 * time.Millisecond)
+	}
+	callCount := func() int32 {
+		return atomic.LoadInt32(&calls)
+	}
+
+	It("should debounce several quick writes", func() {
+		file := filepath.Join(dir, "config")
+		watch(file)
+		for i := 1; i <= 3; i++ {
+			Expect(clientcmd.WriteToFile(*sampleClusters(i), file)).To(Succeed())
+		}
+		Eventually(callCount).Should(BeEquivalentTo(1))
+		Consistently(callCount, 300*time.Millisecond).Should(BeEquivalentTo(1))
+	})
+	It("should ignore unrelated files", func() {
+		file := filepath.Join(dir, "config")
+		watch(file)
+		Expect(os.WriteFile(file+".lock", nil, 0600)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, ".config.tmp"), nil, 0600)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "other"), nil, 0600)).To(Succeed())
+		Consistently(callCount, 300*time.Millisecond).Should(BeZero())
+	})
+	It("should notice new files in a kubeconfig directory", func() {
+		watch(dir)
+		Expect(clientcmd.WriteToFile(*sampleClusters(1), filepath.Join(dir, "one.yaml"))).To(Succeed())
+		Eventually(callCount).Should(BeEquivalentTo(1))
+	})
+})
+
+var _ = Describe("Outgoing diff", func() {
+	It("should report unpushed contexts but no deletions", func() {
+		owners := &machinery.Ownership{
+			Contexts: map[string]string{
+				"context1": "platform",
+				"context3": "support",
+			},
+		}
+		diff, err := machinery.ComputeOutgoingDiff(sampleClusters(1, 3, 4), sampleClusters(1, 2), nil, owners, "platform")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(diff.Items).To(HaveLen(1))
+		Expect(diff.Items[0].ChangeType & machinery.ChangeTypeNew).NotTo(BeZero())
+		Expect(diff.Items[0].AffectedIncoming.Name).To(Equal("context4"))
+	})
+	It("should validate the watch policy", func() {
+		config := &machinery.KitConfig{}
+		Expect(config.WatchPolicy()).To(Equal(machinery.WatchPolicyNotify))
+		Expect(config.WatchDebounce()).To(Equal(machinery.DefaultWatchDebounce))
+		config.Watch = &machinery.WatchConfig{Policy: "sometimes"}
+		_, err := config.WatchPolicy()
+		Expect(err).To(MatchError(machinery.ErrInvalidWatchPolicy))
+	})
+})